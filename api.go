@@ -0,0 +1,118 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// openAPISpec documents the JSON API; keep it in sync with the handlers in
+// this file
+//
+//go:embed api/openapi.json
+var openAPISpec []byte
+
+// apiError is the body of every unsuccessful API response
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiResponse is the envelope every API response is wrapped in. Exactly one of
+// Data and Error is set.
+type apiResponse struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *apiError   `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("error marshaling api response: %s", err)
+		status = http.StatusInternalServerError
+		b = []byte(`{"error":{"code":"internal_error","message":"Unable to encode response"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiResponse{Error: &apiError{Code: code, Message: message}})
+}
+
+// apiHandler wraps an API endpoint that needs the current session's record.
+// It takes care of checking the method and session, and of wrapping whatever
+// f returns in the response envelope.
+func (c *CovidRecord) apiHandler(f func(rec *record.Record) interface{}) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is supported")
+			return
+		}
+
+		sess, ok := c.Sessions.Get(r)
+		if !ok || sess.Record == nil {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "No active session; log in with a provider first")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{Data: f(sess.Record)})
+	}
+}
+
+// apiMe returns the normalized patient
+func apiMe(rec *record.Record) interface{} {
+	return rec.Patient
+}
+
+// apiVaccinations returns the list of doses given
+func apiVaccinations(rec *record.Record) interface{} {
+	// always return a list, never null
+	if rec.Doses == nil {
+		return []record.Dose{}
+	}
+	return rec.Doses
+}
+
+// apiTests returns the list of covid tests
+func apiTests(rec *record.Record) interface{} {
+	if rec.Tests == nil {
+		return []record.TestResult{}
+	}
+	return rec.Tests
+}
+
+// apiStatus returns the computed vaccination status
+func apiStatus(rec *record.Record) interface{} {
+	return rec.Summary()
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// apiNotFound handles any unknown path under the API prefix, so that clients
+// get a JSON error rather than the index page
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "No such endpoint")
+}
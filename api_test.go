@@ -0,0 +1,156 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// loggedIn returns a server with a session for a patient with one dose, and
+// the session cookie to send with requests
+func loggedIn(t *testing.T) (*CovidRecord, *http.Cookie) {
+	t.Helper()
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute)}
+
+	w := httptest.NewRecorder()
+	server.Sessions.Create(w, httptest.NewRequest("GET", "/", nil), claimsRecord(mustPersona(t, "pfizer-partial")))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	return server, cookies[0]
+}
+
+func getAPI(t *testing.T, h http.HandlerFunc, method string, cookie *http.Cookie, data interface{}) (int, *apiError) {
+	t.Helper()
+	r := httptest.NewRequest(method, "/api/v1/test", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %s", ct)
+	}
+
+	var body struct {
+		Data  json.RawMessage `json:"data"`
+		Error *apiError       `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid json %s: %s", w.Body.String(), err)
+	}
+	if body.Error == nil && data != nil {
+		if err := json.Unmarshal(body.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, body.Error
+}
+
+func TestAPIMe(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	var pat map[string]interface{}
+	code, apiErr := getAPI(t, server.apiHandler(apiMe), "GET", cookie, &pat)
+	if code != http.StatusOK || apiErr != nil {
+		t.Fatalf("expected 200, got %d %v", code, apiErr)
+	}
+
+	if pat["name"] != "Joseph Esposito" || pat["birth_date"] != "1999-06-01" || pat["source"] != "bluebutton" {
+		t.Errorf("unexpected patient %v", pat)
+	}
+}
+
+func TestAPIVaccinations(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	var doses []map[string]interface{}
+	code, apiErr := getAPI(t, server.apiHandler(apiVaccinations), "GET", cookie, &doses)
+	if code != http.StatusOK || apiErr != nil {
+		t.Fatalf("expected 200, got %d %v", code, apiErr)
+	}
+
+	if len(doses) != 1 {
+		t.Fatalf("expected 1 dose, got %v", doses)
+	}
+	if doses[0]["date"] != "2021-02-01" || doses[0]["cvx"] != "208" || doses[0]["lot"] != "1S892X78-B" {
+		t.Errorf("unexpected dose %v", doses[0])
+	}
+}
+
+func TestAPIStatus(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	var summary record.Summary
+	code, apiErr := getAPI(t, server.apiHandler(apiStatus), "GET", cookie, &summary)
+	if code != http.StatusOK || apiErr != nil {
+		t.Fatalf("expected 200, got %d %v", code, apiErr)
+	}
+
+	if summary.Status != record.StatusPartial || summary.DosesGiven != 1 || summary.DosesRemaining != 1 {
+		t.Errorf("unexpected status %#v", summary)
+	}
+	if summary.NextDoseDue.Format("2006-01-02") != "2021-02-22" {
+		t.Errorf("expected the next dose 21 days after the first, got %s", summary.NextDoseDue)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	code, apiErr := getAPI(t, server.apiHandler(apiStatus), "GET", nil, nil)
+	if code != http.StatusUnauthorized || apiErr == nil || apiErr.Code != "unauthorized" {
+		t.Errorf("expected 401 without a session, got %d %v", code, apiErr)
+	}
+
+	expired := &http.Cookie{Name: sessionCookie, Value: "not-a-session"}
+	code, apiErr = getAPI(t, server.apiHandler(apiStatus), "GET", expired, nil)
+	if code != http.StatusUnauthorized || apiErr == nil {
+		t.Errorf("expected 401 with an unknown session, got %d %v", code, apiErr)
+	}
+
+	code, apiErr = getAPI(t, server.apiHandler(apiStatus), "POST", cookie, nil)
+	if code != http.StatusMethodNotAllowed || apiErr == nil || apiErr.Code != "method_not_allowed" {
+		t.Errorf("expected 405 for a POST, got %d %v", code, apiErr)
+	}
+
+	code, apiErr = getAPI(t, apiNotFound, "GET", cookie, nil)
+	if code != http.StatusNotFound || apiErr == nil {
+		t.Errorf("expected 404, got %d %v", code, apiErr)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/me", "/vaccinations", "/tests", "/status"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("openapi.json is missing %s", path)
+		}
+	}
+}
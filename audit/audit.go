@@ -0,0 +1,238 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records who accessed which health records, and when, in an
+// append-only log. Each event carries a keyed hash of the one before it, so
+// that editing or removing an event breaks the chain. Every server run, or
+// instance, has a chain of its own, which starts from the last event of the
+// run before it, so that removing a whole run breaks the chain too.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// The kinds of event
+const (
+	// Login is the user coming back from logging in to a provider
+	Login = "login"
+	// TokenExchange is trading the login's code for tokens
+	TokenExchange = "token_exchange"
+	// Fetch is reading the patient's resources from the provider
+	Fetch = "fetch"
+	// CardRender is showing the patient their card
+	CardRender = "card_render"
+	// Export is the patient downloading their record, or reading it from the
+	// api
+	Export = "export"
+	// Revocation is revoking the tokens a provider issued
+	Revocation = "revocation"
+)
+
+// The outcomes of an event
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is an entry in the audit log
+type Event struct {
+	// Chain is the id of the chain the event is in. Servers that restart, or
+	// run side by side, write their events to stdout and Cloud Logging in
+	// chains of their own, which end up interleaved.
+	Chain string `json:"chain"`
+	// Seq numbers the events in the chain, from 1
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"event"`
+	// Provider is the id of the provider the record came from
+	Provider string `json:"provider,omitempty"`
+	// Patient is the patient's id at the provider, hashed by Log.Patient
+	Patient string `json:"patient,omitempty"`
+	// Session identifies the user's session without revealing its id
+	Session   string `json:"session,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Path is the url path of the request
+	Path    string `json:"path,omitempty"`
+	Outcome string `json:"outcome"`
+	// Status is the http status of the response, for exports
+	Status int `json:"status,omitempty"`
+	// Resources lists the FHIR resource types fetched
+	Resources []string `json:"resources,omitempty"`
+	// Detail says why the event failed, or anything else notable about it
+	Detail string `json:"detail,omitempty"`
+
+	// Prev is the hash of the event before this one in the chain. The first
+	// event of a chain has the hash of the last event of the run before, or
+	// is empty if it's the first chain in the log.
+	Prev string `json:"prev"`
+	// Hash is the HMAC-SHA256 of Prev and the rest of the event, keyed with
+	// the log's key so that it can't be recomputed after editing the log
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of the event under key, which covers every field but
+// Hash
+func (ev Event) hash(key []byte) (string, error) {
+	ev.Hash = ""
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Sink is somewhere audit events are written
+type Sink interface {
+	Write(ev Event) error
+}
+
+// Log chains events together and writes them to its sinks
+type Log struct {
+	key   []byte
+	sinks []Sink
+	now   func() time.Time
+
+	mu    sync.Mutex
+	chain string
+	seq   uint64
+	prev  string
+}
+
+// New returns a log that writes to sinks, and hashes events and patient ids
+// with key. It starts a new chain, with a random id.
+func New(key []byte, sinks ...Sink) *Log {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &Log{key: key, sinks: sinks, now: time.Now, chain: hex.EncodeToString(b)}
+}
+
+// Follow starts the log's chain from tail, the last event the run before
+// wrote, so that the chain can't be removed from between them unnoticed
+func (l *Log) Follow(tail Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seq == 0 {
+		l.prev = tail.Hash
+	}
+}
+
+// Patient returns a stand-in for a patient's id at a source that's safe to
+// log. It's keyed, so that ids, which are often guessable, can't be found by
+// hashing every possibility.
+func (l *Log) Patient(source, id string) string {
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, l.key)
+	fmt.Fprintf(mac, "%s:%s", source, id)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Record adds ev to the chain and writes it to every sink. Failing to write
+// an event is logged, but doesn't stop the request it's about.
+func (l *Log) Record(ev Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ev.Chain = l.chain
+	ev.Seq = l.seq + 1
+	ev.Time = l.now().UTC()
+	ev.Prev = l.prev
+	hash, err := ev.hash(l.key)
+	if err != nil {
+		log.Printf("error hashing audit event: %s", err)
+		return
+	}
+	ev.Hash = hash
+	l.seq, l.prev = ev.Seq, ev.Hash
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(ev); err != nil {
+			log.Printf("error writing audit event %d: %s", ev.Seq, err)
+		}
+	}
+}
+
+// Verify reads a log written by a JSON or Cloud Logging sink and checks it
+// with the log's key, returning the last event. Each of the chains in it has
+// to be unbroken, and each but the first has to start with its first event,
+// from an event earlier in the log, so that cutting events from the start of
+// a chain, or a whole chain from between two others, is noticed. The first
+// chain may start anywhere, since the log may have been rotated before it,
+// which means Verify can't tell events cut from the start of the log, or from
+// its end, from a log that was rotated or is still being written.
+func Verify(r io.Reader, key []byte) (Event, error) {
+	var last Event
+	chains := map[string]Event{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		ev, err := parseLine(scanner.Bytes())
+		if err != nil {
+			return last, fmt.Errorf("line %d: %w", line, err)
+		}
+		hash, err := ev.hash(key)
+		if err != nil {
+			return last, fmt.Errorf("line %d: %w", line, err)
+		}
+		if !hmac.Equal([]byte(hash), []byte(ev.Hash)) {
+			return last, fmt.Errorf("line %d: event %s/%d has been altered", line, ev.Chain, ev.Seq)
+		}
+		prev, ok := chains[ev.Chain]
+		switch {
+		case ok && (ev.Prev != prev.Hash || ev.Seq != prev.Seq+1):
+			return last, fmt.Errorf("line %d: event %s/%d doesn't follow event %d", line, ev.Chain, ev.Seq, prev.Seq)
+		case !ok && line > 1 && ev.Seq != 1:
+			return last, fmt.Errorf("line %d: chain %s starts at event %d", line, ev.Chain, ev.Seq)
+		case !ok && line > 1 && !seen[ev.Prev]:
+			return last, fmt.Errorf("line %d: chain %s doesn't start from an earlier event", line, ev.Chain)
+		}
+		chains[ev.Chain] = ev
+		seen[ev.Hash] = true
+		last = ev
+	}
+	return last, scanner.Err()
+}
+
+// parseLine reads an event from a line written by either sink
+func parseLine(b []byte) (Event, error) {
+	var entry struct {
+		Audit *Event `json:"audit"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return Event{}, err
+	}
+	if entry.Audit != nil {
+		return *entry.Audit, nil
+	}
+	var ev Event
+	err := json.Unmarshal(b, &ev)
+	return ev, err
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLog returns a log writing json lines to a buffer, with a clock that
+// ticks a second each event
+func newTestLog(sinks ...Sink) *Log {
+	l := New(testKey, sinks...)
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return l
+}
+
+func recordEvents(l *Log) {
+	l.Record(Event{Kind: Login, Provider: "bluebutton", Patient: l.Patient("bluebutton", "-20140000008325"), Outcome: Success})
+	l.Record(Event{Kind: Fetch, Provider: "bluebutton", Resources: []string{"Patient", "ExplanationOfBenefit"}, Outcome: Success})
+	l.Record(Event{Kind: CardRender, Provider: "bluebutton", Outcome: Success})
+}
+
+var testKey = []byte("key")
+
+// tail is the last event l recorded, as far as the next run needs to know
+func tail(l *Log) Event {
+	return Event{Chain: l.chain, Seq: l.seq, Hash: l.prev}
+}
+
+func TestChain(t *testing.T) {
+	var buf bytes.Buffer
+	recordEvents(newTestLog(NewJSONSink(&buf)))
+
+	last, err := Verify(bytes.NewReader(buf.Bytes()), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Seq != 3 || last.Kind != CardRender {
+		t.Errorf("expected to end with the card render, got %+v", last)
+	}
+
+	lines := strings.SplitAfter(strings.TrimSpace(buf.String()), "\n")
+	tampered := map[string]string{
+		"edited":    strings.Replace(buf.String(), `"ExplanationOfBenefit"`, `"Coverage"`, 1),
+		"removed":   lines[0] + lines[2],
+		"reordered": lines[1] + lines[0] + lines[2],
+	}
+	for name, log := range tampered {
+		if _, err := Verify(strings.NewReader(log), testKey); err == nil {
+			t.Errorf("%s: expected the chain to be broken", name)
+		}
+	}
+
+	// the hashes can't be recomputed without the key
+	var rewritten bytes.Buffer
+	l := New([]byte("guessed key"), NewJSONSink(&rewritten))
+	l.now = newTestLog().now
+	recordEvents(l)
+	if _, err := Verify(&rewritten, testKey); err == nil {
+		t.Errorf("expected a log hashed with another key to be refused")
+	}
+
+	// a log that was rotated can still be checked from where it starts
+	if _, err := Verify(strings.NewReader(lines[1]+lines[2]), testKey); err != nil {
+		t.Errorf("expected the rest of the log to verify: %s", err)
+	}
+}
+
+func TestLinkedRuns(t *testing.T) {
+	// the server restarts twice, and each run follows the one before
+	var buf bytes.Buffer
+	first := newTestLog(NewJSONSink(&buf))
+	recordEvents(first)
+	second := newTestLog(NewJSONSink(&buf))
+	second.Follow(tail(first))
+	recordEvents(second)
+	third := newTestLog(NewJSONSink(&buf))
+	third.Follow(tail(second))
+	third.Record(Event{Kind: Export, Outcome: Success, Status: 200})
+
+	last, err := Verify(bytes.NewReader(buf.Bytes()), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Chain != third.chain || last.Seq != 1 {
+		t.Errorf("expected to end with the third run's event, got %+v", last)
+	}
+
+	lines := strings.SplitAfter(strings.TrimSpace(buf.String()), "\n")
+	tampered := map[string]string{
+		"dropped chain":  lines[0] + lines[1] + lines[2] + lines[6],
+		"truncated head": lines[0] + lines[1] + lines[2] + lines[4] + lines[5] + lines[6],
+		"truncated tail": lines[0] + lines[1] + lines[3] + lines[4] + lines[5] + lines[6],
+	}
+	for name, log := range tampered {
+		if _, err := Verify(strings.NewReader(log), testKey); err == nil {
+			t.Errorf("%s: expected the log to be refused", name)
+		}
+	}
+}
+
+func TestInterleavedChains(t *testing.T) {
+	// two instances write to the same log, and one restarts
+	var buf bytes.Buffer
+	a, b, restarted := newTestLog(NewJSONSink(&buf)), newTestLog(NewJSONSink(&buf)), newTestLog(NewJSONSink(&buf))
+	a.Record(Event{Kind: Login, Outcome: Success})
+	b.Follow(tail(a))
+	b.Record(Event{Kind: Login, Outcome: Success})
+	a.Record(Event{Kind: Fetch, Outcome: Success})
+	restarted.Follow(tail(b))
+	restarted.Record(Event{Kind: Login, Outcome: Success})
+	a.Record(Event{Kind: CardRender, Outcome: Success})
+	b.Record(Event{Kind: Fetch, Outcome: Failure})
+
+	last, err := Verify(bytes.NewReader(buf.Bytes()), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Chain != b.chain || last.Seq != 2 {
+		t.Errorf("expected to end with b's second event, got %+v", last)
+	}
+
+	// each chain is still checked
+	lines := strings.SplitAfter(strings.TrimSpace(buf.String()), "\n")
+	if _, err := Verify(strings.NewReader(lines[0]+lines[1]+lines[3]+lines[2]+lines[4]+lines[5]), testKey); err != nil {
+		t.Errorf("expected the order of events in different chains not to matter: %s", err)
+	}
+	if _, err := Verify(strings.NewReader(lines[0]+lines[1]+lines[3]+lines[4]+lines[5]), testKey); err == nil {
+		t.Errorf("expected removing an event from the middle of a's chain to break it")
+	}
+}
+
+func TestCloudSink(t *testing.T) {
+	var buf bytes.Buffer
+	recordEvents(newTestLog(NewCloudSink(&buf)))
+
+	line := strings.SplitN(buf.String(), "\n", 2)[0]
+	for _, want := range []string{`"severity":"NOTICE"`, `"message":"audit login: success"`, `"time":"2021-08-01T12:00:01Z"`, `"logging.googleapis.com/labels":{"chain":"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %s in %s", want, line)
+		}
+	}
+	if _, err := Verify(&buf, testKey); err != nil {
+		t.Errorf("expected the cloud log to verify: %s", err)
+	}
+}
+
+func TestOpenFileFollows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, last, err := OpenFile(path, testKey)
+	if err != nil || last != nil {
+		t.Fatalf("expected a new, empty log, got %v %v", last, err)
+	}
+	recordEvents(newTestLog(sink))
+
+	// the server restarts
+	sink, last, err = OpenFile(path, testKey)
+	if err != nil || last == nil || last.Seq != 3 {
+		t.Fatalf("expected to follow event 3, got %v %v", last, err)
+	}
+	l := newTestLog(sink)
+	l.Follow(*last)
+	l.Record(Event{Kind: Export, Outcome: Failure, Status: 401})
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Verify(bytes.NewReader(b), testKey); err != nil || got.Seq != 1 || got.Prev != last.Hash {
+		t.Errorf("expected a new chain starting from the last run's, got %+v %v", got, err)
+	}
+
+	// a broken log isn't added to
+	if err := os.WriteFile(path, bytes.Replace(b, []byte(`"status":401`), []byte(`"status":200`), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenFile(path, testKey); err == nil {
+		t.Errorf("expected a tampered log to be refused")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.state")
+
+	state, last, err := OpenState(path, testKey)
+	if err != nil || last != nil {
+		t.Fatalf("expected no state yet, got %v %v", last, err)
+	}
+	var buf bytes.Buffer
+	l := newTestLog(NewCloudSink(&buf), state)
+	recordEvents(l)
+
+	// the server restarts, and can't read the cloud log back
+	state, last, err = OpenState(path, testKey)
+	if err != nil || last == nil || last.Seq != 3 || last.Hash != tail(l).Hash {
+		t.Fatalf("expected the last event, got %v %v", last, err)
+	}
+	next := newTestLog(NewCloudSink(&buf), state)
+	next.Follow(*last)
+	next.Record(Event{Kind: Login, Outcome: Success})
+	if _, err := Verify(&buf, testKey); err != nil {
+		t.Errorf("expected the runs to be linked: %s", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(b, []byte(`"seq":1`), []byte(`"seq":9`), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenState(path, testKey); err == nil {
+		t.Errorf("expected a tampered state to be refused")
+	}
+}
+
+func TestPatient(t *testing.T) {
+	l := New([]byte("key"))
+	id := l.Patient("lighthouse", "1012740022V620959")
+	if id == "" || strings.Contains(id, "1012740022") {
+		t.Errorf("expected the id to be hashed, got %q", id)
+	}
+	if l.Patient("lighthouse", "1012740022V620959") != id {
+		t.Errorf("expected the same patient to get the same hash")
+	}
+	if l.Patient("bluebutton", "1012740022V620959") == id {
+		t.Errorf("expected the same id at another source to be another patient")
+	}
+	if New([]byte("other key")).Patient("lighthouse", "1012740022V620959") == id {
+		t.Errorf("expected the hash to depend on the key")
+	}
+	if l.Patient("lighthouse", "") != "" {
+		t.Errorf("expected no hash without an id")
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// lineWriter writes values to w as lines of json, one at a time
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lineWriter) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	_, err = lw.w.Write(append(b, '\n'))
+	return err
+}
+
+// JSONSink writes each event as a line of json
+type JSONSink struct {
+	lines lineWriter
+}
+
+// NewJSONSink returns a sink that writes to w
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{lines: lineWriter{w: w}}
+}
+
+func (s *JSONSink) Write(ev Event) error {
+	return s.lines.writeLine(ev)
+}
+
+// OpenFile opens the json lines file at path for appending, creating it if
+// need be. If it already has events, it returns the last one, for the log to
+// Follow. A file that doesn't Verify with key isn't appended to.
+func OpenFile(path string, key []byte) (*JSONSink, *Event, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := Verify(f, key)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	if last.Seq == 0 {
+		return NewJSONSink(f), nil, nil
+	}
+	return NewJSONSink(f), &last, nil
+}
+
+// StateFile keeps the last event written in a file, for the next run's chain
+// to Follow when the log itself can't be read back, as with stdout and Cloud
+// Logging
+type StateFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+// OpenState opens the state file at path, returning the event it holds, if
+// there is one. An event that wasn't hashed with key is refused.
+func OpenState(path string, key []byte) (*StateFile, *Event, error) {
+	s := &StateFile{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var ev Event
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return nil, nil, fmt.Errorf("audit state %s: %w", path, err)
+	}
+	hash, err := ev.hash(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("audit state %s: %w", path, err)
+	}
+	if !hmac.Equal([]byte(hash), []byte(ev.Hash)) {
+		return nil, nil, fmt.Errorf("audit state %s: event %s/%d has been altered", path, ev.Chain, ev.Seq)
+	}
+	return s, &ev, nil
+}
+
+// Write replaces the event in the file with ev. It writes a new file and
+// renames it over the old one, so that a crash can't leave half an event.
+func (s *StateFile) Write(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// CloudSink writes each event as a line of json in Google Cloud Logging's
+// structured format, which App Engine picks up from stdout
+// https://cloud.google.com/logging/docs/structured-logging
+type CloudSink struct {
+	lines lineWriter
+}
+
+// NewCloudSink returns a sink that writes to w
+func NewCloudSink(w io.Writer) *CloudSink {
+	return &CloudSink{lines: lineWriter{w: w}}
+}
+
+type cloudEntry struct {
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Time     string            `json:"time"`
+	InsertID string            `json:"logging.googleapis.com/insertId"`
+	Labels   map[string]string `json:"logging.googleapis.com/labels"`
+	Audit    Event             `json:"audit"`
+}
+
+func (s *CloudSink) Write(ev Event) error {
+	severity := "NOTICE"
+	if ev.Outcome != Success {
+		severity = "WARNING"
+	}
+	return s.lines.writeLine(cloudEntry{
+		Severity: severity,
+		Message:  fmt.Sprintf("audit %s: %s", ev.Kind, ev.Outcome),
+		Time:     ev.Time.Format(time.RFC3339Nano),
+		InsertID: ev.Hash,
+		Labels:   map[string]string{"log": "audit", "chain": ev.Chain},
+		Audit:    ev,
+	})
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/adhocteam/covidreport/audit"
+	"github.com/adhocteam/covidreport/record"
+)
+
+// newAuditLog writes the audit log to each of the comma separated sinks in
+// AUDIT_LOG: "stdout" for json lines, "cloud" for Cloud Logging's format on
+// stdout, or the path of a json lines file. Events and patient ids are hashed
+// with AUDIT_KEY, from the environment or the secret manager. Only the
+// sandbox may run without one, with a random key instead. The log's chain
+// starts from the last event of the run before, from a file or the state file
+// at AUDIT_STATE.
+func newAuditLog(sandbox bool) *audit.Log {
+	var key []byte
+	if sandbox {
+		key = []byte(env("AUDIT_KEY", ""))
+	} else {
+		key = []byte(envOrSecret("AUDIT_KEY"))
+	}
+	if len(key) == 0 {
+		if !sandbox {
+			panic("AUDIT_KEY must be set, or patients' hashes in the audit log would change when the server restarts")
+		}
+		log.Printf("AUDIT_KEY isn't set, so patients' hashes in the audit log will change when the server restarts")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+
+	var sinks []audit.Sink
+	var last *audit.Event
+	// follow the most recent of the tails we can read back
+	follow := func(ev *audit.Event) {
+		if ev != nil && (last == nil || ev.Time.After(last.Time)) {
+			last = ev
+		}
+	}
+	if path := env("AUDIT_STATE", ""); path != "" {
+		state, ev, err := audit.OpenState(path, key)
+		if err != nil {
+			panic(err)
+		}
+		sinks = append(sinks, state)
+		follow(ev)
+	}
+	for _, name := range strings.Split(env("AUDIT_LOG", "stdout"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "stdout":
+			sinks = append(sinks, audit.NewJSONSink(os.Stdout))
+		case "cloud":
+			sinks = append(sinks, audit.NewCloudSink(os.Stdout))
+		default:
+			sink, ev, err := audit.OpenFile(name, key)
+			if err != nil {
+				panic(err)
+			}
+			sinks = append(sinks, sink)
+			follow(ev)
+		}
+	}
+
+	l := audit.New(key, sinks...)
+	if last != nil {
+		l.Follow(*last)
+	}
+	return l
+}
+
+// logEvent records ev in the audit log, if there is one, with the request
+// it happened in
+func (c *CovidRecord) logEvent(r *http.Request, ev audit.Event) {
+	if c.Audit == nil {
+		return
+	}
+	// background work, like the session janitor, has no request
+	if r != nil {
+		ev.RequestID = requestID(r)
+		ev.Path = r.URL.Path
+	}
+	c.Audit.Record(ev)
+}
+
+// patientRef is the hashed id of the record's patient
+func (c *CovidRecord) patientRef(rec *record.Record) string {
+	if c.Audit == nil || rec == nil {
+		return ""
+	}
+	return c.Audit.Patient(rec.Patient.Source, rec.Patient.ID)
+}
+
+// sessionEvent returns an event about the records in sess. A session can
+// hold records from more than one provider, so it lists each of them, and
+// their patients, in order.
+func (c *CovidRecord) sessionEvent(kind string, sess *Session) audit.Event {
+	ev := audit.Event{Kind: kind, Session: sessionRef(sess.ID)}
+	sources := make([]string, 0, len(sess.Sources))
+	for source := range sess.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var providers, patients []string
+	for _, source := range sources {
+		provider := source
+		if c.Providers != nil {
+			if p, ok := c.Providers.bySource(source); ok {
+				provider = p.ID
+			}
+		}
+		providers = append(providers, provider)
+		patients = append(patients, c.patientRef(sess.Sources[source]))
+	}
+	ev.Provider = strings.Join(providers, ",")
+	ev.Patient = strings.Join(patients, ",")
+	return ev
+}
+
+// outcome is the audit outcome of an error
+func outcome(err error) string {
+	if err != nil {
+		return audit.Failure
+	}
+	return audit.Success
+}
+
+// statusRecorder remembers the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditExport records an export event for every response from f, which hands
+// the session's record over in some form
+func (c *CovidRecord) auditExport(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.Audit == nil {
+			f(w, r)
+			return
+		}
+		sess, _ := c.Sessions.Get(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		f(rec, r)
+
+		ev := audit.Event{Kind: audit.Export}
+		if sess != nil {
+			ev = c.sessionEvent(audit.Export, sess)
+		}
+		ev.Status = rec.status
+		ev.Outcome = audit.Success
+		if rec.status >= 400 {
+			ev.Outcome = audit.Failure
+		}
+		c.logEvent(r, ev)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adhocteam/covidreport/audit"
+)
+
+func auditEvents(t *testing.T, buf *bytes.Buffer) []audit.Event {
+	t.Helper()
+	if _, err := audit.Verify(bytes.NewReader(buf.Bytes()), []byte("key")); err != nil {
+		t.Fatalf("expected an unbroken audit log: %s", err)
+	}
+	var events []audit.Event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var ev audit.Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	server, _, _ := newRevocationServer()
+	var buf bytes.Buffer
+	server.Audit = audit.New([]byte("key"), audit.NewJSONSink(&buf))
+	handler := server.Handler()
+	session := login(t, handler, "abc")
+
+	r := httptest.NewRequest("GET", "/card.pdf", nil)
+	r.AddCookie(session)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	// an export without a session is a failure
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/me", nil))
+	r = httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(session)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	events := auditEvents(t, &buf)
+	var kinds []string
+	for _, ev := range events {
+		kinds = append(kinds, ev.Kind+" "+ev.Outcome)
+	}
+	want := "token_exchange success, fetch success, login success, card_render success, export success, export failure, revocation success"
+	if got := strings.Join(kinds, ", "); got != want {
+		t.Fatalf("expected events %s, got %s", want, got)
+	}
+
+	patient := server.Audit.Patient("bluebutton", "persona:pfizer-complete")
+	fetch, login, card, export, revocation := events[1], events[2], events[3], events[4], events[6]
+	if fetch.Patient != patient || len(fetch.Resources) != 1 || fetch.Resources[0] != "Patient" {
+		t.Errorf("unexpected fetch %+v", fetch)
+	}
+	if login.Provider != "fake" || login.Patient != patient || login.Session == "" || login.RequestID == "" {
+		t.Errorf("unexpected login %+v", login)
+	}
+	if card.RequestID != login.RequestID || card.Session != login.Session || card.Patient != patient {
+		t.Errorf("expected the card to be audited with the login's request, got %+v", card)
+	}
+	if export.Path != "/card.pdf" || export.Status != 200 || export.Patient != patient || export.RequestID == login.RequestID {
+		t.Errorf("unexpected export %+v", export)
+	}
+	if events[5].Status != 401 || events[5].Patient != "" {
+		t.Errorf("unexpected export without a session %+v", events[5])
+	}
+	if revocation.Detail != revokeLogout || revocation.Session != login.Session {
+		t.Errorf("unexpected revocation %+v", revocation)
+	}
+
+	if log := buf.String(); strings.Contains(log, "pfizer-complete") || strings.Contains(log, session.Value) {
+		t.Errorf("expected patient ids and sessions to be hashed, got %s", log)
+	}
+}
+
+func TestAuditFailedLogin(t *testing.T) {
+	server, _, _ := newRevocationServer()
+	var buf bytes.Buffer
+	server.Audit = audit.New([]byte("key"), audit.NewJSONSink(&buf))
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/auth/fake/callback?code=abc&state=forged", nil))
+	if w.Code != 400 {
+		t.Fatalf("expected the login to be refused, got %d", w.Code)
+	}
+	events := auditEvents(t, &buf)
+	if len(events) != 1 || events[0].Kind != audit.Login || events[0].Outcome != audit.Failure || events[0].Detail != "state mismatch" {
+		t.Errorf("expected a failed login, got %+v", events)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/adhocteam/covidreport/audit"
+)
+
+// stateCookie holds the oauth state between sending the user to a provider
+// and them coming back to our callback
+const stateCookie = "covidrecord_oauth_state"
+
+// authStartHandler sends the user to log in to p, remembering the state we
+// expect them to come back with
+func (c *CovidRecord) authStartHandler(p *registeredProvider) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := makeSessionID()
+		authURL, err := p.impl.AuthURL(state)
+		if err != nil {
+			log.Printf("error starting login to %s: %s", p.ID, err)
+			renderError(w, r, http.StatusBadGateway, errors.New(catalog(r).T("error.unreachable", p.Name)))
+			return
+		}
+
+		http.SetCookie(w, newStateCookie(r, state, 10*60))
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// newStateCookie returns the cookie that keeps a login's state, or clears it
+// if maxAge is negative. The path is / because Blue Button and VA Lighthouse
+// call back to /bbcallback and /callback.
+func newStateCookie(r *http.Request, state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   isTLS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// authCallbackHandler is where p sends the user back to after they log in. It
+// loads their record and adds it to their session.
+func (c *CovidRecord) authCallbackHandler(p *registeredProvider) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// every login is audited, whether or not it works
+		loginFailed := func(detail string) {
+			c.logEvent(r, audit.Event{Kind: audit.Login, Provider: p.ID, Outcome: audit.Failure, Detail: detail})
+		}
+
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			log.Printf("%s returned an error: %s %s", p.ID, e, query.Get("error_description"))
+			loginFailed("provider error: " + e)
+			renderError(w, r, http.StatusBadRequest, errors.New(catalog(r).T("error.notShared", p.Name, e)))
+			return
+		}
+
+		// pull the token out of the callback parameters
+		code := query.Get("code")
+		if code == "" {
+			loginFailed("no code")
+			renderError(w, r, http.StatusBadRequest, errors.New(catalog(r).T("error.noCode", p.Name)))
+			return
+		}
+		state := query.Get("state")
+		cookie, err := r.Cookie(stateCookie)
+		if err != nil || cookie.Value == "" || cookie.Value != state {
+			loginFailed("state mismatch")
+			renderError(w, r, http.StatusBadRequest, errors.New(catalog(r).T("error.loginExpired", p.Name)))
+			return
+		}
+		// wait for our turn before using up the state, so that if we're too
+		// busy the user can reload the page to try again
+		done, ok := c.startFetch(r.Context())
+		if !ok {
+			loginFailed("too many fetches")
+			w.Header().Set("Retry-After", strconv.Itoa(int(fetchWait.Seconds())))
+			renderError(w, r, http.StatusServiceUnavailable, errors.New(catalog(r).T("error.busy")))
+			return
+		}
+		// the state is only good once
+		http.SetCookie(w, newStateCookie(r, "", -1))
+
+		var resources []string
+		rec, tokens, err := p.impl.FetchRecord(code, state, func(resource string) {
+			resources = append(resources, resource)
+		})
+		done()
+
+		// we only get tokens if the code was exchanged
+		if err != nil && tokens.Access == "" {
+			c.logEvent(r, audit.Event{Kind: audit.TokenExchange, Provider: p.ID, Outcome: audit.Failure, Detail: err.Error()})
+			loginFailed("token exchange failed")
+			renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		c.logEvent(r, audit.Event{Kind: audit.TokenExchange, Provider: p.ID, Outcome: audit.Success})
+		fetch := audit.Event{Kind: audit.Fetch, Provider: p.ID, Patient: c.patientRef(rec), Outcome: outcome(err), Resources: resources}
+		if err != nil {
+			fetch.Detail = err.Error()
+		}
+		c.logEvent(r, fetch)
+		if err != nil {
+			c.revoke(r, p, "", tokens, revokeFetchFailed)
+			loginFailed("fetch failed")
+			renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		sess, err := c.Sessions.Link(w, r, rec)
+		if err != nil {
+			log.Printf("not linking records: %s", err)
+			c.revoke(r, p, sess.ID, tokens, revokeNotLinked)
+			c.logEvent(r, audit.Event{Kind: audit.Login, Provider: p.ID, Patient: c.patientRef(rec), Session: sessionRef(sess.ID), Outcome: audit.Failure, Detail: "not linked"})
+			renderError(w, r, http.StatusConflict, err)
+			return
+		}
+		c.logEvent(r, audit.Event{Kind: audit.Login, Provider: p.ID, Patient: c.patientRef(rec), Session: sessionRef(sess.ID), Outcome: audit.Success})
+
+		// we have everything we need from the provider
+		if c.RevokeAfterFetch {
+			c.revoke(r, p, sess.ID, tokens, revokeAfterFetch)
+		} else if old, ok := c.Sessions.SetTokens(sess.ID, p.impl.Source(), tokens); ok {
+			c.revoke(r, p, sess.ID, old, revokeReplaced)
+		}
+		c.renderCard(w, r, sess, c.unlinkedProviders(sess))
+	}
+}
+
+// logoutHandler ends the user's session and revokes the tokens their
+// providers issued
+func (c *CovidRecord) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderError(w, r, http.StatusMethodNotAllowed, errors.New(catalog(r).T("error.logoutMethod")))
+		return
+	}
+
+	sess, ok := c.Sessions.Delete(w, r)
+	if ok {
+		c.revokeSession(r, sess, revokeLogout)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
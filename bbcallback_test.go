@@ -0,0 +1,138 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton/bbtest"
+)
+
+// newBlueButtonServer returns a server whose only provider is a fake Blue
+// Button
+func newBlueButtonServer(t *testing.T) (*CovidRecord, *bbtest.Server) {
+	t.Helper()
+	bb := bbtest.NewServer("bb-client", "bb-secret")
+	t.Cleanup(bb.Close)
+	reg, err := NewRegistry([]ProviderConfig{{
+		ID:           "bluebutton",
+		Type:         providerBlueButton,
+		Name:         "Blue Button",
+		AuthURL:      bb.URL,
+		ClientID:     "bb-client",
+		ClientSecret: "bb-secret",
+		RedirectURL:  "https://localhost.dev:6655/bbcallback",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CovidRecord{Sessions: NewSessionStore(time.Minute), Providers: reg}, bb
+}
+
+// bbLogin logs in to the fake Blue Button as scenario, and returns the
+// response to the callback
+func bbLogin(t *testing.T, handler http.Handler, scenario string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	return fakeLogin(t, handler, "bluebutton", bbtest.Login, scenario, cookies...)
+}
+
+// fakeLogin goes through the login to a fake provider as scenario, with the
+// given cookies, and returns the response to the callback. login follows the
+// provider's authorization url.
+func fakeLogin(t *testing.T, handler http.Handler, provider string, login func(authURL, scenario string) (*url.URL, error), scenario string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/"+provider+"/start", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to %s, got %d: %s", provider, w.Code, w.Body)
+	}
+	state := w.Result().Cookies()[0]
+
+	back, err := login(w.Header().Get("Location"), scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", back.RequestURI(), nil)
+	r.AddCookie(state)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestBlueButtonCallback(t *testing.T) {
+	tests := []struct {
+		scenario string
+		status   int
+		expect   []string
+	}{
+		{"pfizer-complete", http.StatusOK, []string{"Marta J Quigley", "17 Mar 1948", "VACCINATION COMPLETE", "11 Jan 2021", "1 Feb 2021"}},
+		{"moderna-partial", http.StatusOK, []string{"Harold Okafor", "PARTIAL VACCINATION", "22 Feb 2021"}},
+		{"unvaccinated", http.StatusOK, []string{"Ruth A Castellanos", "VACCINATION PENDING", "PCR test", "30 Aug 2021", "Result not reported"}},
+		{"claims-outage", http.StatusInternalServerError, nil},
+		{"deny", http.StatusBadRequest, []string{"access_denied"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			server, _ := newBlueButtonServer(t)
+			w := bbLogin(t, server.Handler(), tt.scenario)
+			if w.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			for _, s := range tt.expect {
+				if !strings.Contains(w.Body.String(), s) {
+					t.Errorf("expected the page to contain %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestBlueButtonRevocation(t *testing.T) {
+	server, bb := newBlueButtonServer(t)
+	handler := server.Handler()
+
+	// a failed fetch revokes the token straight away
+	bbLogin(t, handler, "claims-outage")
+	if len(bb.Revoked()) != 1 {
+		t.Fatalf("expected the token to be revoked after the fetch failed, got %v", bb.Revoked())
+	}
+
+	w := bbLogin(t, handler, "pfizer-complete")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the card, got %d: %s", w.Code, w.Body)
+	}
+	if len(bb.Revoked()) != 1 {
+		t.Fatalf("didn't expect the token to be revoked before logging out")
+	}
+
+	r := httptest.NewRequest("POST", "/logout", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if len(bb.Revoked()) != 2 {
+		t.Errorf("expected the token to be revoked on logout, got %v", bb.Revoked())
+	}
+}
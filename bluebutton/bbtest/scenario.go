@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package bbtest
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+)
+
+//go:embed scenarios/*.json
+var scenarioFiles embed.FS
+
+// Scenario is a Medicare beneficiary the fake Blue Button can log in as: who
+// they are, and the claims it has for them
+type Scenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// User is what /v1/connect/userinfo returns
+	User UserInfo `json:"user"`
+	// Patient is the FHIR Patient resource served for User.Patient
+	Patient json.RawMessage `json:"patient"`
+	// Claims are served as ExplanationOfBenefit resources, one item each
+	Claims []Claim `json:"claims"`
+	// PageSize is how many claims go in a page of results; 10 if it's unset
+	PageSize int `json:"page_size"`
+	// Failures makes an endpoint fail with the given HTTP status. The keys
+	// are "token", "userinfo", "patient" and "eob".
+	Failures map[string]int `json:"failures"`
+}
+
+// UserInfo is a Blue Button user
+// https://bluebutton.cms.gov/developers/#core-resources
+type UserInfo struct {
+	Sub        string `json:"sub"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Created    string `json:"created"`
+	// Patient is the user's FHIR id
+	Patient string `json:"patient"`
+}
+
+// Claim is a line on a claim: a procedure on a day
+type Claim struct {
+	// Type is the claim type, like CARRIER or OUTPATIENT
+	Type string `json:"type"`
+	// Date is the day of service, like 2021-01-04
+	Date    string `json:"date"`
+	Code    string `json:"code"`
+	Display string `json:"display"`
+}
+
+// Scenarios returns the scenarios that ship with the package, sorted by name
+func Scenarios() ([]Scenario, error) {
+	names, err := scenarioFiles.ReadDir("scenarios")
+	if err != nil {
+		return nil, err
+	}
+	var scenarios []Scenario
+	for _, f := range names {
+		b, err := scenarioFiles.ReadFile(path.Join("scenarios", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var s Scenario
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", f.Name(), err)
+		}
+		if s.Name == "" || s.User.Patient == "" {
+			return nil, fmt.Errorf("scenario %s needs a name and a patient", f.Name())
+		}
+		scenarios = append(scenarios, s)
+	}
+	sort.Slice(scenarios, func(i, j int) bool { return scenarios[i].Name < scenarios[j].Name })
+	return scenarios, nil
+}
+
+// MustScenario returns the shipped scenario with the given name, and panics if
+// there isn't one
+func MustScenario(name string) Scenario {
+	scenarios, err := Scenarios()
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range scenarios {
+		if s.Name == name {
+			return s
+		}
+	}
+	panic(fmt.Sprintf("no blue button scenario %q", name))
+}
+
+func (s Scenario) pageSize() int {
+	if s.PageSize <= 0 {
+		return 10
+	}
+	return s.PageSize
+}
+
+// eob renders claim i as an ExplanationOfBenefit
+func (s Scenario) eob(i int) map[string]interface{} {
+	c := s.Claims[i]
+	return map[string]interface{}{
+		"resourceType": "ExplanationOfBenefit",
+		"id":           fmt.Sprintf("carrier%s-%d", s.User.Patient, i+1),
+		"status":       "active",
+		"type": map[string]interface{}{
+			"coding": []map[string]string{{
+				"system": "https://bluebutton.cms.gov/resources/codesystem/eob-type",
+				"code":   c.Type,
+			}},
+		},
+		"patient": map[string]string{"reference": "Patient/" + s.User.Patient},
+		"billablePeriod": map[string]string{
+			"start": c.Date,
+			"end":   c.Date,
+		},
+		"item": []map[string]interface{}{{
+			"sequence": 1,
+			"service": map[string]interface{}{
+				"coding": []map[string]string{{
+					"system":  "https://bluebutton.cms.gov/resources/codesystem/hcpcs",
+					"code":    c.Code,
+					"display": c.Display,
+				}},
+			},
+			"servicedDate": c.Date,
+		}},
+	}
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bbtest is a fake Blue Button, for testing the app end to end
+// without the sandbox. It implements the authorization code flow, userinfo,
+// Patient and paged ExplanationOfBenefit endpoints, serving the beneficiaries
+// described by its scenarios.
+package bbtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Blue Button, listening on a local port
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	mu        sync.Mutex
+	scenarios []Scenario
+	// codes are the authorization codes we've handed out and not yet
+	// exchanged
+	codes map[string]grant
+	// tokens maps access tokens to the name of their scenario
+	tokens  map[string]string
+	revoked []string
+}
+
+type grant struct {
+	scenario    string
+	redirectURI string
+}
+
+// NewServer starts a fake Blue Button serving the given scenarios, and
+// accepting the given client credentials. With no scenarios, it serves the
+// ones that ship with the package. Close it when you're done.
+func NewServer(clientID, clientSecret string, scenarios ...Scenario) *Server {
+	if len(scenarios) == 0 {
+		var err error
+		scenarios, err = Scenarios()
+		if err != nil {
+			panic(err)
+		}
+	}
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		scenarios:    scenarios,
+		codes:        map[string]grant{},
+		tokens:       map[string]string{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/o/authorize/", s.authorize)
+	mux.HandleFunc("/v1/o/token/", s.token)
+	mux.HandleFunc("/v1/o/revoke_token/", s.revoke)
+	mux.HandleFunc("/v1/connect/userinfo", s.userinfo)
+	mux.HandleFunc("/v1/fhir/Patient/", s.patient)
+	mux.HandleFunc("/v1/fhir/ExplanationOfBenefit", s.eob)
+	mux.HandleFunc("/v1/fhir/ExplanationOfBenefit/", s.eob)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Revoked returns the tokens that have been revoked, in order
+func (s *Server) Revoked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.revoked...)
+}
+
+func (s *Server) scenario(name string) (Scenario, bool) {
+	for _, sc := range s.scenarios {
+		if sc.Name == name {
+			return sc, true
+		}
+	}
+	return Scenario{}, false
+}
+
+// authenticated returns the scenario of the request's bearer token
+func (s *Server) authenticated(r *http.Request) (Scenario, bool) {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	name, ok := s.tokens[tok]
+	s.mu.Unlock()
+	if !ok {
+		return Scenario{}, false
+	}
+	return s.scenario(name)
+}
+
+// fail writes the scenario's failure for endpoint, if it has one
+func fail(w http.ResponseWriter, sc Scenario, endpoint string) bool {
+	status, ok := sc.Failures[endpoint]
+	if !ok {
+		return false
+	}
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+var chooseTmpl = template.Must(template.New("choose").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Fake Blue Button</title></head>
+<body>
+<h1>Fake Blue Button</h1>
+<p>Log in as:</p>
+<ul>
+{{range .Scenarios}}<li><a href="{{$.Base}}&scenario={{.Name}}">{{.User.Name}}</a> &mdash; {{.Description}}</li>
+{{end}}</ul>
+<p><a href="{{.Base}}&scenario=deny">Don't share my records</a></p>
+</body>
+</html>
+`))
+
+// authorize is the login page. Given a scenario parameter, it logs in as that
+// scenario straight away, which is what the tests do; otherwise it lists the
+// scenarios to pick from. The scenario "deny" refuses to share records.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "unknown client or response type", http.StatusBadRequest)
+		return
+	}
+
+	name := q.Get("scenario")
+	if name == "" {
+		err := chooseTmpl.Execute(w, map[string]interface{}{
+			"Base":      r.URL.String(),
+			"Scenarios": s.scenarios,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	back := redirectURI.Query()
+	back.Set("state", q.Get("state"))
+	if name == "deny" {
+		back.Set("error", "access_denied")
+	} else {
+		if _, ok := s.scenario(name); !ok {
+			http.Error(w, "unknown scenario", http.StatusNotFound)
+			return
+		}
+		code := randomToken()
+		s.mu.Lock()
+		s.codes[code] = grant{scenario: name, redirectURI: q.Get("redirect_uri")}
+		s.mu.Unlock()
+		back.Set("code", code)
+	}
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code for an access token. Codes can only
+// be used once.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if r.Method != http.MethodPost || !ok || id != s.ClientID || secret != s.ClientSecret {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	code := r.PostFormValue("code")
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !ok || g.redirectURI != r.PostFormValue("redirect_uri") {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	sc, _ := s.scenario(g.scenario)
+	if fail(w, sc, "token") {
+		return
+	}
+
+	access := randomToken()
+	s.mu.Lock()
+	s.tokens[access] = sc.Name
+	s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{
+		"access_token":  access,
+		"expires_in":    36000,
+		"token_type":    "Bearer",
+		"scope":         "profile patient/Patient.read patient/ExplanationOfBenefit.read",
+		"refresh_token": randomToken(),
+		"patient":       sc.User.Patient,
+	})
+}
+
+// revoke revokes an access token
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("client_id") != s.ClientID || r.PostFormValue("client_secret") != s.ClientSecret {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	tok := r.PostFormValue("token")
+	s.mu.Lock()
+	delete(s.tokens, tok)
+	s.revoked = append(s.revoked, tok)
+	s.mu.Unlock()
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	sc, ok := s.authenticated(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if fail(w, sc, "userinfo") {
+		return
+	}
+	writeJSON(w, sc.User)
+}
+
+// patient serves the token's own patient, and nobody else
+func (s *Server) patient(w http.ResponseWriter, r *http.Request) {
+	sc, ok := s.authenticated(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if strings.TrimPrefix(r.URL.Path, "/v1/fhir/Patient/") != sc.User.Patient {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if fail(w, sc, "patient") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.Write(sc.Patient)
+}
+
+// eob serves the patient's claims as a searchset bundle, a page at a time.
+// Like Blue Button, it pages with startIndex and links to the next page.
+func (s *Server) eob(w http.ResponseWriter, r *http.Request) {
+	sc, ok := s.authenticated(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("patient") != sc.User.Patient {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if fail(w, sc, "eob") {
+		return
+	}
+
+	start, _ := strconv.Atoi(q.Get("startIndex"))
+	if start < 0 || (start > 0 && start >= len(sc.Claims)) {
+		http.Error(w, "startIndex out of range", http.StatusBadRequest)
+		return
+	}
+	end := start + sc.pageSize()
+	if end > len(sc.Claims) {
+		end = len(sc.Claims)
+	}
+
+	page := func(i int) string {
+		v := url.Values{}
+		v.Set("patient", sc.User.Patient)
+		v.Set("_count", strconv.Itoa(sc.pageSize()))
+		v.Set("startIndex", strconv.Itoa(i))
+		return fmt.Sprintf("%s/v1/fhir/ExplanationOfBenefit/?%s", s.URL, v.Encode())
+	}
+	links := []map[string]string{
+		{"relation": "first", "url": page(0)},
+		{"relation": "self", "url": page(start)},
+	}
+	if end < len(sc.Claims) {
+		links = append(links, map[string]string{"relation": "next", "url": page(end)})
+	}
+
+	var entries []map[string]interface{}
+	for i := start; i < end; i++ {
+		entries = append(entries, map[string]interface{}{"resource": sc.eob(i)})
+	}
+	writeJSON(w, map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "searchset",
+		"total":        len(sc.Claims),
+		"link":         links,
+		"entry":        entries,
+	})
+}
+
+// Login follows authURL, a link to the server's authorization endpoint, as
+// scenario, and returns where the server sends the user back to: the redirect
+// uri, with a code and the state
+func Login(authURL, scenario string) (*url.URL, error) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(authURL + "&scenario=" + url.QueryEscape(scenario))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("expected a redirect back, got %s", resp.Status)
+	}
+	return resp.Location()
+}
@@ -15,7 +15,6 @@ package bluebutton
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -49,19 +48,15 @@ func (c *Client) String() string {
 		c.CallbackURL)
 }
 
-func makeRandomState() string {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
-	if err != nil {
-		panic("Unable to get random numbers")
-	}
-	return fmt.Sprintf("%x", b)
-}
-
-func (c *Client) AuthURL() string {
-	// should url-encode the params
-	return fmt.Sprintf("%s/v1/o/authorize/?client_id=%s&redirect_uri=%s&response_type=code&state=%s",
-		c.BBURL, c.BBClientID, c.CallbackURL, makeRandomState())
+// AuthURL returns the url to send the user to to log in to Blue Button.
+// state is handed back to our callback.
+func (c *Client) AuthURL(state string) string {
+	params := url.Values{}
+	params.Set("client_id", c.BBClientID)
+	params.Set("redirect_uri", c.CallbackURL)
+	params.Set("response_type", "code")
+	params.Set("state", state)
+	return fmt.Sprintf("%s/v1/o/authorize/?%s", c.BBURL, params.Encode())
 }
 
 // FullToken represents the "full token" returned by blue button
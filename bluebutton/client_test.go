@@ -17,6 +17,8 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"testing"
+
+	"github.com/adhocteam/covidreport/bluebutton/bbtest"
 )
 
 func TestParsePatient(t *testing.T) {
@@ -36,3 +38,71 @@ func TestParsePatient(t *testing.T) {
 		t.Errorf("unexpected patient %#v", pat)
 	}
 }
+
+// fakeClient returns a client for a fake Blue Button, and a code for a login
+// as scenario
+func fakeClient(t *testing.T, scenario string) (*bbtest.Server, *Client, string) {
+	t.Helper()
+	srv := bbtest.NewServer("covidrecord", "shh")
+	t.Cleanup(srv.Close)
+	c := &Client{
+		BBClientID:     "covidrecord",
+		BBClientSecret: "shh",
+		BBURL:          srv.URL,
+		CallbackURL:    "https://localhost.dev:6655/bbcallback",
+	}
+	back, err := bbtest.Login(c.AuthURL("the-state"), scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Query().Get("state") != "the-state" {
+		t.Errorf("expected the state to be handed back, got %s", back)
+	}
+	return srv, c, back.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	_, c, code := fakeClient(t, "pfizer-complete")
+
+	tok, err := c.GetFullToken(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken == "" || tok.RefreshToken == "" {
+		t.Errorf("unexpected token %#v", tok)
+	}
+	if _, err := c.GetFullToken(code); err == nil {
+		t.Errorf("expected a code to only be good once")
+	}
+
+	user, err := c.GetUserInfo(tok.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FhirID != "-20000000002001" || user.Name != "Marta Quigley" {
+		t.Errorf("unexpected user %#v", user)
+	}
+
+	pat, err := c.GetPatient(user.FhirID, tok.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pat.Name[0].Family != "Quigley" || pat.BirthDate.Format("2006-01-02") != "1948-03-17" {
+		t.Errorf("unexpected patient %#v", pat)
+	}
+
+	if _, err := c.GetPatient("-20000000002002", tok.AccessToken); err == nil {
+		t.Errorf("expected someone else's patient record to be refused")
+	}
+	if _, err := c.GetUserInfo("made-up"); err == nil {
+		t.Errorf("expected a made up token to be refused")
+	}
+}
+
+func TestLoginBadSecret(t *testing.T) {
+	_, c, code := fakeClient(t, "pfizer-complete")
+	c.BBClientSecret = "wrong"
+	if _, err := c.GetFullToken(code); err == nil {
+		t.Errorf("expected the wrong client secret to be refused")
+	}
+}
@@ -78,6 +78,14 @@ type Vaccination struct {
 	Lot      string
 }
 
+// LabTest is a covid test a claim was made for. Claims don't include the
+// result.
+type LabTest struct {
+	Date    time.Time
+	Code    string
+	Display string
+}
+
 // Jack Williams
 // https://adhoc.slack.com/archives/CVB2Y9NE5/p1610564186061500?thread_ts=1610563465.058200&cid=CVB2Y9NE5
 // The easiest way i believe would to look for the HCPCS code for Covid in the
@@ -97,34 +105,74 @@ var VaxCodes map[string]bool = map[string]bool{
 	"91300": true, // Pfizer-Biontech Covid-19 Vaccine
 	"0001A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – First Dose
 	"0002A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – Second Dose
+	"0003A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – Third Dose
+	"0004A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – Booster
+	"91305": true, // Pfizer-Biontech Covid-19 Vaccine, tris-sucrose formulation
+	"0051A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – First Dose
+	"0052A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – Second Dose
+	"0053A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – Third Dose
+	"0054A": true, // Pfizer-Biontech Covid-19 Vaccine Administration – Booster
 	"91301": true, // Moderna Covid-19 Vaccine
 	"0011A": true, // Moderna Covid-19 Vaccine Administration – First Dose
 	"0012A": true, // Moderna Covid-19 Vaccine Administration – Second Dose
+	"0013A": true, // Moderna Covid-19 Vaccine Administration – Third Dose
+	"91306": true, // Moderna Covid-19 Vaccine, booster
+	"0064A": true, // Moderna Covid-19 Vaccine Administration – Booster
 	"91302": true, // AstraZeneca Covid-19 Vaccine
 	"0021A": true, // AstraZeneca Covid-19 Vaccine Administration – First Dose
 	"0022A": true, // AstraZeneca Covid-19 Vaccine Administration – Second Dose
+	"91303": true, // Janssen Covid-19 Vaccine
+	"0031A": true, // Janssen Covid-19 Vaccine Administration
+	"0034A": true, // Janssen Covid-19 Vaccine Administration – Booster
+}
+
+// parseServicedDate parses an item's servicedDate. Claims are dated by day,
+// but we've seen full timestamps too
+func parseServicedDate(s string) (time.Time, error) {
+	if dt, err := time.Parse("2006-01-02", s); err == nil {
+		return dt, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
 }
 
-func findVaxes(e EOBResponse) ([]Vaccination, error) {
+// findClaims picks the covid vaccinations, and the tests isTest knows the codes
+// of, out of a page of EOBs. Other lines are skipped before their dates are
+// parsed, since many claims, like v1 outpatient ones, have no servicedDate.
+func findClaims(e EOBResponse, isTest func(code string) bool) ([]Vaccination, []LabTest, error) {
 	var vaxes []Vaccination
+	var tests []LabTest
 	for _, entry := range e.Entries {
 		for _, item := range entry.Resource.Items {
-			for _, serviceCode := range item.ProductOrService.Coding {
-				if _, ok := VaxCodes[serviceCode.Code]; ok {
-					dt, err := time.Parse(time.RFC3339Nano, item.ServicedDate)
+			// the v1 (STU3) API puts the procedure code in service, R4 in
+			// productOrService
+			for _, service := range []Coding{item.Service, item.ProductOrService} {
+				for _, serviceCode := range service.Coding {
+					isVax := VaxCodes[serviceCode.Code]
+					if !isVax && (isTest == nil || !isTest(serviceCode.Code)) {
+						continue
+					}
+					dt, err := parseServicedDate(item.ServicedDate)
 					if err != nil {
-						return nil, err
+						return nil, nil, err
+					}
+					if isVax {
+						vaxes = append(vaxes, Vaccination{
+							Date:    dt,
+							Code:    serviceCode.Code,
+							Display: serviceCode.Display,
+						})
+					} else {
+						tests = append(tests, LabTest{
+							Date:    dt,
+							Code:    serviceCode.Code,
+							Display: serviceCode.Display,
+						})
 					}
-					vaxes = append(vaxes, Vaccination{
-						Date:    dt,
-						Code:    serviceCode.Code,
-						Display: serviceCode.Display,
-					})
 				}
 			}
 		}
 	}
-	return vaxes, nil
+	return vaxes, tests, nil
 }
 
 func (c *Client) GetEOB(tok, fhirID string) (*EOBResponse, error) {
@@ -139,28 +187,40 @@ func (c *Client) GetEOB(tok, fhirID string) (*EOBResponse, error) {
 }
 
 func (c *Client) FindVaccionations(tok, fhirID string) ([]Vaccination, error) {
+	vaxes, _, err := c.FindCovidClaims(tok, fhirID, nil)
+	return vaxes, err
+}
+
+// FindCovidClaims returns the covid vaccinations and tests the patient's
+// claims were made for, following the EOBs through every page. isTest says
+// which codes are covid tests; with a nil isTest no tests are returned.
+func (c *Client) FindCovidClaims(tok, fhirID string, isTest func(code string) bool) ([]Vaccination, []LabTest, error) {
 	var res EOBResponse
 
 	// can we limit this to outputient or something like?
 	// /v1/fhir/ExplanationOfBenefit?patient=123&type=carrier,dme,hha,hospice,inpatient,outpatient,snf
 	err := get(fmt.Sprintf("%s/v1/fhir/ExplanationOfBenefit?patient=%s", c.BBURL, fhirID), tok, &res)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	vaxes, err := findVaxes(res)
+	vaxes, tests, err := findClaims(res, isTest)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for next := res.Next(); next != ""; next = res.Next() {
+		// decode each page afresh, or the last page's missing links would
+		// leave the previous page's next link in place
+		res = EOBResponse{}
 		err := get(next, tok, &res)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		moreVaxes, err := findVaxes(res)
+		moreVaxes, moreTests, err := findClaims(res, isTest)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		vaxes = append(vaxes, moreVaxes...)
+		tests = append(tests, moreTests...)
 	}
-	return vaxes, nil
+	return vaxes, tests, nil
 }
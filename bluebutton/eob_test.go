@@ -36,3 +36,99 @@ func TestParseEOB(t *testing.T) {
 		t.Errorf("expected to find 4 entries, got %d", eob.Total)
 	}
 }
+
+// covidTest stands in for record.IsTestCode, which this package can't import
+func covidTest(code string) bool {
+	return code == "U0003" || code == "U0005" || code == "87635"
+}
+
+func TestFindClaimsOutpatient(t *testing.T) {
+	jsonData, err := ioutil.ReadFile("testdata/outpatient.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var eob EOBResponse
+	if err := json.Unmarshal(jsonData, &eob); err != nil {
+		t.Fatal(err)
+	}
+
+	// real v1 outpatient claims have no servicedDate, which is fine as long
+	// as none of their lines is a vaccination or a covid test
+	vaxes, tests, err := findClaims(eob, covidTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vaxes) != 0 || len(tests) != 0 {
+		t.Errorf("expected no covid claims, got %#v %#v", vaxes, tests)
+	}
+}
+
+func TestFindVaccinations(t *testing.T) {
+	_, c, code := fakeClient(t, "pfizer-complete")
+	tok, err := c.GetFullToken(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the two doses are on the second and third of three pages, among
+	// claims for other things
+	vaxes, err := c.FindVaccionations(tok.AccessToken, "-20000000002001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vaxes) != 2 {
+		t.Fatalf("expected two vaccinations, got %#v", vaxes)
+	}
+	if vaxes[0].Code != "0001A" || vaxes[0].Date.Format("2006-01-02") != "2021-01-11" {
+		t.Errorf("unexpected first dose %#v", vaxes[0])
+	}
+	if vaxes[1].Code != "0002A" || vaxes[1].Date.Format("2006-01-02") != "2021-02-01" {
+		t.Errorf("unexpected second dose %#v", vaxes[1])
+	}
+}
+
+func TestFindVaccinationsNone(t *testing.T) {
+	_, c, code := fakeClient(t, "unvaccinated")
+	tok, err := c.GetFullToken(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaxes, err := c.FindVaccionations(tok.AccessToken, "-20000000002003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vaxes) != 0 {
+		t.Errorf("expected the flu shot not to count, got %#v", vaxes)
+	}
+}
+
+func TestFindCovidTests(t *testing.T) {
+	_, c, code := fakeClient(t, "unvaccinated")
+	tok, err := c.GetFullToken(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tests, err := c.FindCovidClaims(tok.AccessToken, "-20000000002003", covidTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test and the fast turnaround add-on are billed separately, after a
+	// visit and a flu shot that aren't tests
+	if len(tests) != 2 || tests[0].Code != "U0003" || tests[1].Code != "U0005" {
+		t.Fatalf("expected the test's two claim lines, got %#v", tests)
+	}
+	if tests[0].Date.Format("2006-01-02") != "2021-08-30" {
+		t.Errorf("unexpected test date %s", tests[0].Date)
+	}
+}
+
+func TestFindVaccinationsOutage(t *testing.T) {
+	_, c, code := fakeClient(t, "claims-outage")
+	tok, err := c.GetFullToken(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FindVaccionations(tok.AccessToken, "-20000000002004"); err == nil {
+		t.Errorf("expected an error when the claims api is down")
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package bluebutton
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RevokeToken revokes an access token, and with it the user's grant, so it
+// can't be used after we're done with it
+// https://bluebutton.cms.gov/developers/#revoking-a-token
+func (c *Client) RevokeToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	params := url.Values{}
+	params.Set("token", token)
+	params.Set("client_id", c.BBClientID)
+	params.Set("client_secret", c.BBClientSecret)
+
+	revokeURL := fmt.Sprintf("%s/v1/o/revoke_token/", c.BBURL)
+	log.Printf("revoking a token at %s", revokeURL)
+	req, err := http.NewRequestWithContext(ctx, "POST", revokeURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Expected 200, got %v", resp.Status)
+	}
+	return nil
+}
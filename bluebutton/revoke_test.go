@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package bluebutton
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRevokeToken(t *testing.T) {
+	var revoked string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/o/revoke_token/" || r.PostFormValue("client_id") != "bb-client" || r.PostFormValue("client_secret") != "shh" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		revoked = r.PostFormValue("token")
+	}))
+	defer srv.Close()
+
+	c := &Client{BBClientID: "bb-client", BBClientSecret: "shh", BBURL: srv.URL}
+	if err := c.RevokeToken("tok"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked != "tok" {
+		t.Errorf("expected the token to be revoked, got %q", revoked)
+	}
+
+	c.BBClientSecret = "wrong"
+	if err := c.RevokeToken("tok"); err == nil {
+		t.Errorf("expected a failed revocation to return an error")
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/adhocteam/covidreport/audit"
+	"github.com/adhocteam/covidreport/i18n"
+	"github.com/adhocteam/covidreport/record"
+)
+
+// providerLink is a button to connect a provider
+type providerLink struct {
+	Name string
+	Logo string
+	URL  string
+}
+
+// cardDose is a row in the table of doses on the back of the card
+type cardDose struct {
+	record.Dose
+	// Label names the dose, like "Second Dose" or "Booster"
+	Label string
+}
+
+// cardTest is a row in the table of covid tests under the card
+type cardTest struct {
+	record.TestResult
+	Label  string
+	Result string
+}
+
+// Provenance names the test's source
+func (t cardTest) Provenance() string {
+	return record.SourceName(t.Source)
+}
+
+// cardTests lists the tests, most recent first. The catalog has a test.<kind>
+// and result.<outcome> message for each kind of test and outcome.
+func cardTests(cat *i18n.Catalog, tests []record.TestResult) []cardTest {
+	rows := make([]cardTest, len(tests))
+	for i, test := range tests {
+		rows[len(tests)-1-i] = cardTest{
+			TestResult: test,
+			Label:      cat.T("test." + string(test.Kind)),
+			Result:     cat.T("result." + string(test.Outcome)),
+		}
+	}
+	return rows
+}
+
+// dosingStatus is where the patient is in their vaccination, as the card
+// shows it. The template formats and translates it.
+type dosingStatus struct {
+	Status record.Status
+	// DosesGiven counts every dose, and DosesRequired and DosesRemaining the
+	// doses of the primary series
+	DosesGiven     int
+	DosesRequired  int
+	DosesRemaining int
+	BoostersGiven  int
+	// NextDoseEarliest and NextDoseDue are set for a partial vaccination, and
+	// BoosterDue for a complete one, when we know the product's schedule
+	NextDoseEarliest record.Date
+	NextDoseDue      record.Date
+	BoosterDue       record.Date
+	// Products names the vaccines the patient received, in the order they
+	// first got each one. It's empty if we don't recognize any of them.
+	Products []string
+}
+
+// newDosingStatus builds the card's status from the status engine's summary
+// of the doses
+func newDosingStatus(doses []record.Dose, summary record.Summary) dosingStatus {
+	status := dosingStatus{
+		Status:           summary.Status,
+		DosesGiven:       summary.DosesGiven,
+		DosesRequired:    summary.DosesRequired,
+		DosesRemaining:   summary.DosesRemaining,
+		BoostersGiven:    summary.BoostersGiven,
+		NextDoseEarliest: summary.NextDoseEarliest,
+		NextDoseDue:      summary.NextDoseDue,
+		BoosterDue:       summary.BoosterDue,
+	}
+	seen := map[string]bool{}
+	for _, dose := range doses {
+		name := dose.Product
+		if name == "" {
+			product, _ := record.LookupProduct(dose.Code)
+			name = product.Name
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			status.Products = append(status.Products, name)
+		}
+	}
+	return status
+}
+
+// cardPage is the data callback.html is rendered with
+type cardPage struct {
+	Vaccinations []cardDose
+	// Missing labels a row for each dose of the primary series we have no
+	// record of
+	Missing      []string
+	Patient      record.Patient
+	QrCodePng    string
+	Name         string
+	AppleWallet  bool
+	GoogleWallet bool
+	DCC          bool
+	Dosing       dosingStatus
+	// Tests lists the covid tests, most recent first, and Testing is what
+	// they say about the patient today
+	Tests   []cardTest
+	Testing record.TestSummary
+	// Connect lists the providers the user hasn't connected yet, so they can
+	// add the doses recorded there to their card
+	Connect []providerLink
+}
+
+// ordinalMessages is how many doses of each kind the catalogs have an ordinal
+// name for
+const ordinalMessages = 5
+
+// ordinalLabel names the nth dose of a kind, "dose" or "booster", counting
+// from 0, like "Second Dose" or "Third Booster"
+func ordinalLabel(cat *i18n.Catalog, n int, kind string) string {
+	if n < ordinalMessages {
+		return cat.T(fmt.Sprintf("%s.%d", kind, n+1))
+	}
+	return cat.T(kind+".n", n+1)
+}
+
+// cardDoses labels the doses by their role. Primary doses are counted
+// through the series, and boosters are only counted if there's more than one.
+func cardDoses(cat *i18n.Catalog, doses []record.Dose, summary record.Summary) ([]cardDose, []string) {
+	rows := make([]cardDose, len(doses))
+	primary, boosters := 0, 0
+	for i, dose := range doses {
+		var label string
+		switch dose.Role {
+		case record.RoleAdditional:
+			label = cat.T("dose.additional")
+		case record.RoleBooster:
+			label = cat.T("booster")
+			if summary.BoostersGiven > 1 {
+				label = ordinalLabel(cat, boosters, "booster")
+			}
+			boosters++
+		default:
+			label = ordinalLabel(cat, primary, "dose")
+			primary++
+		}
+		rows[i] = cardDose{Dose: dose, Label: label}
+	}
+
+	var missing []string
+	for i := 0; i < summary.DosesRemaining; i++ {
+		missing = append(missing, ordinalLabel(cat, primary+i, "dose"))
+	}
+	return rows, missing
+}
+
+// unlinkedProviders returns a connect button for each provider the session
+// doesn't have a record from
+func (c *CovidRecord) unlinkedProviders(sess *Session) []providerLink {
+	return c.Providers.Links(sess.Sources)
+}
+
+// renderCard renders the vaccination card for the session's record, offering
+// to connect the providers in connect
+func (c *CovidRecord) renderCard(w http.ResponseWriter, r *http.Request, sess *Session, connect []providerLink) {
+	cat := catalog(r)
+	rec := sess.Record
+	summary := rec.Summary()
+
+	qrCode, err := genQrCode(qrPayload(rec))
+	ev := c.sessionEvent(audit.CardRender, sess)
+	ev.Outcome = outcome(err)
+	c.logEvent(r, ev)
+	if err != nil {
+		log.Printf("error generating qr code: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	doses, missing := cardDoses(cat, rec.Doses, summary)
+	renderTemplate(w, r, "callback.html", cardPage{
+		Vaccinations: doses,
+		Missing:      missing,
+		Patient:      rec.Patient,
+		QrCodePng:    qrCode,
+		Name:         rec.Patient.Name,
+		AppleWallet:  c.AppleWallet != nil && !sess.Demo(),
+		GoogleWallet: c.GoogleWallet != nil && !sess.Demo(),
+		DCC:          c.DCC != nil && len(rec.Doses) > 0 && !rec.Patient.BirthDate.IsZero() && !sess.Demo(),
+		Dosing:       newDosingStatus(rec.Doses, summary),
+		Tests:        cardTests(cat, rec.Tests),
+		Testing:      rec.TestSummary(time.Now()),
+		Connect:      connect,
+	})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+func day(year int, month time.Month, d int) record.Date {
+	return record.Date{Time: time.Date(year, month, d, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestNewDosingStatus(t *testing.T) {
+	const (
+		pfizer  = "Pfizer-BioNTech COVID-19 Vaccine"
+		moderna = "Moderna COVID-19 Vaccine"
+	)
+	tests := []struct {
+		name  string
+		doses []record.Dose
+		want  dosingStatus
+	}{
+		{
+			name: "pending",
+			want: dosingStatus{Status: record.StatusPending, DosesRequired: 2, DosesRemaining: 2},
+		},
+		{
+			name:  "partial",
+			doses: []record.Dose{{Date: day(2021, 3, 1), Code: "207", Product: moderna}},
+			want: dosingStatus{
+				Status:           record.StatusPartial,
+				DosesGiven:       1,
+				DosesRequired:    2,
+				DosesRemaining:   1,
+				NextDoseEarliest: day(2021, 3, 25),
+				NextDoseDue:      day(2021, 3, 29),
+				Products:         []string{moderna},
+			},
+		},
+		{
+			name: "mixed products",
+			doses: []record.Dose{
+				{Date: day(2021, 3, 1), Code: "208", Product: pfizer},
+				{Date: day(2021, 3, 22), Code: "207", Product: moderna},
+			},
+			want: dosingStatus{
+				Status:        record.StatusComplete,
+				DosesGiven:    2,
+				DosesRequired: 2,
+				BoosterDue:    day(2021, 9, 22),
+				Products:      []string{pfizer, moderna},
+			},
+		},
+		{
+			name: "boosted with the same product",
+			doses: []record.Dose{
+				{Date: day(2021, 3, 1), Code: "208", Product: pfizer},
+				{Date: day(2021, 3, 22), Code: "208", Product: pfizer},
+				{Date: day(2021, 10, 1), Code: "0004A", Product: pfizer},
+			},
+			want: dosingStatus{
+				Status:        record.StatusBoosted,
+				DosesGiven:    3,
+				DosesRequired: 2,
+				BoostersGiven: 1,
+				Products:      []string{pfizer},
+			},
+		},
+		{
+			name:  "product looked up from the code",
+			doses: []record.Dose{{Date: day(2021, 3, 1), Code: "0031A"}},
+			want: dosingStatus{
+				Status:        record.StatusComplete,
+				DosesGiven:    1,
+				DosesRequired: 1,
+				BoosterDue:    day(2021, 5, 1),
+				Products:      []string{"Janssen COVID-19 Vaccine"},
+			},
+		},
+		{
+			name:  "unknown product",
+			doses: []record.Dose{{Date: day(2021, 3, 1), Code: "99999"}},
+			want: dosingStatus{
+				Status:         record.StatusPartial,
+				DosesGiven:     1,
+				DosesRequired:  2,
+				DosesRemaining: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newDosingStatus(tt.doses, record.Evaluate(tt.doses))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dcc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// base45Alphabet is the QR code alphanumeric character set, which base45
+// (RFC 9285) encodes into so that the QR code can use its compact
+// alphanumeric mode
+const base45Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// base45Encode encodes each pair of bytes as three characters, and a trailing
+// single byte as two
+func base45Encode(in []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(in); i += 2 {
+		if i+1 < len(in) {
+			n := int(in[i])<<8 | int(in[i+1])
+			sb.WriteByte(base45Alphabet[n%45])
+			sb.WriteByte(base45Alphabet[n/45%45])
+			sb.WriteByte(base45Alphabet[n/45/45])
+		} else {
+			n := int(in[i])
+			sb.WriteByte(base45Alphabet[n%45])
+			sb.WriteByte(base45Alphabet[n/45])
+		}
+	}
+	return sb.String()
+}
+
+// base45Decode reverses base45Encode
+func base45Decode(in string) ([]byte, error) {
+	if len(in)%3 == 1 {
+		return nil, fmt.Errorf("invalid base45 length %d", len(in))
+	}
+	out := make([]byte, 0, len(in)/3*2+1)
+	for i := 0; i < len(in); i += 3 {
+		chunk := in[i:]
+		if len(chunk) > 3 {
+			chunk = chunk[:3]
+		}
+		n := 0
+		for j := len(chunk) - 1; j >= 0; j-- {
+			v := strings.IndexByte(base45Alphabet, chunk[j])
+			if v < 0 {
+				return nil, fmt.Errorf("invalid base45 character %q", chunk[j])
+			}
+			n = n*45 + v
+		}
+		if len(chunk) == 3 {
+			if n > 0xffff {
+				return nil, fmt.Errorf("invalid base45 triplet %q", chunk)
+			}
+			out = append(out, byte(n>>8), byte(n))
+		} else {
+			if n > 0xff {
+				return nil, fmt.Errorf("invalid base45 pair %q", chunk)
+			}
+			out = append(out, byte(n))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// This file implements just enough of CBOR (RFC 8949) for a certificate:
+// integers, byte and text strings, arrays, maps and tags. Maps with string
+// keys are written in the deterministic order of section 4.2.1, so the same
+// certificate always encodes to the same bytes.
+
+const (
+	majorUint   = 0
+	majorNegint = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+// The simple values we write and read
+const (
+	simpleFalse = 20
+	simpleTrue  = 21
+	simpleNull  = 22
+)
+
+// cborPair is an entry in a cborMap
+type cborPair struct {
+	Key, Value interface{}
+}
+
+// cborMap is a map written in the order given, which COSE and CWT use with
+// integer keys
+type cborMap []cborPair
+
+// cborTag is a tagged data item
+type cborTag struct {
+	Number  uint64
+	Content interface{}
+}
+
+// writeHead writes the initial byte of a data item and its argument in the
+// shortest form
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	if n < 0 {
+		writeHead(buf, majorNegint, uint64(-1-n))
+		return
+	}
+	writeHead(buf, majorUint, uint64(n))
+}
+
+// cborEncode encodes v, which may be made of the types cborDecode returns,
+// cborMap, map[string]interface{} and json.Number
+func cborEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeItem(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeItem(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(majorSimple<<5 | simpleNull)
+	case bool:
+		if v {
+			buf.WriteByte(majorSimple<<5 | simpleTrue)
+		} else {
+			buf.WriteByte(majorSimple<<5 | simpleFalse)
+		}
+	case int:
+		writeInt(buf, int64(v))
+	case int64:
+		writeInt(buf, v)
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return fmt.Errorf("unsupported number %s", v)
+		}
+		writeInt(buf, n)
+	case string:
+		writeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case []byte:
+		writeHead(buf, majorBytes, uint64(len(v)))
+		buf.Write(v)
+	case []interface{}:
+		writeHead(buf, majorArray, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeItem(buf, item); err != nil {
+				return err
+			}
+		}
+	case cborMap:
+		writeHead(buf, majorMap, uint64(len(v)))
+		for _, pair := range v {
+			if err := encodeItem(buf, pair.Key); err != nil {
+				return err
+			}
+			if err := encodeItem(buf, pair.Value); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// sorting the encoded keys bytewise puts shorter keys first
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		writeHead(buf, majorMap, uint64(len(v)))
+		for _, k := range keys {
+			encodeItem(buf, k)
+			if err := encodeItem(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		writeHead(buf, majorTag, v.Number)
+		return encodeItem(buf, v.Content)
+	default:
+		return fmt.Errorf("unable to encode %T as cbor", v)
+	}
+	return nil
+}
+
+// maxDepth limits how deeply nested a decoded item can be, so that a hostile
+// payload can't exhaust the stack
+const maxDepth = 16
+
+// cborDecoder reads data items from a byte slice
+type cborDecoder struct {
+	data []byte
+	off  int
+}
+
+// cborDecode decodes a single data item, which must take up all of data.
+// Integers decode as int64, maps as map[interface{}]interface{}, and tags as
+// cborTag.
+func cborDecode(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.off != len(data) {
+		return nil, fmt.Errorf("%d bytes of trailing data after cbor item", len(data)-d.off)
+	}
+	return v, nil
+}
+
+// head reads the initial byte of a data item and its argument
+func (d *cborDecoder) head() (byte, byte, uint64, error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, fmt.Errorf("unexpected end of cbor data")
+	}
+	b := d.data[d.off]
+	d.off++
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, info, uint64(info), nil
+	}
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		// indefinite lengths and reserved values
+		return 0, 0, 0, fmt.Errorf("unsupported cbor additional information %d", info)
+	}
+	if d.off+size > len(d.data) {
+		return 0, 0, 0, fmt.Errorf("unexpected end of cbor data")
+	}
+	var n uint64
+	for _, b := range d.data[d.off : d.off+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.off += size
+	return major, info, n, nil
+}
+
+// bytes reads n bytes of string content
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return nil, fmt.Errorf("cbor string of %d bytes is longer than the data", n)
+	}
+	b := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("cbor nested too deeply")
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case majorUint:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("cbor integer %d is too large", n)
+		}
+		return int64(n), nil
+	case majorNegint:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("cbor integer -1-%d is too small", n)
+		}
+		return -1 - int64(n), nil
+	case majorBytes:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case majorText:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case majorArray:
+		// every item takes at least a byte
+		if n > uint64(len(d.data)-d.off) {
+			return nil, fmt.Errorf("cbor array of %d items is longer than the data", n)
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case majorMap:
+		if n > uint64(len(d.data)-d.off)/2 {
+			return nil, fmt.Errorf("cbor map of %d entries is longer than the data", n)
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("unsupported cbor map key %T", k)
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case majorTag:
+		v, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return cborTag{Number: n, Content: v}, nil
+	default:
+		switch info {
+		case simpleFalse:
+			return false, nil
+		case simpleTrue:
+			return true, nil
+		case simpleNull:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unsupported cbor simple value %d", info)
+	}
+}
+
+// jsonValue converts a decoded item into the shapes encoding/json produces,
+// so it can be unmarshaled into a struct. Map keys must be strings.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected map key %v", k)
+			}
+			var err error
+			if m[s], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if arr[i], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case []byte, cborTag:
+		return nil, fmt.Errorf("unexpected %T", v)
+	}
+	return v, nil
+}
@@ -0,0 +1,503 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dcc encodes a vaccination record as an EU Digital COVID Certificate,
+// the QR code travelers show at European borders and venues.
+// https://ec.europa.eu/health/ehealth/covid-19_en
+//
+// The certificate's json is wrapped in a CBOR Web Token, signed with
+// COSE_Sign1, compressed with zlib and base45 encoded behind an "HC1:" prefix.
+// https://github.com/ehn-dcc-development/hcert-spec
+package dcc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// Prefix marks a payload as a health certificate, version 1
+const Prefix = "HC1:"
+
+// SchemaVersion is the version of the certificate json schema we write
+// https://github.com/ehn-dcc-development/ehn-dcc-schema
+const SchemaVersion = "1.3.0"
+
+// DefaultValidity is how long a certificate is valid for, if the issuer
+// doesn't say
+const DefaultValidity = 365 * 24 * time.Hour
+
+// ErrNoVaccination is returned for a record without any doses, which there's
+// no certificate for
+var ErrNoVaccination = errors.New("there are no vaccinations to certify")
+
+// ErrNoBirthDate is returned for a record without a birth date, since the
+// schema requires one
+var ErrNoBirthDate = errors.New("there's no date of birth to certify")
+
+// The CWT and COSE labels we use
+// https://www.iana.org/assignments/cose/cose.xhtml
+const (
+	claimIssuer   = 1
+	claimExpires  = 4
+	claimIssuedAt = 6
+	claimHCert    = -260
+	hcertV1       = 1
+	headerAlg     = 1
+	headerKeyID   = 4
+	algES256      = -7
+	tagCOSESign1  = 18
+)
+
+// maxInflateSize limits how much a compressed certificate can decompress to
+const maxInflateSize = 64 << 10
+
+// Name is the holder's name, as written and transliterated into the
+// characters of a passport's machine readable zone
+type Name struct {
+	FamilyName    string `json:"fn,omitempty"`
+	FamilyNameStd string `json:"fnt"`
+	GivenName     string `json:"gn,omitempty"`
+	GivenNameStd  string `json:"gnt,omitempty"`
+}
+
+// Vaccination is a "v" entry of the certificate. The codes come from the EU's
+// value sets.
+// https://github.com/ehn-dcc-development/ehn-dcc-valuesets
+type Vaccination struct {
+	// Target is the disease, always covid
+	Target       string `json:"tg"`
+	Prophylaxis  string `json:"vp"`
+	Product      string `json:"mp"`
+	Manufacturer string `json:"ma"`
+	DoseNumber   int    `json:"dn"`
+	SeriesDoses  int    `json:"sd"`
+	Date         string `json:"dt"`
+	Country      string `json:"co"`
+	Issuer       string `json:"is"`
+	// ID is the unique vaccination certificate identifier
+	ID string `json:"ci"`
+}
+
+// Certificate is the health certificate json
+type Certificate struct {
+	Version      string        `json:"ver"`
+	Name         Name          `json:"nam"`
+	DateOfBirth  string        `json:"dob"`
+	Vaccinations []Vaccination `json:"v"`
+}
+
+// covidTarget is the SNOMED code for covid
+const covidTarget = "840539006"
+
+// euProduct is how the EU's value sets identify a vaccine
+type euProduct struct {
+	Prophylaxis  string
+	Product      string
+	Manufacturer string
+}
+
+// euProducts maps the CVX codes of the products we know to the EU's value
+// sets. The prophylaxis codes are SNOMED's for mRNA vaccines and the ATC
+// code for other covid vaccines, and the products are their EU marketing
+// authorizations.
+var euProducts = map[string]euProduct{
+	"208": {"1119349007", "EU/1/20/1528", "ORG-100030215"}, // Pfizer-BioNTech
+	"207": {"1119349007", "EU/1/20/1507", "ORG-100031184"}, // Moderna
+	"210": {"J07BX03", "EU/1/21/1529", "ORG-100001699"},    // AstraZeneca
+	"212": {"J07BX03", "EU/1/20/1525", "ORG-100001417"},    // Janssen
+}
+
+// mrzReplacements transliterates the letters that ICAO 9303 spells out, and
+// removes the marks from accented letters
+var mrzReplacements = strings.NewReplacer(
+	"Ä", "AE", "Æ", "AE", "Å", "AA", "Ö", "OE", "Ø", "OE", "Ü", "UE", "ẞ", "SS",
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ç", "C", "È", "E", "É", "E",
+	"Ê", "E", "Ë", "E", "Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ñ", "N",
+	"Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ù", "U", "Ú", "U", "Û", "U",
+	"Ý", "Y",
+)
+
+// maxNameLength is the longest name the schema allows
+const maxNameLength = 80
+
+// standardName transliterates a name as the schema's fnt and gnt fields
+// require: upper case A to Z, with "<" between words
+func standardName(name string) string {
+	name = mrzReplacements.Replace(strings.ToUpper(strings.ReplaceAll(name, "ß", "SS")))
+	var sb strings.Builder
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == ' ' || r == '-' }) {
+		if sb.Len() > 0 {
+			sb.WriteByte('<')
+		}
+		for _, r := range word {
+			if r >= 'A' && r <= 'Z' {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	s := sb.String()
+	if len(s) > maxNameLength {
+		s = s[:maxNameLength]
+	}
+	return s
+}
+
+// certificateID makes a unique vaccination certificate identifier. It's
+// derived from the dose, so reissuing the same certificate gives the same
+// identifier.
+// https://ec.europa.eu/health/sites/default/files/ehealth/docs/vaccination-proof_interoperability-guidelines_en.pdf
+func certificateID(country string, rec *record.Record, dose record.Dose) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{
+		rec.Patient.Name,
+		rec.Patient.BirthDate.Format("2006-01-02"),
+		dose.Date.Format("2006-01-02"),
+		dose.Code,
+	}, "|")))
+	return fmt.Sprintf("URN:UVCI:01:%s:%X", country, h[:12])
+}
+
+// NewCertificate maps a record to a certificate. The certificate holds only
+// the most recent dose, numbered among all the doses the record has, as the
+// EU does for boosters.
+func NewCertificate(rec *record.Record, country, issuer string) (*Certificate, error) {
+	if len(rec.Doses) == 0 {
+		return nil, ErrNoVaccination
+	}
+	if rec.Patient.BirthDate.IsZero() {
+		return nil, ErrNoBirthDate
+	}
+	dose := rec.Doses[len(rec.Doses)-1]
+	cvx := dose.CVX
+	if cvx == "" {
+		p, _ := record.LookupProduct(dose.Code)
+		cvx = p.CVX
+	}
+	product, ok := euProducts[cvx]
+	if !ok {
+		return nil, fmt.Errorf("there's no EU code for the vaccine %q", dose.Code)
+	}
+
+	summary := rec.Summary()
+	doseNumber := len(rec.Doses)
+	seriesDoses := summary.DosesRequired
+	if doseNumber > seriesDoses {
+		seriesDoses = doseNumber
+	}
+
+	family, given := rec.Patient.FamilyName, rec.Patient.GivenName
+	if family == "" {
+		family, given = rec.Patient.Name, ""
+	}
+	cert := &Certificate{
+		Version:     SchemaVersion,
+		DateOfBirth: rec.Patient.BirthDate.Format("2006-01-02"),
+		Name: Name{
+			FamilyName:    family,
+			FamilyNameStd: standardName(family),
+			GivenName:     given,
+			GivenNameStd:  standardName(given),
+		},
+		Vaccinations: []Vaccination{{
+			Target:       covidTarget,
+			Prophylaxis:  product.Prophylaxis,
+			Product:      product.Product,
+			Manufacturer: product.Manufacturer,
+			DoseNumber:   doseNumber,
+			SeriesDoses:  seriesDoses,
+			Date:         dose.Date.Format("2006-01-02"),
+			Country:      country,
+			Issuer:       issuer,
+			ID:           certificateID(country, rec, dose),
+		}},
+	}
+	return cert, nil
+}
+
+// Issuer signs certificates
+type Issuer struct {
+	// Country is the ISO 3166 code of the country we issue certificates in,
+	// and Name who issues them
+	Country string
+	Name    string
+
+	// KeyID tells verifiers which document signer certificate to check the
+	// signature with: the first 8 bytes of its SHA-256 fingerprint
+	KeyID []byte
+	Key   *ecdsa.PrivateKey
+
+	// Validity is how long a certificate is valid for after it's issued
+	Validity time.Duration
+}
+
+// NewIssuer configures an issuer from a PEM encoded document signer
+// certificate and its P-256 private key
+func NewIssuer(country, name, certPEM, keyPEM string) (*Issuer, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in signing certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse signing certificate: %w", err)
+	}
+	key, err := parseECKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.X.Cmp(key.X) != 0 || pub.Y.Cmp(key.Y) != 0 {
+		return nil, fmt.Errorf("the signing key doesn't match the signing certificate")
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &Issuer{
+		Country:  country,
+		Name:     name,
+		KeyID:    fingerprint[:8],
+		Key:      key,
+		Validity: DefaultValidity,
+	}, nil
+}
+
+// parseECKey parses a PEM encoded P-256 private key in either SEC 1 or PKCS#8
+// form
+func parseECKey(in string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(in))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in signing key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err2 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err2 != nil {
+			return nil, fmt.Errorf("unable to parse signing key: %w", err)
+		}
+		var ok bool
+		if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("signing key must be an EC key, got %T", parsed)
+		}
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing key must use P-256")
+	}
+	return key, nil
+}
+
+// toCBOR converts a certificate to the generic values cborEncode takes, by
+// way of its json
+func (c *Certificate) toCBOR() (interface{}, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	err = d.Decode(&v)
+	return v, err
+}
+
+// sigStructure is the data a COSE_Sign1 signature is computed over (RFC 8152
+// section 4.4)
+func sigStructure(protected, payload []byte) ([]byte, error) {
+	return cborEncode([]interface{}{"Signature1", protected, []byte{}, payload})
+}
+
+// Encode issues a certificate for the record, as the text to put in its QR
+// code
+func (i *Issuer) Encode(rec *record.Record, now time.Time) (string, error) {
+	cert, err := NewCertificate(rec, i.Country, i.Name)
+	if err != nil {
+		return "", err
+	}
+	hcert, err := cert.toCBOR()
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := cborEncode(cborMap{
+		{claimIssuer, i.Country},
+		{claimExpires, now.Add(i.Validity).Unix()},
+		{claimIssuedAt, now.Unix()},
+		{claimHCert, cborMap{{hcertV1, hcert}}},
+	})
+	if err != nil {
+		return "", err
+	}
+	protected, err := cborEncode(cborMap{
+		{headerAlg, algES256},
+		{headerKeyID, i.KeyID},
+	})
+	if err != nil {
+		return "", err
+	}
+	toSign, err := sigStructure(protected, payload)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(toSign)
+	r, s, err := ecdsa.Sign(rand.Reader, i.Key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign certificate: %w", err)
+	}
+	// COSE signatures are r and s, each padded to the size of the curve
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	signed, err := cborEncode(cborTag{tagCOSESign1, []interface{}{protected, cborMap{}, payload, signature}})
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	zw.Write(signed)
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return Prefix + base45Encode(buf.Bytes()), nil
+}
+
+// Claims are the contents of a verified certificate
+type Claims struct {
+	Issuer      string
+	IssuedAt    time.Time
+	Expires     time.Time
+	KeyID       []byte
+	Certificate Certificate
+}
+
+// Decode verifies a certificate's signature with key and returns its claims.
+// It doesn't check whether the certificate has expired.
+func Decode(payload string, key *ecdsa.PublicKey) (*Claims, error) {
+	if !strings.HasPrefix(payload, Prefix) {
+		return nil, fmt.Errorf("certificate doesn't start with %s", Prefix)
+	}
+	compressed, err := base45Decode(strings.TrimPrefix(payload, Prefix))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress certificate: %w", err)
+	}
+	signed, err := ioutil.ReadAll(io.LimitReader(zr, maxInflateSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress certificate: %w", err)
+	}
+
+	item, err := cborDecode(signed)
+	if err != nil {
+		return nil, err
+	}
+	// the tag is optional
+	if tag, ok := item.(cborTag); ok {
+		if tag.Number != tagCOSESign1 {
+			return nil, fmt.Errorf("expected a COSE_Sign1 message, got tag %d", tag.Number)
+		}
+		item = tag.Content
+	}
+	msg, ok := item.([]interface{})
+	if !ok || len(msg) != 4 {
+		return nil, fmt.Errorf("malformed COSE_Sign1 message")
+	}
+	protected, ok1 := msg[0].([]byte)
+	unprotected, ok2 := msg[1].(map[interface{}]interface{})
+	body, ok3 := msg[2].([]byte)
+	signature, ok4 := msg[3].([]byte)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, fmt.Errorf("malformed COSE_Sign1 message")
+	}
+
+	headers, err := cborDecode(protected)
+	if err != nil {
+		return nil, fmt.Errorf("malformed protected header: %w", err)
+	}
+	protectedHeaders, ok := headers.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed protected header")
+	}
+	if alg := protectedHeaders[int64(headerAlg)]; alg != int64(algES256) {
+		return nil, fmt.Errorf("unsupported signature algorithm %v", alg)
+	}
+	kid, ok := protectedHeaders[int64(headerKeyID)].([]byte)
+	if !ok {
+		kid, _ = unprotected[int64(headerKeyID)].([]byte)
+	}
+
+	if len(signature) != 64 {
+		return nil, fmt.Errorf("invalid signature length %d", len(signature))
+	}
+	toVerify, err := sigStructure(protected, body)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(toVerify)
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return nil, fmt.Errorf("invalid certificate signature")
+	}
+
+	item, err = cborDecode(body)
+	if err != nil {
+		return nil, err
+	}
+	cwt, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed CWT claims")
+	}
+	claims := &Claims{KeyID: kid}
+	claims.Issuer, _ = cwt[int64(claimIssuer)].(string)
+	if iat, ok := cwt[int64(claimIssuedAt)].(int64); ok {
+		claims.IssuedAt = time.Unix(iat, 0).UTC()
+	}
+	if exp, ok := cwt[int64(claimExpires)].(int64); ok {
+		claims.Expires = time.Unix(exp, 0).UTC()
+	}
+
+	hcerts, ok := cwt[int64(claimHCert)].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("certificate has no health certificate claim")
+	}
+	hcert, err := jsonValue(hcerts[int64(hcertV1)])
+	if err != nil {
+		return nil, fmt.Errorf("malformed health certificate: %w", err)
+	}
+	b, err := json.Marshal(hcert)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &claims.Certificate); err != nil {
+		return nil, fmt.Errorf("malformed health certificate: %w", err)
+	}
+	return claims, nil
+}
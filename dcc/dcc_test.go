@@ -0,0 +1,326 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package dcc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// testIssuer generates a throwaway document signer certificate and key
+func testIssuer(t *testing.T) *Issuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "DSC test", Country: []string{"US"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := NewIssuer("US", "Ad Hoc LLC",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func testRecord(codes ...string) *record.Record {
+	rec := &record.Record{
+		Patient: record.Patient{
+			Name:       "José María Nuñez-Ávila",
+			GivenName:  "José María",
+			FamilyName: "Nuñez-Ávila",
+			BirthDate:  record.Date{Time: time.Date(1964, 8, 12, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	for i, code := range codes {
+		rec.Doses = append(rec.Doses, record.Dose{
+			Date: record.Date{Time: time.Date(2021, 2, 1+28*i, 0, 0, 0, 0, time.UTC)},
+			Code: code,
+		})
+	}
+	return rec
+}
+
+func TestBase45(t *testing.T) {
+	// the examples from RFC 9285
+	tests := map[string]string{
+		"AB":      "BB8",
+		"Hello!!": "%69 VD92EX0",
+		"base-45": "UJCLQE7W581",
+		"ietf!":   "QED8WEX0",
+		"":        "",
+	}
+	for in, want := range tests {
+		if got := base45Encode([]byte(in)); got != want {
+			t.Errorf("encode %q: expected %q, got %q", in, want, got)
+		}
+		got, err := base45Decode(want)
+		if err != nil || string(got) != in {
+			t.Errorf("decode %q: expected %q, got %q, %v", want, in, got, err)
+		}
+	}
+
+	for _, bad := range []string{"A", "GGW", "ZZ", "ab"} {
+		if _, err := base45Decode(bad); err == nil {
+			t.Errorf("expected an error decoding %q", bad)
+		}
+	}
+}
+
+func TestCBOR(t *testing.T) {
+	// examples from RFC 8949 appendix A
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{1000, "1903e8"},
+		{int64(1000000000000), "1b000000e8d4a51000"},
+		{-1, "20"},
+		{-1000, "3903e7"},
+		{"IETF", "6449455446"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{[]interface{}{1, []interface{}{2, 3}}, "8201820203"},
+		{map[string]interface{}{"b": []interface{}{2, 3}, "a": 1}, "a26161016162820203"},
+		{cborMap{{1, 2}, {3, 4}}, "a201020304"},
+		{cborTag{1, 1363896240}, "c11a514b67b0"},
+		{nil, "f6"},
+		{true, "f5"},
+	}
+	for _, tt := range tests {
+		b, err := cborEncode(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("encode %#v: expected %s, got %s", tt.v, tt.want, got)
+		}
+		if _, err := cborDecode(b); err != nil {
+			t.Errorf("decode %s: %s", tt.want, err)
+		}
+	}
+
+	// deterministic encoding puts shorter keys first
+	b, _ := cborEncode(map[string]interface{}{"aa": 1, "b": 2})
+	if got := hex.EncodeToString(b); got != "a261620262616101" {
+		t.Errorf("expected shorter keys first, got %s", got)
+	}
+
+	for _, bad := range []string{"", "18", "5f", "62616263", "9affffffff", "8201"} {
+		b, _ := hex.DecodeString(bad)
+		if _, err := cborDecode(b); err == nil {
+			t.Errorf("expected an error decoding %s", bad)
+		}
+	}
+}
+
+func TestStandardName(t *testing.T) {
+	tests := map[string]string{
+		"Musterfrau-Gößinger": "MUSTERFRAU<GOESSINGER",
+		"José María":          "JOSE<MARIA",
+		"O'Brien":             "OBRIEN",
+		"  van der  Berg ":    "VAN<DER<BERG",
+		"":                    "",
+	}
+	for in, want := range tests {
+		if got := standardName(in); got != want {
+			t.Errorf("%q: expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	issuer := testIssuer(t)
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	payload, err := issuer.Encode(testRecord("0011A", "0012A"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(payload, "HC1:") {
+		t.Fatalf("expected the HC1 prefix, got %q", payload)
+	}
+	for _, r := range strings.TrimPrefix(payload, "HC1:") {
+		if !strings.ContainsRune(base45Alphabet, r) {
+			t.Fatalf("expected only QR alphanumeric characters, got %q", r)
+		}
+	}
+
+	claims, err := Decode(payload, &issuer.Key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "US" || !claims.IssuedAt.Equal(now) || !claims.Expires.Equal(now.Add(DefaultValidity)) {
+		t.Errorf("unexpected claims %#v", claims)
+	}
+	if !bytes.Equal(claims.KeyID, issuer.KeyID) || len(claims.KeyID) != 8 {
+		t.Errorf("expected key id %x, got %x", issuer.KeyID, claims.KeyID)
+	}
+
+	want := Certificate{
+		Version: "1.3.0",
+		Name: Name{
+			FamilyName:    "Nuñez-Ávila",
+			FamilyNameStd: "NUNEZ<AVILA",
+			GivenName:     "José María",
+			GivenNameStd:  "JOSE<MARIA",
+		},
+		DateOfBirth: "1964-08-12",
+		Vaccinations: []Vaccination{{
+			Target:       "840539006",
+			Prophylaxis:  "1119349007",
+			Product:      "EU/1/20/1507",
+			Manufacturer: "ORG-100031184",
+			DoseNumber:   2,
+			SeriesDoses:  2,
+			Date:         "2021-03-01",
+			Country:      "US",
+			Issuer:       "Ad Hoc LLC",
+			ID:           claims.Certificate.Vaccinations[0].ID,
+		}},
+	}
+	if !reflect.DeepEqual(claims.Certificate, want) {
+		t.Errorf("expected %#v, got %#v", want, claims.Certificate)
+	}
+	if id := want.Vaccinations[0].ID; !strings.HasPrefix(id, "URN:UVCI:01:US:") {
+		t.Errorf("unexpected certificate id %q", id)
+	}
+
+	// the payload is deterministic apart from the signature
+	again, _ := issuer.Encode(testRecord("0011A", "0012A"), now)
+	claims2, err := Decode(again, &issuer.Key.PublicKey)
+	if err != nil || !reflect.DeepEqual(claims.Certificate, claims2.Certificate) {
+		t.Errorf("expected the same certificate when reissued, got %#v", claims2)
+	}
+}
+
+func TestDoseNumbers(t *testing.T) {
+	tests := []struct {
+		name   string
+		codes  []string
+		dn, sd int
+		mp     string
+	}{
+		{"partial", []string{"0001A"}, 1, 2, "EU/1/20/1528"},
+		{"complete", []string{"0001A", "0002A"}, 2, 2, "EU/1/20/1528"},
+		{"boosted", []string{"0001A", "0002A", "0004A"}, 3, 3, "EU/1/20/1528"},
+		{"janssen", []string{"0031A"}, 1, 1, "EU/1/20/1525"},
+		{"janssen booster", []string{"0031A", "0064A"}, 2, 2, "EU/1/20/1507"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := NewCertificate(testRecord(tt.codes...), "US", "Ad Hoc LLC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := cert.Vaccinations[0]
+			if v.DoseNumber != tt.dn || v.SeriesDoses != tt.sd || v.Product != tt.mp {
+				t.Errorf("expected %d/%d of %s, got %#v", tt.dn, tt.sd, tt.mp, v)
+			}
+		})
+	}
+
+	if _, err := NewCertificate(testRecord(), "US", "Ad Hoc LLC"); !errors.Is(err, ErrNoVaccination) {
+		t.Errorf("expected ErrNoVaccination, got %v", err)
+	}
+	noBirthDate := testRecord("0001A")
+	noBirthDate.Patient.BirthDate = record.Date{}
+	if _, err := NewCertificate(noBirthDate, "US", "Ad Hoc LLC"); !errors.Is(err, ErrNoBirthDate) {
+		t.Errorf("expected ErrNoBirthDate, got %v", err)
+	}
+	if _, err := NewCertificate(testRecord("99999"), "US", "Ad Hoc LLC"); err == nil {
+		t.Errorf("expected an error for an unknown vaccine")
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	issuer := testIssuer(t)
+	payload, err := issuer.Encode(testRecord("0001A"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := testIssuer(t)
+	if _, err := Decode(payload, &other.Key.PublicKey); err == nil {
+		t.Errorf("expected a signature from another key to be rejected")
+	}
+	if _, err := Decode(strings.TrimPrefix(payload, Prefix), &issuer.Key.PublicKey); err == nil {
+		t.Errorf("expected a payload without the prefix to be rejected")
+	}
+
+	// change a byte of the certificate and re-encode it
+	compressed, _ := base45Decode(strings.TrimPrefix(payload, Prefix))
+	zr, _ := zlib.NewReader(bytes.NewReader(compressed))
+	signed, _ := ioutil.ReadAll(zr)
+	tampered := bytes.Replace(signed, []byte("2021-02-01"), []byte("2021-01-01"), 1)
+	if bytes.Equal(tampered, signed) {
+		t.Fatal("expected to find the vaccination date in the certificate")
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(tampered)
+	zw.Close()
+	if _, err := Decode(Prefix+base45Encode(buf.Bytes()), &issuer.Key.PublicKey); err == nil {
+		t.Errorf("expected a tampered certificate to be rejected")
+	}
+}
+
+func TestNewIssuerKeyMismatch(t *testing.T) {
+	a, b := testIssuer(t), testIssuer(t)
+	keyDER, _ := x509.MarshalECPrivateKey(b.Key)
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	// rebuild a's certificate to pair it with b's key
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &a.Key.PublicKey, a.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if _, err := NewIssuer("US", "Ad Hoc LLC", certPEM, keyPEM); err == nil {
+		t.Errorf("expected a key that doesn't match the certificate to be rejected")
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/adhocteam/covidreport/dcc"
+	"github.com/adhocteam/covidreport/fhir"
+	"github.com/adhocteam/covidreport/ics"
+	"github.com/adhocteam/covidreport/pdf"
+	"github.com/adhocteam/covidreport/record"
+	"github.com/adhocteam/covidreport/wallet"
+)
+
+// requireSession returns the current session, or renders an error page and
+// returns false if there isn't one
+func (c *CovidRecord) requireSession(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	sess, ok := c.Sessions.Get(r)
+	if !ok || sess.Record == nil {
+		renderError(w, r, http.StatusUnauthorized, errors.New(catalog(r).T("error.sessionExpired")))
+		return nil, false
+	}
+	return sess, true
+}
+
+// attachment sets the headers for a file download
+func attachment(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+}
+
+// exportFHIRHandler serves the session's record as a FHIR R4 bundle
+func (c *CovidRecord) exportFHIRHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := c.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := json.MarshalIndent(fhir.NewBundle(sess.Record, time.Now()), "", "  ")
+	if err != nil {
+		log.Printf("error encoding fhir bundle: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	attachment(w, fhir.ContentType, "covid-vaccination-record.json")
+	w.Write(b)
+}
+
+// cardPDFHandler serves a printable version of the card. Pass layout=wallet
+// for a credit card sized card instead of a full page.
+func (c *CovidRecord) cardPDFHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := c.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	layout := pdf.Layout(r.URL.Query().Get("layout"))
+	if layout != pdf.Wallet {
+		layout = pdf.FullPage
+	}
+
+	b, err := pdf.RenderCard(sess.Record, qrPayload(sess.Record), layout)
+	if err != nil {
+		log.Printf("error rendering pdf card: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	attachment(w, "application/pdf", fmt.Sprintf("covid-vaccination-card-%s.pdf", layout))
+	w.Write(b)
+}
+
+// applePassHandler serves the card as an Apple Wallet pass. Demo records
+// don't get a pass signed with our certificate.
+func (c *CovidRecord) applePassHandler(w http.ResponseWriter, r *http.Request) {
+	if c.AppleWallet == nil {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noAppleWallet")))
+		return
+	}
+	sess, ok := c.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if sess.Demo() {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noAppleWallet")))
+		return
+	}
+
+	b, err := c.AppleWallet.Pass(sess.Record, qrPayload(sess.Record))
+	if err != nil {
+		log.Printf("error building apple wallet pass: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	attachment(w, wallet.PKPassContentType, "covid-vaccination.pkpass")
+	w.Write(b)
+}
+
+// googlePassHandler sends the user to Google Pay to save the card. The signed
+// link is built on demand, rather than put on the card page, because it
+// embeds the whole pass and is too long to comfortably include in the page.
+// Demo records don't get a link signed with our issuer key.
+func (c *CovidRecord) googlePassHandler(w http.ResponseWriter, r *http.Request) {
+	if c.GoogleWallet == nil {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noGoogleWallet")))
+		return
+	}
+	sess, ok := c.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if sess.Demo() {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noGoogleWallet")))
+		return
+	}
+
+	saveURL, err := c.GoogleWallet.SaveURL(sess.Record, qrPayload(sess.Record))
+	if err != nil {
+		log.Printf("error building google wallet link: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, saveURL, http.StatusFound)
+}
+
+// dccPage is the data dcc.html is rendered with
+type dccPage struct {
+	Name        string
+	QrCodePng   string
+	Vaccination dcc.Vaccination
+	Product     string
+	Given       record.Date
+	Expires     time.Time
+}
+
+// dccHandler shows the record as an EU Digital COVID Certificate. Demo
+// records aren't anyone's, so they don't get a certificate signed with our key.
+func (c *CovidRecord) dccHandler(w http.ResponseWriter, r *http.Request) {
+	if c.DCC == nil {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noDCC")))
+		return
+	}
+	sess, ok := c.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if sess.Demo() {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noDCC")))
+		return
+	}
+
+	rec := sess.Record
+	cert, err := dcc.NewCertificate(rec, c.DCC.Country, c.DCC.Name)
+	if errors.Is(err, dcc.ErrNoVaccination) {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noVaccinations")))
+		return
+	}
+	if errors.Is(err, dcc.ErrNoBirthDate) {
+		renderError(w, r, http.StatusUnprocessableEntity, errors.New(catalog(r).T("error.noBirthDate")))
+		return
+	}
+	if err != nil {
+		log.Printf("error building eu dcc: %s", err)
+		renderError(w, r, http.StatusUnprocessableEntity, errors.New(catalog(r).T("error.dccVaccine", err)))
+		return
+	}
+
+	now := time.Now()
+	payload, err := c.DCC.Encode(rec, now)
+	if err != nil {
+		log.Printf("error signing eu dcc: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	qrCode, err := genQrCode(payload)
+	if err != nil {
+		log.Printf("error generating qr code: %s", err)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderTemplate(w, r, "dcc.html", dccPage{
+		Name:        rec.Patient.Name,
+		QrCodePng:   qrCode,
+		Vaccination: cert.Vaccinations[0],
+		Product:     rec.Doses[len(rec.Doses)-1].Product,
+		Given:       rec.Doses[len(rec.Doses)-1].Date,
+		Expires:     now.Add(c.DCC.Validity),
+	})
+}
+
+// nextDoseHandler serves a calendar event, with reminders, for the day the
+// next dose is due
+func (c *CovidRecord) nextDoseHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := c.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	cat := catalog(r)
+	rec := sess.Record
+	summary := rec.Summary()
+	if summary.NextDoseDue.IsZero() {
+		renderError(w, r, http.StatusNotFound, errors.New(cat.T("error.noNextDose")))
+		return
+	}
+
+	// boosters don't count towards the series
+	dose := ordinalLabel(cat, summary.DosesRequired-summary.DosesRemaining, "reminder.dose")
+	vaccine := cat.T("reminder.vaccine")
+	if product := rec.Doses[0].Product; product != "" {
+		vaccine = product
+	}
+	earliest := cat.Date(summary.NextDoseEarliest)
+
+	// the uid is stable so that downloading the reminder again updates the
+	// event instead of adding a second one
+	patientHash := sha256.Sum256([]byte(rec.Patient.Name + rec.Patient.BirthDate.String()))
+	uid := fmt.Sprintf("%x-%s@covidrecord", patientHash[:8], summary.NextDoseDue.Format("20060102"))
+
+	event := ics.Event{
+		UID:         uid,
+		Date:        summary.NextDoseDue.Time,
+		Summary:     cat.T("reminder.summary", dose),
+		Description: cat.T("reminder.description", dose, vaccine, earliest),
+		Alarms: []ics.Alarm{{
+			Before:      summary.NextDoseDue.Sub(summary.NextDoseEarliest.Time),
+			Description: cat.T("reminder.earliest", dose),
+		}, {
+			Before:      24 * time.Hour,
+			Description: cat.T("reminder.tomorrow", dose),
+		}},
+	}
+
+	attachment(w, ics.ContentType, "covid-vaccine-next-dose.ics")
+	w.Write(ics.Encode([]ics.Event{event}, time.Now()))
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/dcc"
+	"github.com/adhocteam/covidreport/record"
+	"github.com/adhocteam/covidreport/wallet"
+)
+
+func TestExportFHIR(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	r := httptest.NewRequest("GET", "/export/fhir", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.exportFHIRHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/fhir+json" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="covid-vaccination-record.json"` {
+		t.Errorf("unexpected content disposition %s", cd)
+	}
+
+	w = httptest.NewRecorder()
+	server.exportFHIRHandler(w, httptest.NewRequest("GET", "/export/fhir", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", w.Code)
+	}
+}
+
+func TestCardPDF(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	for _, layout := range []string{"", "wallet"} {
+		r := httptest.NewRequest("GET", "/card.pdf?layout="+layout, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		server.cardPDFHandler(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/pdf" {
+			t.Errorf("unexpected content type %s", ct)
+		}
+		if !strings.HasPrefix(w.Body.String(), "%PDF-") {
+			t.Errorf("expected a pdf for layout %q", layout)
+		}
+	}
+}
+
+func TestApplePassNotConfigured(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	r := httptest.NewRequest("GET", "/card.pkpass", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.applePassHandler(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when apple wallet isn't configured, got %d", w.Code)
+	}
+}
+
+func TestApplePassDemo(t *testing.T) {
+	// the wallet can't sign anything, but the demo record mustn't get that far
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute), AppleWallet: &wallet.AppleWallet{}}
+	body, cookie := demoCard(t, server)
+	if strings.Contains(body, `href="/card.pkpass"`) {
+		t.Errorf("expected the demo card not to offer an apple wallet pass")
+	}
+
+	r := httptest.NewRequest("GET", "/card.pkpass", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.applePassHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a demo record, got %d", w.Code)
+	}
+}
+
+func TestGooglePassNotConfigured(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	r := httptest.NewRequest("GET", "/googlewallet", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.googlePassHandler(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when google wallet isn't configured, got %d", w.Code)
+	}
+}
+
+func TestGooglePassDemo(t *testing.T) {
+	// the wallet can't sign anything, but the demo record mustn't get that far
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute), GoogleWallet: &wallet.GoogleWallet{}}
+	body, cookie := demoCard(t, server)
+	if strings.Contains(body, `href="/googlewallet"`) {
+		t.Errorf("expected the demo card not to offer a google wallet pass")
+	}
+
+	r := httptest.NewRequest("GET", "/googlewallet", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.googlePassHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a demo record, got %d", w.Code)
+	}
+}
+
+func TestNextDoseICS(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	r := httptest.NewRequest("GET", "/nextdose.ics", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.nextDoseHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"DTSTART;VALUE=DATE:20210222", "TRIGGER:-P4D", "TRIGGER:-P1D", "second dose"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in calendar:\n%s", want, body)
+		}
+	}
+
+	// the reminder is in the user's language
+	r.Header.Set("Accept-Language", "es")
+	w = httptest.NewRecorder()
+	server.nextDoseHandler(w, r)
+	body = w.Body.String()
+	for _, want := range []string{"le toca la segunda dosis", "18 feb 2021"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the spanish calendar:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "second dose") {
+		t.Errorf("didn't expect english in the spanish calendar:\n%s", body)
+	}
+}
+
+// testDCCIssuer signs certificates with a throwaway key
+func testDCCIssuer(t *testing.T) *dcc.Issuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "DSC test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := dcc.NewIssuer("US", "Ad Hoc LLC",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestDCC(t *testing.T) {
+	server, cookie := loggedIn(t)
+
+	r := httptest.NewRequest("GET", "/dcc", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.dccHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when the dcc isn't configured, got %d", w.Code)
+	}
+
+	server.DCC = testDCCIssuer(t)
+	w = httptest.NewRecorder()
+	server.dccHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"data:image/png;base64,", "Dose 1/2", "URN:UVCI:01:US:"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the page:\n%s", want, body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	server.dccHandler(w, httptest.NewRequest("GET", "/dcc", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", w.Code)
+	}
+}
+
+func TestDCCNoBirthDate(t *testing.T) {
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute), DCC: testDCCIssuer(t)}
+	rec := claimsRecord(mustPersona(t, "pfizer-complete"))
+	rec.Patient.BirthDate = record.Date{}
+	w := httptest.NewRecorder()
+	server.Sessions.Create(w, httptest.NewRequest("GET", "/", nil), rec)
+
+	r := httptest.NewRequest("GET", "/dcc", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	server.dccHandler(w, r)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "date of birth") {
+		t.Errorf("expected a certificate without a birth date to be refused, got %d: %s", w.Code, w.Body)
+	}
+}
+
+// demoCard shows server's demo card, returning the page and the cookie of the
+// session it started
+func demoCard(t *testing.T, server *CovidRecord) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.staticCallback(w, httptest.NewRequest("GET", "/showCallback?persona=pfizer-complete", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the demo card, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	return w.Body.String(), cookies[0]
+}
+
+func TestDCCDemo(t *testing.T) {
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute), DCC: testDCCIssuer(t)}
+	body, cookie := demoCard(t, server)
+	if strings.Contains(body, `href="/dcc"`) {
+		t.Errorf("expected the demo card not to offer a dcc")
+	}
+
+	r := httptest.NewRequest("GET", "/dcc", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.dccHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a demo record, got %d", w.Code)
+	}
+}
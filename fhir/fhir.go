@@ -0,0 +1,270 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fhir converts a normalized vaccination record into FHIR R4
+// resources, so users can take their record to another provider or app.
+// https://www.hl7.org/fhir/R4/
+package fhir
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// ContentType is the mime type for FHIR json
+const ContentType = "application/fhir+json"
+
+// CVXSystem is the code system for CDC vaccine codes
+const CVXSystem = "http://hl7.org/fhir/sid/cvx"
+
+// LOINCSystem is the code system for lab tests
+const LOINCSystem = "http://loinc.org"
+
+// hcpcsSystem is the code system for the HCPCS and CPT codes in claims
+const hcpcsSystem = "https://bluebutton.cms.gov/resources/codesystem/hcpcs"
+
+// snomedSystem is the code system for lab results
+const snomedSystem = "http://snomed.info/sct"
+
+// unspecifiedCVX is the CVX code for a covid vaccine of unknown formulation,
+// which we use when we can't identify the product
+const unspecifiedCVX = "213"
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type HumanName struct {
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+// Patient is a FHIR R4 Patient resource
+// https://www.hl7.org/fhir/R4/patient.html
+type Patient struct {
+	ResourceType string      `json:"resourceType"`
+	Name         []HumanName `json:"name,omitempty"`
+	Gender       string      `json:"gender,omitempty"`
+	BirthDate    string      `json:"birthDate,omitempty"`
+}
+
+// Immunization is a FHIR R4 Immunization resource
+// https://www.hl7.org/fhir/R4/immunization.html
+type Immunization struct {
+	ResourceType       string          `json:"resourceType"`
+	Status             string          `json:"status"`
+	VaccineCode        CodeableConcept `json:"vaccineCode"`
+	Patient            Reference       `json:"patient"`
+	OccurrenceDateTime string          `json:"occurrenceDateTime"`
+	PrimarySource      bool            `json:"primarySource"`
+	Manufacturer       *Reference      `json:"manufacturer,omitempty"`
+	LotNumber          string          `json:"lotNumber,omitempty"`
+	Location           *Reference      `json:"location,omitempty"`
+}
+
+// Observation is a FHIR R4 Observation resource, for a lab result
+// https://www.hl7.org/fhir/R4/observation.html
+type Observation struct {
+	ResourceType         string            `json:"resourceType"`
+	Status               string            `json:"status"`
+	Category             []CodeableConcept `json:"category"`
+	Code                 CodeableConcept   `json:"code"`
+	Subject              Reference         `json:"subject"`
+	EffectiveDateTime    string            `json:"effectiveDateTime"`
+	Performer            []Reference       `json:"performer,omitempty"`
+	ValueCodeableConcept *CodeableConcept  `json:"valueCodeableConcept,omitempty"`
+	// DataAbsentReason explains a missing value, like a claim that doesn't
+	// include the result
+	DataAbsentReason *CodeableConcept `json:"dataAbsentReason,omitempty"`
+}
+
+// Entry is one resource in a bundle
+type Entry struct {
+	FullURL  string      `json:"fullUrl"`
+	Resource interface{} `json:"resource"`
+}
+
+// Bundle is a FHIR R4 Bundle resource
+// https://www.hl7.org/fhir/R4/bundle.html
+type Bundle struct {
+	ResourceType string  `json:"resourceType"`
+	ID           string  `json:"id,omitempty"`
+	Type         string  `json:"type"`
+	Timestamp    string  `json:"timestamp,omitempty"`
+	Entries      []Entry `json:"entry"`
+}
+
+// newUUID returns a random (version 4) uuid
+func newUUID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("Unable to get random numbers")
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// fhirGender maps a gender to the FHIR administrative-gender value set
+func fhirGender(gender string) string {
+	switch g := strings.ToLower(gender); g {
+	case "male", "female", "other", "unknown":
+		return g
+	case "":
+		return ""
+	default:
+		return "unknown"
+	}
+}
+
+// NewPatient converts a normalized patient to a FHIR Patient
+func NewPatient(pat record.Patient) Patient {
+	p := Patient{
+		ResourceType: "Patient",
+		Gender:       fhirGender(pat.Gender),
+	}
+	if pat.Name != "" || pat.FamilyName != "" {
+		name := HumanName{Text: pat.Name, Family: pat.FamilyName}
+		if pat.GivenName != "" {
+			name.Given = strings.Fields(pat.GivenName)
+		}
+		p.Name = []HumanName{name}
+	}
+	if !pat.BirthDate.IsZero() {
+		p.BirthDate = pat.BirthDate.Format("2006-01-02")
+	}
+	return p
+}
+
+// NewImmunization converts a normalized dose to a FHIR Immunization given to
+// the patient at patientRef
+func NewImmunization(dose record.Dose, patientRef string) Immunization {
+	coding := Coding{System: CVXSystem, Code: dose.CVX, Display: dose.Product}
+	if coding.Code == "" {
+		coding = Coding{
+			System:  CVXSystem,
+			Code:    unspecifiedCVX,
+			Display: "SARS-COV-2 (COVID-19) vaccine, UNSPECIFIED FORMULATION",
+		}
+	}
+
+	imm := Immunization{
+		ResourceType:       "Immunization",
+		Status:             "completed",
+		VaccineCode:        CodeableConcept{Coding: []Coding{coding}, Text: dose.Display},
+		Patient:            Reference{Reference: patientRef},
+		OccurrenceDateTime: dose.Date.Format("2006-01-02"),
+		// we're reporting records from a claim or the VA, not the provider who
+		// gave the vaccine
+		PrimarySource: false,
+		LotNumber:     dose.Lot,
+	}
+	if dose.Manufacturer != "" {
+		imm.Manufacturer = &Reference{Display: dose.Manufacturer}
+	}
+	if dose.Location != "" {
+		imm.Location = &Reference{Display: dose.Location}
+	}
+	return imm
+}
+
+// results are the SNOMED codes for the outcome of a test
+var results = map[record.TestOutcome]Coding{
+	record.OutcomePositive: {System: snomedSystem, Code: "260373001", Display: "Detected"},
+	record.OutcomeNegative: {System: snomedSystem, Code: "260415000", Display: "Not detected"},
+}
+
+// NewObservation converts a normalized test to a FHIR laboratory Observation
+// of the patient at patientRef
+func NewObservation(test record.TestResult, patientRef string) Observation {
+	system := LOINCSystem
+	if test.Source == record.SourceBlueButton {
+		system = hcpcsSystem
+	}
+	obs := Observation{
+		ResourceType: "Observation",
+		Status:       "final",
+		Category: []CodeableConcept{{Coding: []Coding{{
+			System:  "http://terminology.hl7.org/CodeSystem/observation-category",
+			Code:    "laboratory",
+			Display: "Laboratory",
+		}}}},
+		Code: CodeableConcept{
+			Coding: []Coding{{System: system, Code: test.Code, Display: test.Display}},
+			Text:   test.Display,
+		},
+		Subject:           Reference{Reference: patientRef},
+		EffectiveDateTime: test.Date.Format(time.RFC3339),
+	}
+	if result, ok := results[test.Outcome]; ok {
+		obs.ValueCodeableConcept = &CodeableConcept{Coding: []Coding{result}, Text: result.Display}
+	} else {
+		obs.DataAbsentReason = &CodeableConcept{Coding: []Coding{{
+			System:  "http://terminology.hl7.org/CodeSystem/data-absent-reason",
+			Code:    "unknown",
+			Display: "Unknown",
+		}}}
+	}
+	if test.Location != "" {
+		obs.Performer = []Reference{{Display: test.Location}}
+	}
+	return obs
+}
+
+// NewBundle converts a record into a FHIR collection bundle with one Patient,
+// an Immunization for each dose and an Observation for each test
+func NewBundle(rec *record.Record, now time.Time) *Bundle {
+	patientRef := "urn:uuid:" + newUUID()
+	bundle := &Bundle{
+		ResourceType: "Bundle",
+		ID:           newUUID(),
+		Type:         "collection",
+		Timestamp:    now.UTC().Format(time.RFC3339),
+		Entries: []Entry{{
+			FullURL:  patientRef,
+			Resource: NewPatient(rec.Patient),
+		}},
+	}
+	for _, dose := range rec.Doses {
+		bundle.Entries = append(bundle.Entries, Entry{
+			FullURL:  "urn:uuid:" + newUUID(),
+			Resource: NewImmunization(dose, patientRef),
+		})
+	}
+	for _, test := range rec.Tests {
+		bundle.Entries = append(bundle.Entries, Entry{
+			FullURL:  "urn:uuid:" + newUUID(),
+			Resource: NewObservation(test, patientRef),
+		})
+	}
+	return bundle
+}
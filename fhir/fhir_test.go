@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fhir
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+	"github.com/adhocteam/covidreport/lighthouse"
+	"github.com/adhocteam/covidreport/record"
+)
+
+// requireFields fails the test if any of the given fields are missing or empty
+// in a json object
+func requireFields(t *testing.T, what string, obj map[string]interface{}, fields ...string) {
+	t.Helper()
+	for _, field := range fields {
+		v, ok := obj[field]
+		if !ok || v == nil || v == "" {
+			t.Errorf("%s is missing required field %s: %v", what, field, obj)
+		}
+	}
+}
+
+// validateBundle round-trips a bundle through json and checks the fields the
+// FHIR R4 spec requires of a collection of patients, immunizations and
+// observations
+func validateBundle(t *testing.T, bundle *Bundle) []map[string]interface{} {
+	t.Helper()
+	b, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	requireFields(t, "bundle", doc, "resourceType", "type", "entry")
+	if doc["resourceType"] != "Bundle" || doc["type"] != "collection" {
+		t.Errorf("expected a collection bundle, got %v", doc)
+	}
+
+	var resources []map[string]interface{}
+	patients := map[string]bool{}
+	entries, _ := doc["entry"].([]interface{})
+	for _, e := range entries {
+		entry := e.(map[string]interface{})
+		requireFields(t, "entry", entry, "fullUrl", "resource")
+		resource := entry["resource"].(map[string]interface{})
+		requireFields(t, "resource", resource, "resourceType")
+
+		switch resource["resourceType"] {
+		case "Patient":
+			patients[entry["fullUrl"].(string)] = true
+		case "Immunization":
+			requireFields(t, "immunization", resource, "status", "vaccineCode", "patient", "occurrenceDateTime")
+			if _, ok := resource["primarySource"]; !ok {
+				t.Errorf("immunization is missing primarySource")
+			}
+			coding := resource["vaccineCode"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})
+			requireFields(t, "vaccineCode", coding, "system", "code")
+			if coding["system"] != CVXSystem {
+				t.Errorf("expected a cvx code, got %v", coding)
+			}
+			ref := resource["patient"].(map[string]interface{})["reference"]
+			if ref == nil || !patients[ref.(string)] {
+				t.Errorf("immunization refers to unknown patient %v", ref)
+			}
+		case "Observation":
+			requireFields(t, "observation", resource, "status", "code", "subject", "effectiveDateTime")
+			_, hasValue := resource["valueCodeableConcept"]
+			_, hasReason := resource["dataAbsentReason"]
+			if hasValue == hasReason {
+				t.Errorf("expected observation to have either a value or a reason it's missing: %v", resource)
+			}
+			ref := resource["subject"].(map[string]interface{})["reference"]
+			if ref == nil || !patients[ref.(string)] {
+				t.Errorf("observation refers to unknown patient %v", ref)
+			}
+		default:
+			t.Errorf("unexpected resource %v", resource["resourceType"])
+		}
+		resources = append(resources, resource)
+	}
+	return resources
+}
+
+func TestBundleFromBlueButton(t *testing.T) {
+	pat := &bluebutton.Patient{
+		Gender:    "female",
+		BirthDate: bluebutton.YearMonthDay{Time: time.Date(1999, 6, 1, 0, 0, 0, 0, time.UTC)},
+		Name:      []bluebutton.PatientName{{Family: "Doe", Given: []string{"Jane", "X"}}},
+	}
+	vaxes := []bluebutton.Vaccination{
+		{Date: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC), Code: "0011A", Lot: "012L20A", Location: "Northshore Clinic"},
+		{Date: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), Code: "0012A"},
+	}
+
+	resources := validateBundle(t, NewBundle(record.FromBlueButton(pat, vaxes), time.Now()))
+	if len(resources) != 3 {
+		t.Fatalf("expected a patient and two immunizations, got %d resources", len(resources))
+	}
+
+	patient := resources[0]
+	if patient["birthDate"] != "1999-06-01" || patient["gender"] != "female" {
+		t.Errorf("unexpected patient %v", patient)
+	}
+
+	first := resources[1]
+	if first["occurrenceDateTime"] != "2021-01-04" || first["lotNumber"] != "012L20A" {
+		t.Errorf("unexpected immunization %v", first)
+	}
+	code := first["vaccineCode"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"]
+	if code != "207" {
+		t.Errorf("expected moderna's cvx code, got %v", code)
+	}
+}
+
+func TestBundleFromLighthouse(t *testing.T) {
+	pat := &lighthouse.Patient{
+		Name:      "Mr. Porfirio146 Schmeler639",
+		BirthDate: lighthouse.YearMonthDay{Time: time.Date(1950, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	vaxes := []lighthouse.Vaccination{
+		{Date: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC), Code: "unrecognized"},
+	}
+
+	resources := validateBundle(t, NewBundle(record.FromLighthouse(pat, vaxes), time.Now()))
+	if len(resources) != 2 {
+		t.Fatalf("expected a patient and one immunization, got %d resources", len(resources))
+	}
+
+	code := resources[1]["vaccineCode"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"]
+	if code != unspecifiedCVX {
+		t.Errorf("expected the unspecified cvx code, got %v", code)
+	}
+}
+
+func TestBundleWithTests(t *testing.T) {
+	pat := &lighthouse.Patient{Name: "Tamara Ellis"}
+	rec := record.FromLighthouse(pat, nil)
+	rec.Tests = record.LighthouseTests([]lighthouse.LabResult{
+		{Date: time.Date(2021, 9, 20, 14, 10, 0, 0, time.UTC), Code: "94500-6", Value: "260415000", Performer: "Cheyenne VA Medical Center Laboratory"},
+	})
+	claims := record.FromBlueButton(nil, nil)
+	claims.Tests = record.BlueButtonTests([]bluebutton.LabTest{
+		{Date: time.Date(2021, 8, 30, 0, 0, 0, 0, time.UTC), Code: "U0003"},
+	})
+
+	resources := validateBundle(t, NewBundle(record.Merge(rec, claims), time.Now()))
+	if len(resources) != 3 {
+		t.Fatalf("expected a patient and two observations, got %d resources", len(resources))
+	}
+
+	// the claim says a test was done, but not the result
+	claim := resources[1]
+	if claim["effectiveDateTime"] != "2021-08-30T00:00:00Z" || claim["dataAbsentReason"] == nil {
+		t.Errorf("unexpected observation %v", claim)
+	}
+	lab := resources[2]
+	result := lab["valueCodeableConcept"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})
+	if result["code"] != "260415000" {
+		t.Errorf("expected a not detected result, got %v", result)
+	}
+	code := lab["code"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})
+	if code["system"] != LOINCSystem || code["code"] != "94500-6" {
+		t.Errorf("expected the loinc code, got %v", code)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package i18n holds the translations of the app's pages and picks the
+// language to show them in.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default is the language we fall back to, and the one every other catalog
+// is translated from
+const Default = "en"
+
+// Supported lists the languages we have a catalog for, default first
+var Supported = []string{"en", "es"}
+
+// the catalogs are a flat json object of message key to text, one file per
+// language
+//
+//go:embed locales/*.json
+var localeFS embed.FS
+
+// Catalog is the messages for a language
+type Catalog struct {
+	Lang     string
+	Messages map[string]string
+	fallback *Catalog
+}
+
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() map[string]*Catalog {
+	cats := make(map[string]*Catalog, len(Supported))
+	for _, lang := range Supported {
+		b, err := localeFS.ReadFile("locales/" + lang + ".json")
+		if err != nil {
+			panic(err)
+		}
+		cat := &Catalog{Lang: lang}
+		if err := json.Unmarshal(b, &cat.Messages); err != nil {
+			panic(fmt.Sprintf("unable to parse the %s catalog: %s", lang, err))
+		}
+		cats[lang] = cat
+	}
+	for lang, cat := range cats {
+		if lang != Default {
+			cat.fallback = cats[Default]
+		}
+	}
+	return cats
+}
+
+// Lookup returns the catalog for a language, or the default catalog if we
+// don't support it
+func Lookup(lang string) *Catalog {
+	if cat, ok := catalogs[lang]; ok {
+		return cat
+	}
+	return catalogs[Default]
+}
+
+// IsSupported reports whether we have a catalog for lang
+func IsSupported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// Keys lists the catalog's message keys, sorted
+func (c *Catalog) Keys() []string {
+	keys := make([]string, 0, len(c.Messages))
+	for k := range c.Messages {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// T returns the message for key, formatted with args like fmt.Sprintf. A
+// message missing from the catalog falls back to the default language, and
+// then to the key itself, so a missing translation shows up on the page
+// rather than breaking it.
+func (c *Catalog) T(key string, args ...interface{}) string {
+	msg, ok := c.Messages[key]
+	if !ok {
+		if c.fallback != nil {
+			return c.fallback.T(key, args...)
+		}
+		return key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// N returns the singular or plural form of a message, key.one or key.other,
+// for a count of n. Both of our languages only have the two forms. The
+// count is shown by the caller, not formatted into the message.
+func (c *Catalog) N(key string, n int) string {
+	if n == 1 {
+		return c.T(key + ".one")
+	}
+	return c.T(key + ".other")
+}
+
+// Time is a date to format, like a time.Time or a record.Date
+type Time interface {
+	Format(layout string) string
+	Month() time.Month
+}
+
+// monthToken is substituted for the month name while formatting a date, so
+// the layout can put it wherever the language wants it
+const monthToken = "\x00"
+
+// Format formats t with the go layout in the message layoutKey, naming the
+// month in the catalog's language. Layouts use "Jan" for the month.
+func (c *Catalog) Format(layoutKey string, t Time) string {
+	layout := strings.Replace(c.T(layoutKey), "Jan", monthToken, 1)
+	month := c.T("month." + strconv.Itoa(int(t.Month())))
+	return strings.Replace(t.Format(layout), monthToken, month, 1)
+}
+
+// Date formats a date, like "2 Jan 2006"
+func (c *Catalog) Date(t Time) string {
+	return c.Format("date.format", t)
+}
+
+// DateTime formats a date and time of day, like "2 Jan 2006 3:04 PM"
+func (c *Catalog) DateTime(t Time) string {
+	return c.Format("datetime.format", t)
+}
+
+// Negotiate picks the supported language the Accept-Language header prefers,
+// or the default if it doesn't ask for any we have
+// https://httpwg.org/specs/rfc7231.html#header.accept-language
+func Negotiate(header string) string {
+	best, bestQ := Default, 0.0
+	for i, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		// we only have one variety of each language, so es-MX gets es
+		lang := strings.SplitN(tag, "-", 2)[0]
+		// earlier entries win ties, by giving them a slight edge
+		q -= float64(i) * 1e-6
+		if IsSupported(lang) && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package i18n
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                              "en",
+		"es":                            "es",
+		"es-MX,es;q=0.9,en;q=0.8":       "es",
+		"en-US,en;q=0.9,es;q=0.8":       "en",
+		"fr-FR,fr;q=0.9,es;q=0.5":       "es",
+		"fr":                            "en",
+		"en;q=0.2, ES;q=0.7":            "es",
+		"es;q=0":                        "en",
+		"es;q=bogus, en":                "en",
+		"de, es-419;q=0.8, en-GB;q=0.8": "es",
+	}
+	for header, want := range tests {
+		if got := Negotiate(header); got != want {
+			t.Errorf("%q: expected %s, got %s", header, want, got)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tm := time.Date(2021, 8, 5, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		lang, date, dob, datetime string
+	}{
+		{"en", "5 Aug 2021", "05 Aug 2021", "5 Aug 2021 3:04 PM"},
+		{"es", "5 ago 2021", "05 ago 2021", "5 ago 2021 15:04"},
+	}
+	for _, tt := range tests {
+		cat := Lookup(tt.lang)
+		if got := cat.Date(tm); got != tt.date {
+			t.Errorf("%s: expected %q, got %q", tt.lang, tt.date, got)
+		}
+		if got := cat.Format("dob.format", tm); got != tt.dob {
+			t.Errorf("%s: expected %q, got %q", tt.lang, tt.dob, got)
+		}
+		if got := cat.DateTime(tm); got != tt.datetime {
+			t.Errorf("%s: expected %q, got %q", tt.lang, tt.datetime, got)
+		}
+	}
+}
+
+func TestT(t *testing.T) {
+	es := Lookup("es")
+	if got := es.T("connect.provider", "VA"); got != "Conectar con VA" {
+		t.Errorf("unexpected message %q", got)
+	}
+	if got := es.N("card.dosesRemaining", 1); got != "dosis pendiente" {
+		t.Errorf("unexpected singular %q", got)
+	}
+	if got := es.N("card.dosesRemaining", 0); got != "dosis pendientes" {
+		t.Errorf("unexpected plural %q", got)
+	}
+	if got := es.T("no.such.key"); got != "no.such.key" {
+		t.Errorf("expected a missing message to show its key, got %q", got)
+	}
+	if Lookup("xx") != Lookup(Default) {
+		t.Errorf("expected an unsupported language to get the default catalog")
+	}
+}
+
+var verbRe = regexp.MustCompile(`%[a-z]`)
+
+// TestCatalogsMatch checks every catalog translates exactly the default
+// catalog's messages, with the same format verbs
+func TestCatalogsMatch(t *testing.T) {
+	def := Lookup(Default)
+	for _, lang := range Supported {
+		cat := Lookup(lang)
+		for _, key := range def.Keys() {
+			msg, ok := cat.Messages[key]
+			if !ok {
+				t.Errorf("%s: missing a translation of %q", lang, key)
+				continue
+			}
+			want := verbRe.FindAllString(def.Messages[key], -1)
+			if got := verbRe.FindAllString(msg, -1); len(got) != len(want) {
+				t.Errorf("%s: %q has verbs %v, expected %v", lang, key, got, want)
+			}
+		}
+		for _, key := range cat.Keys() {
+			if _, ok := def.Messages[key]; !ok {
+				t.Errorf("%s: %q isn't in the %s catalog", lang, key, Default)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ics writes iCalendar files (RFC 5545) so users can add reminders
+// for their next dose to their calendar.
+package ics
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ContentType is the mime type for an iCalendar file
+const ContentType = "text/calendar; charset=utf-8"
+
+// Alarm is a reminder shown some time before an event starts
+type Alarm struct {
+	Before      time.Duration
+	Description string
+}
+
+// Event is an all-day calendar event
+type Event struct {
+	UID         string
+	Date        time.Time
+	Summary     string
+	Description string
+	Alarms      []Alarm
+}
+
+// escape escapes text values as section 3.3.11 requires
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// writeLine writes a content line, folding it so that no line is longer than
+// 75 octets (section 3.1). Folds never split a utf-8 sequence.
+func writeLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xc0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space, which counts toward the
+		// limit
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// duration formats d as a negative iCalendar duration, for an alarm trigger
+func duration(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("-P%dD", d/(24*time.Hour))
+	}
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("-PT%dH", d/time.Hour)
+	}
+	return fmt.Sprintf("-PT%dM", d/time.Minute)
+}
+
+// Encode returns a calendar containing events
+func Encode(events []Event, now time.Time) []byte {
+	var buf bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		writeLine(&buf, fmt.Sprintf(format, args...))
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Ad Hoc//Covid Report//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	for _, e := range events {
+		line("BEGIN:VEVENT")
+		line("UID:%s", e.UID)
+		line("DTSTAMP:%s", now.UTC().Format("20060102T150405Z"))
+		line("DTSTART;VALUE=DATE:%s", e.Date.Format("20060102"))
+		line("DTEND;VALUE=DATE:%s", e.Date.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:%s", escape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION:%s", escape(e.Description))
+		}
+		line("TRANSP:TRANSPARENT")
+		for _, a := range e.Alarms {
+			line("BEGIN:VALARM")
+			line("ACTION:DISPLAY")
+			line("TRIGGER:%s", duration(a.Before))
+			line("DESCRIPTION:%s", escape(a.Description))
+			line("END:VALARM")
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return buf.Bytes()
+}
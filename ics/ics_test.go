@@ -0,0 +1,69 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	now := time.Date(2021, 2, 2, 15, 4, 5, 0, time.UTC)
+	cal := string(Encode([]Event{{
+		UID:         "abc@covidrecord",
+		Date:        time.Date(2021, 2, 22, 0, 0, 0, 0, time.UTC),
+		Summary:     "COVID-19 vaccine: second dose due",
+		Description: "Due today; as early as 18 Feb, 2021",
+		Alarms:      []Alarm{{Before: 4 * 24 * time.Hour, Description: "now"}, {Before: 2 * time.Hour, Description: "soon"}},
+	}}, now))
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTAMP:20210202T150405Z\r\n",
+		"DTSTART;VALUE=DATE:20210222\r\n",
+		"DTEND;VALUE=DATE:20210223\r\n",
+		`DESCRIPTION:Due today\; as early as 18 Feb\, 2021` + "\r\n",
+		"TRIGGER:-P4D\r\n",
+		"TRIGGER:-PT2H\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(cal, want) {
+			t.Errorf("expected calendar to contain %q:\n%s", want, cal)
+		}
+	}
+	if strings.Count(cal, "BEGIN:VALARM") != 2 {
+		t.Errorf("expected two alarms:\n%s", cal)
+	}
+}
+
+func TestFolding(t *testing.T) {
+	long := strings.Repeat("é", 100)
+	cal := string(Encode([]Event{{UID: "x", Summary: long}}, time.Now()))
+
+	var unfolded strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(cal, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line longer than 75 octets: %q", line)
+		}
+		if strings.HasPrefix(line, " ") {
+			unfolded.WriteString(line[1:])
+		} else {
+			unfolded.WriteString("\n" + line)
+		}
+	}
+	if !strings.Contains(unfolded.String(), "SUMMARY:"+long) {
+		t.Errorf("folded line doesn't unfold to the original:\n%s", cal)
+	}
+}
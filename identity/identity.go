@@ -0,0 +1,249 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package identity decides whether two patient records, loaded from different
+// sources, belong to the same person. We have to be sure of that before we
+// merge their vaccinations onto one card.
+package identity
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// DefaultThreshold is the lowest score we accept as a match by default
+const DefaultThreshold = 0.85
+
+// how much each field counts toward the score. Fields that either record is
+// missing are left out, and the score is scaled by the weights that remain.
+const (
+	familyWeight    = 0.35
+	givenWeight     = 0.25
+	birthDateWeight = 0.3
+	genderWeight    = 0.1
+)
+
+// Result is the outcome of comparing two patients
+type Result struct {
+	// Score runs from 0, nothing in common, to 1, a perfect match
+	Score float64
+	// Mismatches describes the fields that didn't match exactly
+	Mismatches []string
+	// Incomplete is set when either patient is missing their name or birth
+	// date, which we need to say anything at all
+	Incomplete bool
+}
+
+// Matcher compares patients against a threshold
+type Matcher struct {
+	Threshold float64
+}
+
+// MismatchError is returned when two patients don't match well enough to
+// merge their records
+type MismatchError struct {
+	A, B   record.Patient
+	Result Result
+}
+
+func (e *MismatchError) Error() string {
+	a, b := record.SourceName(e.A.Source), record.SourceName(e.B.Source)
+	if e.Result.Incomplete {
+		return fmt.Sprintf("The records from %s and %s don't have enough details to tell whether they belong to the same person, so we haven't combined them.", a, b)
+	}
+	msg := fmt.Sprintf("The records from %s and %s don't appear to belong to the same person", a, b)
+	if len(e.Result.Mismatches) > 0 {
+		msg += fmt.Sprintf(" (the %s differ)", strings.Join(e.Result.Mismatches, " and "))
+	}
+	return msg + ", so we haven't combined them."
+}
+
+// Check compares a and b, and returns a *MismatchError if their score is below
+// the threshold
+func (m Matcher) Check(a, b record.Patient) (Result, error) {
+	res := Compare(a, b)
+	if res.Score < m.Threshold {
+		return res, &MismatchError{A: a, B: b, Result: res}
+	}
+	return res, nil
+}
+
+// honorifics and generational suffixes that aren't part of anyone's name for
+// our purposes
+var ignoredWords = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "miss": true, "dr": true,
+	"jr": true, "sr": true, "ii": true, "iii": true, "iv": true,
+}
+
+// normalizeName lowercases a name and strips punctuation, digits (synthetic
+// test data adds numbers to names, like "Porfirio146") and honorifics,
+// returning the words that remain
+func normalizeName(name string) []string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r):
+			return unicode.ToLower(r)
+		case unicode.IsSpace(r), r == '-':
+			return ' '
+		default:
+			// apostrophes, periods, digits
+			return -1
+		}
+	}, name)
+
+	var words []string
+	for _, word := range strings.Fields(cleaned) {
+		if !ignoredWords[word] {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// nameParts splits a patient's name into given names and a family name. Some
+// sources only give us the full name as text, in which case we assume the
+// last word is the family name.
+func nameParts(p record.Patient) ([]string, string) {
+	given := normalizeName(p.GivenName)
+	family := strings.Join(normalizeName(p.FamilyName), " ")
+	if family != "" {
+		return given, family
+	}
+
+	words := normalizeName(p.Name)
+	if len(words) == 0 {
+		return nil, ""
+	}
+	return words[:len(words)-1], words[len(words)-1]
+}
+
+// similarity compares two words, allowing for a typo or two in longer names
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	longest := len([]rune(a))
+	if n := len([]rune(b)); n > longest {
+		longest = n
+	}
+	if longest == 0 {
+		return 0
+	}
+	sim := 1 - float64(levenshtein(a, b))/float64(longest)
+	// a couple of letters in common doesn't make a match
+	if sim < 0.75 {
+		return 0
+	}
+	return sim
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(vals ...int) int {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// givenSimilarity compares first names, and gives partial credit when one
+// side only has an initial
+func givenSimilarity(a, b []string) float64 {
+	if a[0] == b[0] {
+		return 1
+	}
+	if (len(a[0]) == 1 || len(b[0]) == 1) && a[0][0] == b[0][0] {
+		return 0.5
+	}
+	return similarity(a[0], b[0])
+}
+
+// Compare scores how likely it is that a and b are the same person
+func Compare(a, b record.Patient) Result {
+	var res Result
+	var score, total float64
+	compare := func(field string, weight, sim float64) {
+		score += weight * sim
+		total += weight
+		if sim < 1 {
+			res.Mismatches = append(res.Mismatches, field)
+		}
+	}
+
+	givenA, familyA := nameParts(a)
+	givenB, familyB := nameParts(b)
+	haveName := familyA != "" && familyB != ""
+	if haveName {
+		compare("last names", familyWeight, similarity(familyA, familyB))
+	}
+	if len(givenA) > 0 && len(givenB) > 0 {
+		compare("first names", givenWeight, givenSimilarity(givenA, givenB))
+	}
+
+	haveBirthDate := !a.BirthDate.IsZero() && !b.BirthDate.IsZero()
+	if haveBirthDate {
+		da, db := a.BirthDate, b.BirthDate
+		switch {
+		case da.Year() == db.Year() && da.YearDay() == db.YearDay():
+			compare("birth dates", birthDateWeight, 1)
+		case da.Year() == db.Year() && int(da.Month()) == db.Day() && da.Day() == int(db.Month()):
+			// the day and month were swapped somewhere along the way
+			compare("birth dates", birthDateWeight, 0.5)
+		default:
+			compare("birth dates", birthDateWeight, 0)
+		}
+	}
+
+	ga, gb := strings.ToLower(a.Gender), strings.ToLower(b.Gender)
+	if ga != "" && gb != "" && ga != "unknown" && gb != "unknown" {
+		sim := 0.0
+		if ga == gb {
+			sim = 1
+		}
+		compare("genders", genderWeight, sim)
+	}
+
+	if !haveName || !haveBirthDate {
+		res.Score = 0
+		res.Incomplete = true
+		return res
+	}
+	res.Score = score / total
+	return res
+}
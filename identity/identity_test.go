@@ -0,0 +1,94 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package identity
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+func birthDate(s string) record.Date {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return record.Date{Time: t}
+}
+
+func TestCompare(t *testing.T) {
+	bb := record.Patient{
+		Source:     record.SourceBlueButton,
+		GivenName:  "Porfirio146",
+		FamilyName: "Schmeler639",
+		Gender:     "male",
+		BirthDate:  birthDate("1948-07-11"),
+	}
+
+	tests := []struct {
+		name  string
+		other record.Patient
+		match bool
+	}{
+		{"same person", record.Patient{Name: "Porfirio Schmeler", Gender: "male", BirthDate: birthDate("1948-07-11")}, true},
+		{"typo in last name", record.Patient{Name: "Porfirio Schmeller", BirthDate: birthDate("1948-07-11")}, true},
+		{"honorific and initial", record.Patient{Name: "Mr. P. Schmeler", BirthDate: birthDate("1948-07-11")}, true},
+		{"different birth date", record.Patient{Name: "Porfirio Schmeler", BirthDate: birthDate("1952-03-02")}, false},
+		{"different person", record.Patient{Name: "Maria Gonzalez", Gender: "female", BirthDate: birthDate("1948-07-11")}, false},
+		{"no birth date", record.Patient{Name: "Porfirio Schmeler"}, false},
+		{"no name", record.Patient{BirthDate: birthDate("1948-07-11")}, false},
+	}
+
+	m := Matcher{Threshold: DefaultThreshold}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.other.Source = record.SourceLighthouse
+			res, err := m.Check(bb, tt.other)
+			if tt.match && err != nil {
+				t.Errorf("expected a match, got %s (score %.2f)", err, res.Score)
+			}
+			if !tt.match && err == nil {
+				t.Errorf("expected no match, got score %.2f", res.Score)
+			}
+		})
+	}
+}
+
+func TestMismatchError(t *testing.T) {
+	a := record.Patient{Source: record.SourceBlueButton, Name: "Joseph Esposito", BirthDate: birthDate("1999-06-01")}
+	b := record.Patient{Source: record.SourceLighthouse, Name: "Joseph Esposito", BirthDate: birthDate("1989-06-01")}
+
+	_, err := Matcher{Threshold: DefaultThreshold}.Check(a, b)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a *MismatchError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "birth dates") {
+		t.Errorf("expected the error to mention the birth dates, got %q", err)
+	}
+
+	// a low enough threshold lets it through
+	if _, err := (Matcher{Threshold: 0.5}).Check(a, b); err != nil {
+		t.Errorf("expected a match with a lower threshold, got %s", err)
+	}
+
+	b.BirthDate = record.Date{}
+	_, err = Matcher{Threshold: 0.5}.Check(a, b)
+	if !errors.As(err, &mismatch) || !mismatch.Result.Incomplete {
+		t.Errorf("expected incomplete data never to match, got %v", err)
+	}
+}
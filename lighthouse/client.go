@@ -4,7 +4,9 @@ Copyright 2021 Ad Hoc LLC
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
-    http://www.apache.org/licenses/LICENSE-2.0
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
 WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
@@ -15,8 +17,8 @@ package lighthouse
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -27,12 +29,32 @@ import (
 	"time"
 )
 
+// Client talks to VA Lighthouse. It caches the VA's openid configuration and
+// signing keys, so it mustn't be copied after first use.
 type Client struct {
 	ClientID     string
 	ClientSecret string
-	URL          string
-	FhirURL      string
-	CallbackURL  string
+	// URL is the base of the VA's oauth server, which publishes its
+	// endpoints at /oauth2/.well-known/openid-configuration
+	URL         string
+	FhirURL     string
+	CallbackURL string
+	// Timeout is how long we wait for each request to the VA. It defaults to
+	// ten seconds.
+	Timeout time.Duration
+
+	oidc oidc
+}
+
+// ErrTokenRejected is returned when the VA refuses our access token, usually
+// because it's expired
+var ErrTokenRejected = errors.New("the VA didn't accept our access token")
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 10 * time.Second
 }
 
 func (c *Client) String() string {
@@ -51,29 +73,34 @@ func (c *Client) String() string {
 		c.FhirURL)
 }
 
-func makeRandomState() string {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+// AuthURL returns the url to send the user to to log in to VA Lighthouse with
+// the given scopes. state is handed back to our callback, and the ID token
+// we're issued is bound to it.
+func (c *Client) AuthURL(scope, state string) (string, error) {
+	d, err := c.Discover()
 	if err != nil {
-		panic("Unable to get random numbers")
+		return "", err
 	}
-	return fmt.Sprintf("%x", b)
-}
-
-func (c Client) AuthURL(scope string) string {
-	return fmt.Sprintf("%s/oauth2/authorization?client_id=%s&redirect_uri=%s&response_type=code&state=%s&scope=%s",
-		c.URL, c.ClientID, c.CallbackURL, makeRandomState(), scope)
+	params := url.Values{}
+	params.Set("client_id", c.ClientID)
+	params.Set("redirect_uri", c.CallbackURL)
+	params.Set("response_type", "code")
+	params.Set("state", state)
+	params.Set("nonce", nonceFor(state))
+	params.Set("scope", scope)
+	return fmt.Sprintf("%s?%s", d.AuthorizationEndpoint, params.Encode()), nil
 }
 
-// {
-//   "access_token": "SlAV32hkKG",
-//   "expires_in": 3600,
-//   "refresh_token": "8xLOxBtZp8",
-//   "scope": "openid profile email offline_access",
-//   "patient": "1558538470",
-//   "state": "af0ifjsldkj",
-//   "token_type": "Bearer",
-// }
+//	{
+//	  "access_token": "SlAV32hkKG",
+//	  "expires_in": 3600,
+//	  "refresh_token": "8xLOxBtZp8",
+//	  "scope": "openid profile email offline_access",
+//	  "patient": "1558538470",
+//	  "state": "af0ifjsldkj",
+//	  "token_type": "Bearer",
+//	  "id_token": "eyJraWQiOiJ...",
+//	}
 type FullToken struct {
 	AccessToken  string  `json:"access_token"`
 	Expires      float32 `json:"expires_in"`
@@ -82,23 +109,56 @@ type FullToken struct {
 	RefreshToken string  `json:"refresh_token"`
 	State        string  `json:"state"`
 	PatientID    string  `json:"patient"`
+	IDToken      string  `json:"id_token"`
+
+	// Claims are the verified claims from the ID token, which identify the
+	// user who logged in
+	Claims *IDClaims `json:"-"`
 }
 
-func (c Client) GetFullToken(callbackToken, state string) (*FullToken, error) {
+// GetFullToken exchanges the code from the callback for tokens, and verifies
+// the ID token that comes with them. The ID token has to say which patient
+// the user is, in its fhirUser claim, and agree with the token response: the
+// patient field isn't signed, so it's only trusted when the ID token backs it.
+func (c *Client) GetFullToken(callbackToken, state string) (*FullToken, error) {
+	d, err := c.Discover()
+	if err != nil {
+		return nil, err
+	}
+
 	params := url.Values{}
 	params.Set("code", callbackToken)
 	params.Set("grant_type", "authorization_code")
 	params.Set("redirect_uri", c.CallbackURL)
 	params.Set("state", state)
-	fullTokenURL := fmt.Sprintf("%s/oauth2/token/", c.URL)
-	return c.requestFullToken(fullTokenURL, params)
+	tok, err := c.requestFullToken(d.TokenEndpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.IDToken == "" {
+		return nil, fmt.Errorf("the VA didn't return an id token")
+	}
+	tok.Claims, err = c.VerifyIDToken(tok.IDToken, nonceFor(state))
+	if err != nil {
+		return nil, err
+	}
+	id := tok.Claims.PatientID()
+	if id == "" {
+		return nil, fmt.Errorf("the VA's id token doesn't name the patient")
+	}
+	if tok.PatientID != id {
+		return nil, fmt.Errorf("the VA's token response and id token are for different patients")
+	}
+	log.Printf("authenticated VA user %s", tok.Claims.Subject)
+	return tok, nil
 }
 
 func (c *Client) requestFullToken(url string, data url.Values) (*FullToken, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
 	defer cancel()
 
-	log.Printf("sending %v to %s", data, url)
+	log.Printf("requesting a token from %s", url)
 
 	client := &http.Client{}
 	body := strings.NewReader(data.Encode())
@@ -142,8 +202,8 @@ func (c *Client) requestFullToken(url string, data url.Values) (*FullToken, erro
 	return &fullToken, nil
 }
 
-func get(url, tok string, obj interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (c *Client) get(url, tok string, obj interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
 	defer cancel()
 
 	log.Printf("getting %s", url)
@@ -154,7 +214,9 @@ func get(url, tok string, obj interface{}) error {
 		return err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	if tok != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	}
 
 	start := time.Now()
 	resp, err := client.Do(req)
@@ -170,6 +232,9 @@ func get(url, tok string, obj interface{}) error {
 		return err
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized && tok != "" {
+		return fmt.Errorf("%w: %s", ErrTokenRejected, resp.Header.Get("WWW-Authenticate"))
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("Expected 200, got %s", resp.Status)
 	}
@@ -188,20 +253,47 @@ type Code struct {
 	Value   interface{} `json:"value,omitempty"`
 }
 
+// cvxSystem identifies CVX codes in a coding
+const cvxSystem = "http://hl7.org/fhir/sid/cvx"
+
+// covidCVX are the CVX codes for covid vaccines. The VA returns every
+// immunization the veteran has had; we only want these.
+// https://www2.cdc.gov/vaccines/iis/iisstandards/vaccines.asp?rpt=cvx
+var covidCVX = map[string]bool{
+	"207": true, // Moderna
+	"208": true, // Pfizer-BioNTech
+	"210": true, // AstraZeneca
+	"211": true, // Novavax
+	"212": true, // Janssen
+	"213": true, // unspecified formulation
+	"217": true, // Pfizer-BioNTech, 12 years and up, gray cap
+	"218": true, // Pfizer-BioNTech, 5 to 11 years
+	"219": true, // Pfizer-BioNTech, 2 to 4 years
+	"221": true, // Moderna, 50 mcg
+}
+
+// maxPages stops us following next links forever if the VA misbehaves
+const maxPages = 20
+
 type ImmunizationResource struct {
 	ResourceType string `json:"resourceType"`
 	ID           string `json:"id"`
 	Status       string `json:"status"`
 	VaccineCode  struct {
 		Coding []Code `json:"coding"`
+		Text   string `json:"text"`
 	} `json:"vaccineCode"`
-	Text    string `json:"text"`
 	Patient struct {
 		Reference string `json:"reference"`
 		Display   string `json:"display"`
 	}
-	Occurence string `json:"occurrenceString"`
-	Reaction  []struct {
+	OccurrenceDateTime string `json:"occurrenceDateTime"`
+	LotNumber          string `json:"lotNumber"`
+	Location           struct {
+		Reference string `json:"reference"`
+		Display   string `json:"display"`
+	} `json:"location"`
+	Reaction []struct {
 		Detail struct {
 			Display string `json:"display"`
 		} `json:"detail"`
@@ -219,6 +311,16 @@ type ImmunizationResponse struct {
 	} `json:"entry"`
 }
 
+// Next returns the url of the next page of results, if there is one
+func (res ImmunizationResponse) Next() string {
+	for _, link := range res.Links {
+		if link.Relation == "next" {
+			return link.Url
+		}
+	}
+	return ""
+}
+
 type Vaccination struct {
 	Date     time.Time
 	Code     string
@@ -227,23 +329,221 @@ type Vaccination struct {
 	Lot      string
 }
 
-// todo return some sort of more useful vaccination struct. returning the immunizationresponse for now just to test things out
-func (c Client) GetVaccinations(tok, patientID string) ([]Vaccination, error) {
+// parseDate parses a FHIR dateTime, which the VA gives with a time and zone,
+// or a plain date
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if tm, err := time.Parse(layout, s); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse date %q", s)
+}
+
+// findVaxes picks the completed covid vaccinations out of a page of
+// immunizations. Doses entered in error or not given have another status.
+func findVaxes(res ImmunizationResponse) ([]Vaccination, error) {
+	var vaxes []Vaccination
+	for _, entry := range res.Entries {
+		imm := entry.Resource
+		if imm.ResourceType != "Immunization" || imm.Status != "completed" {
+			continue
+		}
+		for _, code := range imm.VaccineCode.Coding {
+			if code.System != cvxSystem || !covidCVX[code.Code] {
+				continue
+			}
+			date, err := parseDate(imm.OccurrenceDateTime)
+			if err != nil {
+				return nil, fmt.Errorf("immunization %s: %w", imm.ID, err)
+			}
+			display := code.Display
+			if display == "" {
+				display = imm.VaccineCode.Text
+			}
+			vaxes = append(vaxes, Vaccination{
+				Date:     date,
+				Code:     code.Code,
+				Display:  display,
+				Location: imm.Location.Display,
+				Lot:      imm.LotNumber,
+			})
+			break
+		}
+	}
+	return vaxes, nil
+}
+
+// GetVaccinations returns the patient's covid vaccinations, following the
+// search results through every page
+func (c *Client) GetVaccinations(tok, patientID string) ([]Vaccination, error) {
 	if patientID == "" {
 		return nil, fmt.Errorf("invalid patient id")
 	}
-	var res ImmunizationResponse
-	// TODO add paging
-	err := get(fmt.Sprintf("%s/Immunization?patient=%s", c.FhirURL, patientID), tok, &res)
-	if err != nil {
-		return nil, err
-	}
 
-	// TODO search through the vaccination response for a covid vaccination
 	var vaxes []Vaccination
+	next := fmt.Sprintf("%s/Immunization?patient=%s", c.FhirURL, url.QueryEscape(patientID))
+	for page := 0; next != ""; page++ {
+		if page == maxPages {
+			return nil, fmt.Errorf("the VA returned more than %d pages of immunizations", maxPages)
+		}
+		var res ImmunizationResponse
+		err := c.get(next, tok, &res)
+		if err != nil {
+			return nil, err
+		}
+		found, err := findVaxes(res)
+		if err != nil {
+			return nil, err
+		}
+		vaxes = append(vaxes, found...)
+		next = res.Next()
+	}
 	return vaxes, nil
 }
 
+const loincSystem = "http://loinc.org"
+
+type ObservationResource struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Code         struct {
+		Coding []Code `json:"coding"`
+		Text   string `json:"text"`
+	} `json:"code"`
+	EffectiveDateTime    string `json:"effectiveDateTime"`
+	ValueCodeableConcept struct {
+		Coding []Code `json:"coding"`
+		Text   string `json:"text"`
+	} `json:"valueCodeableConcept"`
+	ValueString    string `json:"valueString"`
+	Interpretation []struct {
+		Coding []Code `json:"coding"`
+	} `json:"interpretation"`
+	Performer []struct {
+		Reference string `json:"reference"`
+		Display   string `json:"display"`
+	} `json:"performer"`
+}
+
+type ObservationResponse struct {
+	Links []struct {
+		Relation string `json:"relation"`
+		Url      string `json:"url"`
+	} `json:"link"`
+	Entries []struct {
+		FullURL  string              `json:"fullUrl"`
+		Resource ObservationResource `json:"resource"`
+	} `json:"entry"`
+}
+
+// Next returns the url of the next page of results, if there is one
+func (res ObservationResponse) Next() string {
+	for _, link := range res.Links {
+		if link.Relation == "next" {
+			return link.Url
+		}
+	}
+	return ""
+}
+
+// LabResult is a covid lab test. Value and Interpretation are the codes the lab reported the
+// result with, and ValueText its text, if there's no code.
+type LabResult struct {
+	Date           time.Time
+	Code           string
+	Display        string
+	Value          string
+	ValueText      string
+	Interpretation string
+	Performer      string
+}
+
+// findLabs picks the final lab results isTest knows the LOINC codes of out of
+// a page of observations. Preliminary and cancelled results have another
+// status. Other labs are skipped before their dates are parsed, so a bad one
+// can't cost the patient their covid tests.
+func findLabs(res ObservationResponse, isTest func(code string) bool) ([]LabResult, error) {
+	var labs []LabResult
+	for _, entry := range res.Entries {
+		obs := entry.Resource
+		if obs.ResourceType != "Observation" {
+			continue
+		}
+		switch obs.Status {
+		case "final", "amended", "corrected":
+		default:
+			continue
+		}
+		for _, code := range obs.Code.Coding {
+			if code.System != loincSystem || isTest == nil || !isTest(code.Code) {
+				continue
+			}
+			date, err := parseDate(obs.EffectiveDateTime)
+			if err != nil {
+				return nil, fmt.Errorf("observation %s: %w", obs.ID, err)
+			}
+			lab := LabResult{
+				Date:      date,
+				Code:      code.Code,
+				Display:   code.Display,
+				ValueText: obs.ValueCodeableConcept.Text,
+			}
+			if lab.Display == "" {
+				lab.Display = obs.Code.Text
+			}
+			if len(obs.ValueCodeableConcept.Coding) > 0 {
+				lab.Value = obs.ValueCodeableConcept.Coding[0].Code
+				if lab.ValueText == "" {
+					lab.ValueText = obs.ValueCodeableConcept.Coding[0].Display
+				}
+			}
+			if lab.ValueText == "" {
+				lab.ValueText = obs.ValueString
+			}
+			if len(obs.Interpretation) > 0 && len(obs.Interpretation[0].Coding) > 0 {
+				lab.Interpretation = obs.Interpretation[0].Coding[0].Code
+			}
+			if len(obs.Performer) > 0 {
+				lab.Performer = obs.Performer[0].Display
+			}
+			labs = append(labs, lab)
+			break
+		}
+	}
+	return labs, nil
+}
+
+// GetLabResults returns the patient's covid lab results, following the search
+// results through every page. The VA returns every lab result the veteran has
+// had; isTest says which LOINC codes are covid tests.
+func (c *Client) GetLabResults(tok, patientID string, isTest func(code string) bool) ([]LabResult, error) {
+	if patientID == "" {
+		return nil, fmt.Errorf("invalid patient id")
+	}
+
+	var labs []LabResult
+	next := fmt.Sprintf("%s/Observation?patient=%s&category=laboratory", c.FhirURL, url.QueryEscape(patientID))
+	for page := 0; next != ""; page++ {
+		if page == maxPages {
+			return nil, fmt.Errorf("the VA returned more than %d pages of lab results", maxPages)
+		}
+		var res ObservationResponse
+		err := c.get(next, tok, &res)
+		if err != nil {
+			return nil, err
+		}
+		found, err := findLabs(res, isTest)
+		if err != nil {
+			return nil, err
+		}
+		labs = append(labs, found...)
+		next = res.Next()
+	}
+	return labs, nil
+}
+
 type PatientResponse struct {
 	Links []struct {
 		Relation string `json:"relation"`
@@ -255,6 +555,7 @@ type PatientResponse struct {
 		Family string   `json:"family"`
 		Given  []string `json:"given"`
 	} `json:"name"`
+	Gender    string       `json:"gender"`
 	BirthDate YearMonthDay `json:"birthDate"`
 }
 
@@ -274,22 +575,31 @@ func (j *YearMonthDay) UnmarshalJSON(b []byte) error {
 }
 
 type Patient struct {
-	Name      string
-	BirthDate YearMonthDay
+	Name       string
+	GivenName  string
+	FamilyName string
+	Gender     string
+	BirthDate  YearMonthDay
 }
 
-func (c Client) GetPatient(tok, patientID string) (*Patient, error) {
+func (c *Client) GetPatient(tok, patientID string) (*Patient, error) {
 	if patientID == "" {
 		return nil, fmt.Errorf("invalid patient id")
 	}
 	var res PatientResponse
-	err := get(fmt.Sprintf("%s/Patient/%s", c.FhirURL, patientID), tok, &res)
+	err := c.get(fmt.Sprintf("%s/Patient/%s", c.FhirURL, patientID), tok, &res)
 	if err != nil {
 		return nil, err
 	}
+	if len(res.Names) == 0 {
+		return nil, fmt.Errorf("patient %s has no name", patientID)
+	}
 	pat := &Patient{
-		Name:      res.Names[0].Text,
-		BirthDate: res.BirthDate,
+		Name:       res.Names[0].Text,
+		GivenName:  strings.Join(res.Names[0].Given, " "),
+		FamilyName: res.Names[0].Family,
+		Gender:     res.Gender,
+		BirthDate:  res.BirthDate,
 	}
 	return pat, nil
 }
@@ -15,8 +15,12 @@ package lighthouse
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/lighthouse/vatest"
 )
 
 func TestParsePatient(t *testing.T) {
@@ -39,4 +43,152 @@ func TestParsePatient(t *testing.T) {
 	if pat.Names[0].Text != "Mr. Porfirio146 Schmeler639" {
 		t.Errorf("unexpected patient %#v", pat.Names)
 	}
+
+	if pat.Gender != "male" || pat.BirthDate.Format("2006-01-02") != "1916-06-15" {
+		t.Errorf("unexpected gender or birth date %#v", pat)
+	}
+}
+
+// loginTo logs in to a fake VA as scenario, returning a client for it and the
+// token it was issued
+func loginTo(t *testing.T, va *vatest.Server, scenario string) (*Client, *FullToken) {
+	t.Helper()
+	c := &Client{
+		ClientID:     "covidrecord",
+		ClientSecret: "shh",
+		URL:          va.URL,
+		FhirURL:      va.FhirURL(),
+		CallbackURL:  "https://localhost.dev:6655/callback",
+	}
+	authURL, err := c.AuthURL("openid profile launch/patient patient/Immunization.read", "the-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := vatest.Login(authURL, scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := c.GetFullToken(back.Query().Get("code"), back.Query().Get("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, tok
+}
+
+func newFakeVAServer(t *testing.T, scenarios ...vatest.Scenario) *vatest.Server {
+	t.Helper()
+	va := vatest.NewServer("covidrecord", "shh", scenarios...)
+	t.Cleanup(va.Close)
+	return va
+}
+
+func TestFetchRecord(t *testing.T) {
+	va := newFakeVAServer(t)
+	c, tok := loginTo(t, va, "moderna-complete")
+	if tok.PatientID != "1013062086" || tok.Claims.Subject != "00u2fqgvbyT23TZNm2p7" {
+		t.Errorf("unexpected token %#v", tok)
+	}
+
+	pat, err := c.GetPatient(tok.AccessToken, tok.PatientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pat.Name != "Tamara Ellis" || pat.BirthDate.Format("2006-01-02") != "1967-06-19" {
+		t.Errorf("unexpected patient %#v", pat)
+	}
+	if _, err := c.GetPatient(tok.AccessToken, "1012845331"); err == nil {
+		t.Errorf("expected someone else's patient record to be refused")
+	}
+
+	// the doses are spread over three pages, along with a dose entered in
+	// error and other vaccines
+	vaxes, err := c.GetVaccinations(tok.AccessToken, tok.PatientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vaxes) != 2 {
+		t.Fatalf("expected two covid vaccinations, got %#v", vaxes)
+	}
+	if vaxes[0].Code != "207" || vaxes[0].Lot != "037K20A" || vaxes[0].Location != "Cheyenne VA Medical Center" {
+		t.Errorf("unexpected first dose %#v", vaxes[0])
+	}
+	if vaxes[1].Date.Format("2006-01-02") != "2021-02-03" {
+		t.Errorf("unexpected second dose %#v", vaxes[1])
+	}
+
+	// the covid tests come back among other labs, and one is still
+	// preliminary
+	labs, err := c.GetLabResults(tok.AccessToken, tok.PatientID, covidTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labs) != 2 {
+		t.Fatalf("expected two final covid tests, got %#v", labs)
+	}
+	if labs[0].Code != "94500-6" || labs[0].Value != "260373001" || labs[0].Performer != "Cheyenne VA Medical Center Laboratory" {
+		t.Errorf("unexpected first test %#v", labs[0])
+	}
+	if labs[1].Date.Format("2006-01-02") != "2021-09-20" || labs[1].ValueText != "Not detected" {
+		t.Errorf("unexpected second test %#v", labs[1])
+	}
+}
+
+// covidTest stands in for record.IsTestCode, which this package can't import
+func covidTest(code string) bool {
+	return code == "94500-6" || code == "94309-2"
+}
+
+func TestFindLabsSkipsOtherLabs(t *testing.T) {
+	var res ObservationResponse
+	err := json.Unmarshal([]byte(`{"entry": [
+		{"resource": {"resourceType": "Observation", "id": "a1c", "status": "final",
+			"code": {"coding": [{"system": "http://loinc.org", "code": "4548-4"}]},
+			"effectiveDateTime": "sometime in 2021"}},
+		{"resource": {"resourceType": "Observation", "id": "pcr", "status": "final",
+			"code": {"coding": [{"system": "http://loinc.org", "code": "94500-6"}]},
+			"effectiveDateTime": "2021-09-20T10:00:00Z"}}
+	]}`), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a lab we don't want with a date we can't parse mustn't cost the
+	// patient their covid tests
+	labs, err := findLabs(res, covidTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labs) != 1 || labs[0].Code != "94500-6" {
+		t.Errorf("expected just the covid test, got %#v", labs)
+	}
+}
+
+func TestFetchRecordFailures(t *testing.T) {
+	slow := vatest.MustScenario("slow-fhir")
+	slow.Delays["immunization"] = vatest.Duration{Duration: time.Second}
+	va := newFakeVAServer(t, vatest.MustScenario("token-expired"), vatest.MustScenario("fhir-outage"), slow)
+
+	c, tok := loginTo(t, va, "token-expired")
+	_, err := c.GetPatient(tok.AccessToken, tok.PatientID)
+	if !errors.Is(err, ErrTokenRejected) {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+
+	c, tok = loginTo(t, va, "fhir-outage")
+	if _, err := c.GetPatient(tok.AccessToken, tok.PatientID); err != nil {
+		t.Errorf("expected the patient to load, got %s", err)
+	}
+	if _, err := c.GetVaccinations(tok.AccessToken, tok.PatientID); err == nil {
+		t.Errorf("expected an error when the immunization api fails")
+	}
+
+	c, tok = loginTo(t, va, "slow-fhir")
+	c.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := c.GetVaccinations(tok.AccessToken, tok.PatientID); err == nil {
+		t.Errorf("expected a slow response to time out")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected to give up after the timeout, took %s", time.Since(start))
+	}
 }
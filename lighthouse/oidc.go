@@ -0,0 +1,282 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lighthouse
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discovery is the part of the OpenID provider configuration we use
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+}
+
+// how long we keep the signing keys before fetching them again, and how often
+// we'll refetch them early when a token is signed with a key we don't have
+const (
+	jwksTTL        = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// clockSkew is how far our clock and the VA's can disagree
+const clockSkew = time.Minute
+
+// timeNow is replaced in the tests
+var timeNow = time.Now
+
+// oidc caches the discovery document and signing keys
+type oidc struct {
+	mu        sync.Mutex
+	discovery *Discovery
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+}
+
+// Discover fetches the OpenID configuration from VA Lighthouse. It's fetched
+// once and remembered; a failure isn't, so it's tried again next time.
+func (c *Client) Discover() (*Discovery, error) {
+	c.oidc.mu.Lock()
+	defer c.oidc.mu.Unlock()
+	if c.oidc.discovery != nil {
+		return c.oidc.discovery, nil
+	}
+
+	var d Discovery
+	err := c.get(fmt.Sprintf("%s/oauth2/.well-known/openid-configuration", c.URL), "", &d)
+	if err != nil {
+		return nil, fmt.Errorf("discovering the VA's openid configuration: %w", err)
+	}
+	if d.Issuer == "" || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("the VA's openid configuration is missing its issuer or endpoints")
+	}
+	c.oidc.discovery = &d
+	return c.oidc.discovery, nil
+}
+
+// jwk is an RSA key in a JSON Web Key Set
+// https://tools.ietf.org/html/rfc7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("bad exponent")
+	}
+	var exp int
+	for _, b := range e {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
+
+// signingKey returns the key with id kid, fetching the key set if we don't
+// have it, or if it might have been rotated
+func (c *Client) signingKey(jwksURI, kid string) (*rsa.PublicKey, error) {
+	c.oidc.mu.Lock()
+	defer c.oidc.mu.Unlock()
+
+	now := timeNow()
+	key, ok := c.oidc.keys[kid]
+	stale := now.Sub(c.oidc.fetched) > jwksTTL
+	if ok && !stale {
+		return key, nil
+	}
+	// don't let tokens with made up key ids make us hammer the VA
+	if !ok && !stale && now.Sub(c.oidc.fetched) < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := c.get(jwksURI, "", &set)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the VA's signing keys: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := k.rsaKey()
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+	c.oidc.keys = keys
+	c.oidc.fetched = now
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// audience is a JWT aud claim, which may be a string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(b, &many)
+	*a = many
+	return err
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IDClaims are the claims in a verified ID token
+type IDClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	Expires         int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	AuthorizedParty string   `json:"azp"`
+	// FhirUser is a reference to the user's FHIR resource, like
+	// "Patient/1558538470". It's only there when the fhirUser scope is
+	// granted, which we always request.
+	FhirUser string `json:"fhirUser"`
+}
+
+// PatientID returns the id of the patient the token was issued to, or "" if
+// it doesn't say
+func (c IDClaims) PatientID() string {
+	i := strings.LastIndex(c.FhirUser, "Patient/")
+	if i < 0 {
+		return ""
+	}
+	return c.FhirUser[i+len("Patient/"):]
+}
+
+// nonceFor derives the nonce we send with a login from its state. The state
+// is bound to the user's browser by a cookie and only accepted once, so the
+// nonce is too, without us having to remember another value.
+func nonceFor(state string) string {
+	sum := sha256.Sum256([]byte("nonce:" + state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyIDToken checks the ID token's signature against the VA's published
+// keys, and that it was issued by the VA, to us, for this login, and hasn't
+// expired
+func (c *Client) VerifyIDToken(token, nonce string) (*IDClaims, error) {
+	d, err := c.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	// the algorithm is the VA's choice, not the token's; in particular,
+	// never accept "none"
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("id token signed with unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := c.signingKey(d.JWKSURI, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("id token signature doesn't verify")
+	}
+
+	var claims IDClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+
+	now := timeNow()
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("id token issued by %q, expected %q", claims.Issuer, d.Issuer)
+	case !claims.Audience.contains(c.ClientID):
+		return nil, fmt.Errorf("id token wasn't issued to us")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != c.ClientID:
+		return nil, fmt.Errorf("id token wasn't issued to us")
+	case claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("id token has expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("id token was issued in the future")
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("id token is for a different login")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("id token has no subject")
+	}
+	return &claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
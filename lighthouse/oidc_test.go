@@ -0,0 +1,302 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lighthouse
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVA serves an openid configuration, key set and token endpoint
+type fakeVA struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	kid       string
+	jwksFetch int
+	// idToken is what the token endpoint returns as the id token
+	idToken string
+	// revoked lists the hint and token of each revocation request
+	revoked []string
+}
+
+func newFakeVA(t *testing.T) *fakeVA {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	va := &fakeVA{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"issuer": "%[1]s/oauth2",
+			"authorization_endpoint": "%[1]s/oauth2/authorization",
+			"token_endpoint": "%[1]s/oauth2/token",
+			"jwks_uri": "%[1]s/oauth2/keys",
+			"revocation_endpoint": "%[1]s/oauth2/revoke"
+		}`, va.URL)
+	})
+	mux.HandleFunc("/oauth2/keys", func(w http.ResponseWriter, r *http.Request) {
+		va.jwksFetch++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": va.kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(va.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(va.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token": "tok", "patient": "1558538470", "id_token": %q}`, va.idToken)
+	})
+	mux.HandleFunc("/oauth2/revoke", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "covidrecord" || secret != "shh" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		va.revoked = append(va.revoked, r.PostFormValue("token_type_hint")+" "+r.PostFormValue("token"))
+	})
+	va.Server = httptest.NewServer(mux)
+	t.Cleanup(va.Close)
+	return va
+}
+
+func (va *fakeVA) client() *Client {
+	return &Client{ClientID: "covidrecord", ClientSecret: "shh", URL: va.URL, CallbackURL: "https://localhost.dev:6655/callback"}
+}
+
+// claims returns a valid set of claims for a login with the given state
+func (va *fakeVA) claims(state string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":      va.URL + "/oauth2",
+		"sub":      "00u2p9far4ihDAEX82p7",
+		"aud":      "covidrecord",
+		"exp":      timeNow().Add(time.Hour).Unix(),
+		"iat":      timeNow().Unix(),
+		"nonce":    nonceFor(state),
+		"fhirUser": "https://sandbox-api.va.gov/services/fhir/v0/r4/Patient/1558538470",
+	}
+}
+
+func (va *fakeVA) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	seg := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(map[string]string{"alg": alg, "kid": va.kid}) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, va.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestAuthURLDiscovery(t *testing.T) {
+	va := newFakeVA(t)
+	authURL, err := va.client().AuthURL("openid launch/patient", "the-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/oauth2/authorization" || u.Query().Get("nonce") != nonceFor("the-state") {
+		t.Errorf("expected the discovered endpoint with a nonce, got %s", authURL)
+	}
+}
+
+func TestGetFullTokenVerifiesIDToken(t *testing.T) {
+	va := newFakeVA(t)
+	c := va.client()
+
+	va.idToken = va.sign(t, "RS256", va.claims("the-state"))
+	tok, err := c.GetFullToken("code", "the-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Claims.Subject != "00u2p9far4ihDAEX82p7" || tok.PatientID != "1558538470" {
+		t.Errorf("unexpected token %#v", tok)
+	}
+
+	// a token replayed from another login fails
+	if _, err := c.GetFullToken("code", "another-state"); err == nil {
+		t.Errorf("expected an id token for another login to be refused")
+	}
+
+	va.idToken = ""
+	if _, err := c.GetFullToken("code", "the-state"); err == nil {
+		t.Errorf("expected a missing id token to be refused")
+	}
+}
+
+func TestGetFullTokenPatientMustMatch(t *testing.T) {
+	va := newFakeVA(t)
+	c := va.client()
+
+	// the token response says 1558538470, which isn't signed, so the id
+	// token has to agree
+	claims := va.claims("the-state")
+	claims["fhirUser"] = "Patient/42"
+	va.idToken = va.sign(t, "RS256", claims)
+	if _, err := c.GetFullToken("code", "the-state"); err == nil || !strings.Contains(err.Error(), "different patients") {
+		t.Errorf("expected an id token for a different patient to be refused, got %v", err)
+	}
+
+	// and can't stay quiet about it
+	delete(claims, "fhirUser")
+	va.idToken = va.sign(t, "RS256", claims)
+	if _, err := c.GetFullToken("code", "the-state"); err == nil || !strings.Contains(err.Error(), "doesn't name the patient") {
+		t.Errorf("expected an id token without fhirUser to be refused, got %v", err)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	va := newFakeVA(t)
+	c := va.client()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  func() string
+		expect string
+	}{
+		{"valid", func() string { return va.sign(t, "RS256", va.claims("s")) }, ""},
+		{"wrong issuer", func() string {
+			claims := va.claims("s")
+			claims["iss"] = "https://evil.example"
+			return va.sign(t, "RS256", claims)
+		}, "issued by"},
+		{"wrong audience", func() string {
+			claims := va.claims("s")
+			claims["aud"] = []string{"someone-else"}
+			return va.sign(t, "RS256", claims)
+		}, "issued to us"},
+		{"expired", func() string {
+			claims := va.claims("s")
+			claims["exp"] = timeNow().Add(-time.Hour).Unix()
+			return va.sign(t, "RS256", claims)
+		}, "expired"},
+		{"wrong nonce", func() string {
+			claims := va.claims("s")
+			claims["nonce"] = "guess"
+			return va.sign(t, "RS256", claims)
+		}, "different login"},
+		{"unsigned", func() string {
+			parts := strings.Split(va.sign(t, "RS256", va.claims("s")), ".")
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+			return header + "." + parts[1] + "."
+		}, "unsupported algorithm"},
+		{"signed by someone else", func() string {
+			real := va.key
+			va.key = other
+			defer func() { va.key = real }()
+			return va.sign(t, "RS256", va.claims("s"))
+		}, "doesn't verify"},
+		{"tampered", func() string {
+			parts := strings.Split(va.sign(t, "RS256", va.claims("s")), ".")
+			claims := va.claims("s")
+			claims["sub"] = "someone-else"
+			b, _ := json.Marshal(claims)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+		}, "doesn't verify"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.VerifyIDToken(tt.token(), nonceFor("s"))
+			if tt.expect == "" && err != nil {
+				t.Errorf("expected a valid token, got %s", err)
+			}
+			if tt.expect != "" && (err == nil || !strings.Contains(err.Error(), tt.expect)) {
+				t.Errorf("expected an error containing %q, got %v", tt.expect, err)
+			}
+		})
+	}
+
+	if va.jwksFetch != 1 {
+		t.Errorf("expected the key set to be fetched once and cached, got %d fetches", va.jwksFetch)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	va := newFakeVA(t)
+	c := va.client()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if _, err := c.VerifyIDToken(va.sign(t, "RS256", va.claims("s")), nonceFor("s")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the VA rotates its key. Right away, we don't refetch for an unknown key
+	va.kid = "key-2"
+	token := va.sign(t, "RS256", va.claims("s"))
+	if _, err := c.VerifyIDToken(token, nonceFor("s")); err == nil {
+		t.Errorf("expected an unknown key not to be refetched immediately")
+	}
+
+	// but a little later we do
+	now = now.Add(2 * jwksMinRefresh)
+	if _, err := c.VerifyIDToken(token, nonceFor("s")); err != nil {
+		t.Errorf("expected the rotated key to be fetched, got %s", err)
+	}
+	if va.jwksFetch != 2 {
+		t.Errorf("expected two key set fetches, got %d", va.jwksFetch)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	va := newFakeVA(t)
+	c := va.client()
+
+	if err := c.RevokeToken("refresh-tok", "refresh_token"); err != nil {
+		t.Fatal(err)
+	}
+	if len(va.revoked) != 1 || va.revoked[0] != "refresh_token refresh-tok" {
+		t.Errorf("unexpected revocations %v", va.revoked)
+	}
+
+	c.ClientSecret = "wrong"
+	if err := c.RevokeToken("tok", "access_token"); err == nil {
+		t.Errorf("expected a failed revocation to return an error")
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lighthouse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RevokeToken revokes an access or refresh token at the revocation endpoint
+// from the VA's openid configuration. hint says which kind of token it is,
+// "access_token" or "refresh_token".
+// https://tools.ietf.org/html/rfc7009
+func (c *Client) RevokeToken(token, hint string) error {
+	d, err := c.Discover()
+	if err != nil {
+		return err
+	}
+	if d.RevocationEndpoint == "" {
+		return fmt.Errorf("the VA doesn't publish a revocation endpoint")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	params := url.Values{}
+	params.Set("token", token)
+	params.Set("token_type_hint", hint)
+
+	log.Printf("revoking a %s at %s", hint, d.RevocationEndpoint)
+	req, err := http.NewRequestWithContext(ctx, "POST", d.RevocationEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.ClientID, c.ClientSecret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// the server responds 200 whether or not the token was valid, so that a
+	// token that already expired counts as revoked
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Expected 200, got %v", resp.Status)
+	}
+	return nil
+}
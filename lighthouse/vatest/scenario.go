@@ -0,0 +1,263 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package vatest
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed scenarios/*.json
+var scenarioFiles embed.FS
+
+// Scenario is a veteran the fake VA can log in as: who they are, the
+// immunizations the VA has for them, and how the VA misbehaves
+type Scenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Sub is the user's VA login id, the subject of their ID token
+	Sub string `json:"sub"`
+	// Patient is the FHIR R4 Patient resource served at Patient/{id}
+	Patient json.RawMessage `json:"patient"`
+	// Immunizations are served as Immunization resources
+	Immunizations []Immunization `json:"immunizations"`
+	// LabResults are served as laboratory Observation resources
+	LabResults []LabResult `json:"lab_results"`
+	// PageSize is how many immunizations or lab results go in a page of
+	// results; 10 if it's unset
+	PageSize int `json:"page_size"`
+	// ExpiredToken makes the access token the VA issues expire straight
+	// away, so the FHIR API refuses it
+	ExpiredToken bool `json:"expired_token"`
+	// Failures makes an endpoint fail with the given HTTP status, and Delays
+	// makes it slow to respond. The keys are "token", "patient",
+	// "immunization" and "observation".
+	Failures map[string]int      `json:"failures"`
+	Delays   map[string]Duration `json:"delays"`
+}
+
+// Immunization is a vaccine dose in the VA's records
+type Immunization struct {
+	// Date is when it was given, like 2021-01-04
+	Date    string `json:"date"`
+	CVX     string `json:"cvx"`
+	Display string `json:"display"`
+	Lot     string `json:"lot"`
+	// Location is the name of the facility that gave it
+	Location string `json:"location"`
+	// Status defaults to completed; entered-in-error and not-done doses
+	// shouldn't be counted
+	Status string `json:"status"`
+}
+
+// LabResult is a lab test in the VA's records
+type LabResult struct {
+	// Date is when the specimen was collected, like 2021-01-04
+	Date    string `json:"date"`
+	LOINC   string `json:"loinc"`
+	Display string `json:"display"`
+	// Result is the SNOMED code for the result, like 260415000 for not
+	// detected, and ResultDisplay its name
+	Result        string `json:"result"`
+	ResultDisplay string `json:"result_display"`
+	// Performer is the name of the lab
+	Performer string `json:"performer"`
+	// Status defaults to final; preliminary and cancelled results shouldn't
+	// be counted
+	Status string `json:"status"`
+}
+
+// Duration is a time.Duration written like "3s" in a scenario file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// Scenarios returns the scenarios that ship with the package, sorted by name
+func Scenarios() ([]Scenario, error) {
+	names, err := scenarioFiles.ReadDir("scenarios")
+	if err != nil {
+		return nil, err
+	}
+	var scenarios []Scenario
+	for _, f := range names {
+		b, err := scenarioFiles.ReadFile(path.Join("scenarios", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var s Scenario
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", f.Name(), err)
+		}
+		if s.Name == "" || s.Sub == "" || s.PatientID() == "" {
+			return nil, fmt.Errorf("scenario %s needs a name, sub and patient id", f.Name())
+		}
+		scenarios = append(scenarios, s)
+	}
+	sort.Slice(scenarios, func(i, j int) bool { return scenarios[i].Name < scenarios[j].Name })
+	return scenarios, nil
+}
+
+// MustScenario returns the shipped scenario with the given name, and panics if
+// there isn't one
+func MustScenario(name string) Scenario {
+	scenarios, err := Scenarios()
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range scenarios {
+		if s.Name == name {
+			return s
+		}
+	}
+	panic(fmt.Sprintf("no va scenario %q", name))
+}
+
+// PatientID is the id of the scenario's Patient resource
+func (s Scenario) PatientID() string {
+	var pat struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(s.Patient, &pat)
+	return pat.ID
+}
+
+// PatientName is the patient's name, for listing the scenario
+func (s Scenario) PatientName() string {
+	var pat struct {
+		Name []struct {
+			Text   string   `json:"text"`
+			Given  []string `json:"given"`
+			Family string   `json:"family"`
+		} `json:"name"`
+	}
+	json.Unmarshal(s.Patient, &pat)
+	if len(pat.Name) == 0 {
+		return s.Name
+	}
+	if pat.Name[0].Text != "" {
+		return pat.Name[0].Text
+	}
+	return strings.Join(append(pat.Name[0].Given, pat.Name[0].Family), " ")
+}
+
+func (s Scenario) pageSize() int {
+	if s.PageSize <= 0 {
+		return 10
+	}
+	return s.PageSize
+}
+
+// immunization renders immunization i as a FHIR R4 Immunization
+func (s Scenario) immunization(base string, i int) map[string]interface{} {
+	imm := s.Immunizations[i]
+	status := imm.Status
+	if status == "" {
+		status = "completed"
+	}
+	res := map[string]interface{}{
+		"resourceType": "Immunization",
+		"id":           fmt.Sprintf("I2-%s-%d", s.PatientID(), i+1),
+		"status":       status,
+		"vaccineCode": map[string]interface{}{
+			"coding": []map[string]string{{
+				"system":  "http://hl7.org/fhir/sid/cvx",
+				"code":    imm.CVX,
+				"display": imm.Display,
+			}},
+			"text": imm.Display,
+		},
+		"patient": map[string]string{
+			"reference": fmt.Sprintf("%s/Patient/%s", base, s.PatientID()),
+			"display":   s.PatientName(),
+		},
+		"occurrenceDateTime": imm.Date + "T09:30:00Z",
+		"primarySource":      true,
+	}
+	if imm.Lot != "" {
+		res["lotNumber"] = imm.Lot
+	}
+	if imm.Location != "" {
+		res["location"] = map[string]string{
+			"reference": fmt.Sprintf("%s/Location/I2-LOC%d", base, i+1),
+			"display":   imm.Location,
+		}
+	}
+	return res
+}
+
+// observation renders lab result i as a FHIR R4 laboratory Observation
+func (s Scenario) observation(base string, i int) map[string]interface{} {
+	lab := s.LabResults[i]
+	status := lab.Status
+	if status == "" {
+		status = "final"
+	}
+	res := map[string]interface{}{
+		"resourceType": "Observation",
+		"id":           fmt.Sprintf("I2-%s-LAB%d", s.PatientID(), i+1),
+		"status":       status,
+		"category": []map[string]interface{}{{
+			"coding": []map[string]string{{
+				"system":  "http://terminology.hl7.org/CodeSystem/observation-category",
+				"code":    "laboratory",
+				"display": "Laboratory",
+			}},
+		}},
+		"code": map[string]interface{}{
+			"coding": []map[string]string{{
+				"system":  "http://loinc.org",
+				"code":    lab.LOINC,
+				"display": lab.Display,
+			}},
+			"text": lab.Display,
+		},
+		"subject": map[string]string{
+			"reference": fmt.Sprintf("%s/Patient/%s", base, s.PatientID()),
+			"display":   s.PatientName(),
+		},
+		"effectiveDateTime": lab.Date + "T14:10:00Z",
+	}
+	if lab.Result != "" {
+		res["valueCodeableConcept"] = map[string]interface{}{
+			"coding": []map[string]string{{
+				"system":  "http://snomed.info/sct",
+				"code":    lab.Result,
+				"display": lab.ResultDisplay,
+			}},
+			"text": lab.ResultDisplay,
+		}
+	}
+	if lab.Performer != "" {
+		res["performer"] = []map[string]string{{
+			"reference": fmt.Sprintf("%s/Organization/I2-ORG%d", base, i+1),
+			"display":   lab.Performer,
+		}}
+	}
+	return res
+}
@@ -0,0 +1,500 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vatest is a fake VA Lighthouse, for testing the app end to end
+// without the VA's sandbox. It implements OpenID Connect discovery, the
+// authorization code flow with signed ID tokens, revocation, and the FHIR
+// Patient and paged Immunization endpoints, serving the veterans described by
+// its scenarios.
+package vatest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FhirPath is where the fake serves its FHIR API, like the VA does
+const FhirPath = "/services/fhir/v0/r4"
+
+// Server is a fake VA Lighthouse, listening on a local port
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	scenarios []Scenario
+	// codes are the authorization codes we've handed out and not yet
+	// exchanged
+	codes  map[string]grant
+	tokens map[string]token
+	// revoked lists the hint and token of each revocation
+	revoked []string
+}
+
+type grant struct {
+	scenario    string
+	redirectURI string
+	nonce       string
+}
+
+type token struct {
+	scenario string
+	expires  time.Time
+}
+
+// NewServer starts a fake VA serving the given scenarios, and accepting the
+// given client credentials. With no scenarios, it serves the ones that ship
+// with the package. Close it when you're done.
+func NewServer(clientID, clientSecret string, scenarios ...Scenario) *Server {
+	if len(scenarios) == 0 {
+		var err error
+		scenarios, err = Scenarios()
+		if err != nil {
+			panic(err)
+		}
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		scenarios:    scenarios,
+		codes:        map[string]grant{},
+		tokens:       map[string]token{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/oauth2/authorization", s.authorize)
+	mux.HandleFunc("/oauth2/token/", s.token)
+	mux.HandleFunc("/oauth2/keys", s.keys)
+	mux.HandleFunc("/oauth2/revoke", s.revoke)
+	mux.HandleFunc(FhirPath+"/Patient/", s.patient)
+	mux.HandleFunc(FhirPath+"/Immunization", s.immunizations)
+	mux.HandleFunc(FhirPath+"/Observation", s.observations)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// FhirURL is the base url of the fake's FHIR API
+func (s *Server) FhirURL() string {
+	return s.URL + FhirPath
+}
+
+// Revoked returns the hint and token of each revocation, in order, like
+// "refresh_token 1234"
+func (s *Server) Revoked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.revoked...)
+}
+
+func (s *Server) scenario(name string) (Scenario, bool) {
+	for _, sc := range s.scenarios {
+		if sc.Name == name {
+			return sc, true
+		}
+	}
+	return Scenario{}, false
+}
+
+// authenticated returns the scenario of the request's bearer token, or writes
+// the VA's error if the token is missing, unknown or expired
+func (s *Server) authenticated(w http.ResponseWriter, r *http.Request) (Scenario, bool) {
+	s.mu.Lock()
+	tok, ok := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !ok || time.Now().After(tok.expires) {
+		description := "The access token is invalid"
+		if ok {
+			description = "The access token expired"
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, description))
+		http.Error(w, `{"message": "Invalid token."}`, http.StatusUnauthorized)
+		return Scenario{}, false
+	}
+	return s.scenario(tok.scenario)
+}
+
+// misbehave waits out the scenario's delay for endpoint, and writes its
+// failure, if it has them. It returns true if the request has been dealt
+// with.
+func misbehave(w http.ResponseWriter, r *http.Request, sc Scenario, endpoint string) bool {
+	if d, ok := sc.Delays[endpoint]; ok {
+		select {
+		case <-time.After(d.Duration):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	status, ok := sc.Failures[endpoint]
+	if !ok {
+		return false
+	}
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 s.URL + "/oauth2",
+		"authorization_endpoint": s.URL + "/oauth2/authorization",
+		"token_endpoint":         s.URL + "/oauth2/token/",
+		"jwks_uri":               s.URL + "/oauth2/keys",
+		"revocation_endpoint":    s.URL + "/oauth2/revoke",
+	})
+}
+
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "vatest",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+var chooseTmpl = template.Must(template.New("choose").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Fake VA Lighthouse</title></head>
+<body>
+<h1>Fake VA Lighthouse</h1>
+<p>Log in as:</p>
+<ul>
+{{range .Scenarios}}<li><a href="{{$.Base}}&scenario={{.Name}}">{{.PatientName}}</a> &mdash; {{.Description}}</li>
+{{end}}</ul>
+<p><a href="{{.Base}}&scenario=deny">Don't share my records</a></p>
+</body>
+</html>
+`))
+
+// authorize is the login page. Given a scenario parameter, it logs in as that
+// scenario straight away, which is what the tests do; otherwise it lists the
+// scenarios to pick from. The scenario "deny" refuses to share records.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "unknown client or response type", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(" "+q.Get("scope")+" ", " openid ") || q.Get("nonce") == "" {
+		http.Error(w, "an openid login needs the openid scope and a nonce", http.StatusBadRequest)
+		return
+	}
+
+	name := q.Get("scenario")
+	if name == "" {
+		err := chooseTmpl.Execute(w, map[string]interface{}{
+			"Base":      r.URL.String(),
+			"Scenarios": s.scenarios,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	back := redirectURI.Query()
+	back.Set("state", q.Get("state"))
+	if name == "deny" {
+		back.Set("error", "access_denied")
+		back.Set("error_description", "The resource owner or authorization server denied the request.")
+	} else {
+		if _, ok := s.scenario(name); !ok {
+			http.Error(w, "unknown scenario", http.StatusNotFound)
+			return
+		}
+		code := randomToken()
+		s.mu.Lock()
+		s.codes[code] = grant{scenario: name, redirectURI: q.Get("redirect_uri"), nonce: q.Get("nonce")}
+		s.mu.Unlock()
+		back.Set("code", code)
+	}
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code for an access token and an ID token.
+// Codes can only be used once.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if r.Method != http.MethodPost || !ok || id != s.ClientID || secret != s.ClientSecret {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	code := r.PostFormValue("code")
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !ok || g.redirectURI != r.PostFormValue("redirect_uri") {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	sc, _ := s.scenario(g.scenario)
+	if misbehave(w, r, sc, "token") {
+		return
+	}
+
+	now := time.Now()
+	expiresIn := time.Hour
+	if sc.ExpiredToken {
+		expiresIn = 0
+	}
+	access := randomToken()
+	s.mu.Lock()
+	s.tokens[access] = token{scenario: sc.Name, expires: now.Add(expiresIn)}
+	s.mu.Unlock()
+
+	idToken, err := s.sign(map[string]interface{}{
+		"iss":      s.URL + "/oauth2",
+		"sub":      sc.Sub,
+		"aud":      s.ClientID,
+		"iat":      now.Unix(),
+		"exp":      now.Add(time.Hour).Unix(),
+		"nonce":    g.nonce,
+		"fhirUser": fmt.Sprintf("%s/Patient/%s", s.FhirURL(), sc.PatientID()),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token":  access,
+		"expires_in":    int(expiresIn.Seconds()),
+		"token_type":    "Bearer",
+		"scope":         r.PostFormValue("scope"),
+		"refresh_token": randomToken(),
+		"patient":       sc.PatientID(),
+		"state":         r.PostFormValue("state"),
+		"id_token":      idToken,
+	})
+}
+
+// sign makes an RS256 JWT of claims with the server's key
+func (s *Server) sign(claims map[string]interface{}) (string, error) {
+	seg := func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b), err
+	}
+	header, err := seg(map[string]string{"alg": "RS256", "kid": "vatest", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := seg(claims)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(header + "." + payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// revoke revokes an access or refresh token. Like the VA, it succeeds whether
+// or not it knows the token.
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != s.ClientID || secret != s.ClientSecret {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	tok := r.PostFormValue("token")
+	s.mu.Lock()
+	delete(s.tokens, tok)
+	s.revoked = append(s.revoked, r.PostFormValue("token_type_hint")+" "+tok)
+	s.mu.Unlock()
+}
+
+// patient serves the token's own patient, and nobody else
+func (s *Server) patient(w http.ResponseWriter, r *http.Request) {
+	sc, ok := s.authenticated(w, r)
+	if !ok {
+		return
+	}
+	if strings.TrimPrefix(r.URL.Path, FhirPath+"/Patient/") != sc.PatientID() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if misbehave(w, r, sc, "patient") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.Write(sc.Patient)
+}
+
+// immunizations serves the patient's immunizations as a searchset bundle, a
+// page at a time. Like the VA, it pages with page and _count.
+func (s *Server) immunizations(w http.ResponseWriter, r *http.Request) {
+	s.search(w, r, "Immunization", "immunization", func(sc Scenario) int {
+		return len(sc.Immunizations)
+	}, Scenario.immunization)
+}
+
+// observations serves the patient's lab results like immunizations. Only
+// the laboratory category is supported.
+func (s *Server) observations(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("category") != "laboratory" {
+		http.Error(w, "only category=laboratory is supported", http.StatusBadRequest)
+		return
+	}
+	s.search(w, r, "Observation", "observation", func(sc Scenario) int {
+		return len(sc.LabResults)
+	}, Scenario.observation)
+}
+
+// search serves a page of the scenario's resources of resourceType as a
+// searchset bundle. count is how many resources the scenario has, and
+// resource renders the ith, with references relative to the fhir base url.
+func (s *Server) search(w http.ResponseWriter, r *http.Request, resourceType, endpoint string, count func(Scenario) int, resource func(sc Scenario, base string, i int) map[string]interface{}) {
+	sc, ok := s.authenticated(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("patient") != sc.PatientID() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if misbehave(w, r, sc, endpoint) {
+		return
+	}
+
+	total := count(sc)
+	size := sc.pageSize()
+	if n, err := strconv.Atoi(q.Get("_count")); err == nil && n > 0 {
+		size = n
+	}
+	page := 1
+	if n, err := strconv.Atoi(q.Get("page")); err == nil && n > 0 {
+		page = n
+	}
+	start := (page - 1) * size
+	if start > total {
+		start = total
+	}
+	end := start + size
+	if end > total {
+		end = total
+	}
+	last := (total + size - 1) / size
+	if last == 0 {
+		last = 1
+	}
+
+	pageURL := func(n int) string {
+		v := url.Values{}
+		for key := range q {
+			v.Set(key, q.Get(key))
+		}
+		v.Set("_count", strconv.Itoa(size))
+		v.Set("page", strconv.Itoa(n))
+		return fmt.Sprintf("%s/%s?%s", s.FhirURL(), resourceType, v.Encode())
+	}
+	links := []map[string]string{
+		{"relation": "first", "url": pageURL(1)},
+		{"relation": "self", "url": pageURL(page)},
+	}
+	if page < last {
+		links = append(links, map[string]string{"relation": "next", "url": pageURL(page + 1)})
+	}
+	links = append(links, map[string]string{"relation": "last", "url": pageURL(last)})
+
+	var entries []map[string]interface{}
+	for i := start; i < end; i++ {
+		res := resource(sc, s.FhirURL(), i)
+		entries = append(entries, map[string]interface{}{
+			"fullUrl":  fmt.Sprintf("%s/%s/%s", s.FhirURL(), resourceType, res["id"]),
+			"resource": res,
+			"search":   map[string]string{"mode": "match"},
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "searchset",
+		"total":        total,
+		"link":         links,
+		"entry":        entries,
+	})
+}
+
+// Login follows authURL, a link to the server's authorization endpoint, as
+// scenario, and returns where the server sends the user back to: the redirect
+// uri, with a code and the state
+func Login(authURL, scenario string) (*url.URL, error) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(authURL + "&scenario=" + url.QueryEscape(scenario))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("expected a redirect back, got %s", resp.Status)
+	}
+	return resp.Location()
+}
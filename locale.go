@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/adhocteam/covidreport/i18n"
+	"github.com/adhocteam/covidreport/identity"
+	"github.com/adhocteam/covidreport/record"
+)
+
+// langCookie remembers the language the user picked with ?lang=
+const langCookie = "covidrecord_lang"
+
+// langCookieAge is how long we remember the user's language for
+const langCookieAge = 365 * 24 * 60 * 60
+
+// requestLang is the language to show a page in: the one given by ?lang=,
+// then the one remembered in the cookie, then the best match for the
+// browser's Accept-Language
+func requestLang(r *http.Request) string {
+	if r == nil {
+		return i18n.Default
+	}
+	if lang := r.URL.Query().Get("lang"); i18n.IsSupported(lang) {
+		return lang
+	}
+	if c, err := r.Cookie(langCookie); err == nil && i18n.IsSupported(c.Value) {
+		return c.Value
+	}
+	return i18n.Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// catalog returns the messages for the request's language
+func catalog(r *http.Request) *i18n.Catalog {
+	return i18n.Lookup(requestLang(r))
+}
+
+// withLanguage remembers the language picked with ?lang= in a cookie, so that
+// the rest of the user's pages are in it too
+func withLanguage(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lang := r.URL.Query().Get("lang"); i18n.IsSupported(lang) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     langCookie,
+				Value:    lang,
+				Path:     "/",
+				MaxAge:   langCookieAge,
+				HttpOnly: true,
+				Secure:   isTLS(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// messageError is an error whose message for the user is in the catalog, for
+// code that doesn't have the request to pick the language. renderError shows
+// it in the request's language; Error is the default language's, for logs.
+type messageError struct {
+	key string
+	err error
+}
+
+func (e *messageError) Error() string { return i18n.Lookup(i18n.Default).T(e.key) }
+
+func (e *messageError) Unwrap() error { return e.err }
+
+// mismatchFields maps the fields identity reports as not matching to their
+// messages
+var mismatchFields = map[string]string{
+	"last names":  "mismatch.lastNames",
+	"first names": "mismatch.firstNames",
+	"birth dates": "mismatch.birthDates",
+	"genders":     "mismatch.genders",
+}
+
+// mismatchMessage explains to the user why two records weren't combined
+func mismatchMessage(cat *i18n.Catalog, e *identity.MismatchError) string {
+	a, b := record.SourceName(e.A.Source), record.SourceName(e.B.Source)
+	if e.Result.Incomplete {
+		return cat.T("error.mismatchIncomplete", a, b)
+	}
+	var fields string
+	for i, field := range e.Result.Mismatches {
+		if key, ok := mismatchFields[field]; ok {
+			field = cat.T(key)
+		}
+		if i == 0 {
+			fields = field
+		} else {
+			fields = cat.T("list.and", fields, field)
+		}
+	}
+	if fields == "" {
+		return cat.T("error.mismatch", a, b)
+	}
+	return cat.T("error.mismatchFields", a, b, fields)
+}
+
+// localizeError returns err with its message in the request's language, if
+// it's one of the errors we have messages for
+func localizeError(r *http.Request, err error) error {
+	var msg *messageError
+	var mismatch *identity.MismatchError
+	switch {
+	case errors.As(err, &msg):
+		return errors.New(catalog(r).T(msg.key))
+	case errors.As(err, &mismatch):
+		return errors.New(mismatchMessage(catalog(r), mismatch))
+	}
+	return err
+}
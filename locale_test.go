@@ -0,0 +1,210 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/i18n"
+	"github.com/adhocteam/covidreport/identity"
+	"github.com/adhocteam/covidreport/lighthouse"
+	"github.com/adhocteam/covidreport/record"
+)
+
+var (
+	// templateKeyRe finds the messages templates use: {{t "key" ...}} and
+	// {{n "key" count}}, which may be nested in other actions
+	templateKeyRe = regexp.MustCompile(`[{(]\s*(t|n) "([^"]+)"`)
+	// codeKeyRe finds the messages go code uses with cat.T("key") and
+	// cat.N("key", n), but not the keys it builds like cat.T("test." + kind)
+	codeKeyRe = regexp.MustCompile(`\.(T|N)\("([^"]+)"\s*[,)]`)
+)
+
+// usedKeys finds the message keys used in files matching pattern
+func usedKeys(t *testing.T, pattern string, re *regexp.Regexp) []string {
+	t.Helper()
+	files, err := filepath.Glob(pattern)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no files match %s: %v", pattern, err)
+	}
+	var keys []string
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range re.FindAllStringSubmatch(string(b), -1) {
+			if m[1] == "n" || m[1] == "N" {
+				keys = append(keys, m[2]+".one", m[2]+".other")
+			} else {
+				keys = append(keys, m[2])
+			}
+		}
+	}
+	return keys
+}
+
+// TestCatalogComplete fails if a message the templates or handlers use is
+// missing from any language's catalog
+func TestCatalogComplete(t *testing.T) {
+	keys := usedKeys(t, "templates/*.html", templateKeyRe)
+	if len(keys) < 50 {
+		t.Fatalf("expected to find the templates' messages, only found %v", keys)
+	}
+	keys = append(keys, usedKeys(t, "*.go", codeKeyRe)...)
+
+	// the keys built at run time
+	for _, kind := range []record.TestKind{record.TestMolecular, record.TestAntigen, record.TestAntibody} {
+		keys = append(keys, "test."+string(kind))
+	}
+	for _, outcome := range []record.TestOutcome{record.OutcomePositive, record.OutcomeNegative, record.OutcomeUnknown} {
+		keys = append(keys, "result."+string(outcome))
+	}
+	for i := 1; i <= ordinalMessages; i++ {
+		keys = append(keys, fmt.Sprintf("dose.%d", i), fmt.Sprintf("booster.%d", i), fmt.Sprintf("reminder.dose.%d", i))
+	}
+	keys = append(keys, "dose.n", "booster.n", "reminder.dose.n", "date.format", "dob.format", "datetime.format")
+	// and the messages of errors translated when they're rendered
+	keys = append(keys, "error.vaLoginExpired", "error.vaTimeout")
+	for _, key := range mismatchFields {
+		keys = append(keys, key)
+	}
+	for m := 1; m <= 12; m++ {
+		keys = append(keys, fmt.Sprintf("month.%d", m))
+	}
+
+	for _, lang := range i18n.Supported {
+		cat := i18n.Lookup(lang)
+		for _, key := range keys {
+			if _, ok := cat.Messages[key]; !ok {
+				t.Errorf("%s: no translation for %q", lang, key)
+			}
+		}
+	}
+}
+
+func TestRequestLang(t *testing.T) {
+	tests := []struct {
+		name, url, cookie, accept, want string
+	}{
+		{"default", "/", "", "", "en"},
+		{"accept-language", "/", "", "es-US,es;q=0.9", "es"},
+		{"cookie beats accept-language", "/", "en", "es", "en"},
+		{"query beats cookie", "/?lang=es", "en", "", "es"},
+		{"unsupported query", "/?lang=xx", "es", "", "es"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: langCookie, Value: tt.cookie})
+			}
+			r.Header.Set("Accept-Language", tt.accept)
+			if got := requestLang(r); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLanguageCookie(t *testing.T) {
+	server := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/?lang=es", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `<html lang="es">`) || !strings.Contains(body, "Verificación de vacunación") {
+		t.Errorf("expected the index page in spanish, got %s", body)
+	}
+	if got := w.Header().Get("Content-Language"); got != "es" {
+		t.Errorf("expected Content-Language es, got %q", got)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == langCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != "es" {
+		t.Fatalf("expected the language to be remembered, got %v", w.Result().Cookies())
+	}
+
+	// later pages are in spanish without asking again, even for an english
+	// browser
+	r := httptest.NewRequest("GET", "/error", nil)
+	r.AddCookie(cookie)
+	r.Header.Set("Accept-Language", "en-US")
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "Se produjo un error") {
+		t.Errorf("expected the error page in spanish, got %s", w.Body)
+	}
+}
+
+func TestSpanishCard(t *testing.T) {
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute)}
+	r := httptest.NewRequest("GET", "/showCallback?persona=boosted", nil)
+	r.Header.Set("Accept-Language", "es-MX,es;q=0.9")
+	w := httptest.NewRecorder()
+	server.staticCallback(w, r)
+
+	body := w.Body.String()
+	for _, want := range []string{"VACUNADO &#43; REFUERZO", "F. nac. &mdash; 01 jun 1999", "Primera dosis", "Refuerzo recibido", "Cerrar sesión"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q on the card", want)
+		}
+	}
+	for _, english := range []string{"First Dose", "Log out", " Jun "} {
+		if strings.Contains(body, english) {
+			t.Errorf("didn't expect %q on the spanish card", english)
+		}
+	}
+}
+
+func TestLocalizeError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/callback", nil)
+	r.Header.Set("Accept-Language", "es")
+
+	err := vaError(fmt.Errorf("getting patient: %w", lighthouse.ErrTokenRejected))
+	if got := localizeError(r, err).Error(); !strings.Contains(got, "Su inicio de sesión en el VA venció") {
+		t.Errorf("expected the VA's error in spanish, got %q", got)
+	}
+	if !strings.Contains(err.Error(), "Your VA login expired") {
+		t.Errorf("expected the error to be logged in english, got %q", err)
+	}
+
+	_, err = identity.Matcher{Threshold: identity.DefaultThreshold}.Check(
+		record.Patient{Source: record.SourceBlueButton, Name: "Joseph Esposito", BirthDate: record.Date{Time: mustParse("2006-01-02", "1999-06-01")}},
+		record.Patient{Source: record.SourceLighthouse, Name: "Joe Esposito", BirthDate: record.Date{Time: mustParse("2006-01-02", "1989-06-01")}},
+	)
+	got := localizeError(r, err).Error()
+	if !strings.Contains(got, "no parecen ser de la misma persona (no coinciden los nombres y las fechas de nacimiento)") {
+		t.Errorf("expected the mismatch in spanish, got %q", got)
+	}
+	if english := localizeError(httptest.NewRequest("GET", "/", nil), err).Error(); english != err.Error() {
+		t.Errorf("expected the english message to match the error's, got %q and %q", english, err)
+	}
+}
@@ -15,9 +15,11 @@ package main
 
 import (
 	"context"
+	_ "embed"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
 	"os"
@@ -25,8 +27,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/adhocteam/covidreport/bluebutton"
-	"github.com/adhocteam/covidreport/lighthouse"
+	"github.com/adhocteam/covidreport/audit"
+	"github.com/adhocteam/covidreport/dcc"
+	"github.com/adhocteam/covidreport/record"
+	"github.com/adhocteam/covidreport/wallet"
 	"github.com/skip2/go-qrcode"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
@@ -44,434 +48,403 @@ func genQrCode(in string) (string, error) {
 	return base64.StdEncoding.EncodeToString(qrCode), nil
 }
 
-func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
-	// We're just going to read the templates every time, to make development
-	// easier. In the future, we might want to be more efficent with this
-	t, err := template.ParseGlob("templates/*.html")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error %s", err.Error()), 500)
-		return
+// qrPayload is what we encode in the card's qr code for a record
+func qrPayload(rec *record.Record) string {
+	switch rec.Summary().Status {
+	case record.StatusComplete, record.StatusBoosted:
+		return "✓"
 	}
+	return "❌"
+}
 
-	err = t.ExecuteTemplate(w, name, data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error %s", err.Error()), 500)
-		return
-	}
+type requestIDKey struct{}
+
+// requestID returns the id logreq gave the request, which ties the audit log's
+// events to the request log
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
 }
 
 func logreq(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("path: %s", r.URL.Path)
+		// a shorter id than a session's is plenty to tell requests apart
+		id := makeSessionID()[:16]
+		log.Printf("path: %s request: %s", r.URL.Path, id)
+		w.Header().Set("X-Request-Id", id)
 
-		f(w, r)
+		f(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
 	})
 }
 
 // CovidRecord represents a covid record server
 type CovidRecord struct {
 	Port     string
-	BBClient bluebutton.Client
-	VAClient lighthouse.Client
+	Sessions *SessionStore
+	// Providers are the sources of records users can connect
+	Providers *Registry
+	// RevokeAfterFetch revokes providers' tokens as soon as we've loaded the
+	// user's record, rather than when they log out
+	RevokeAfterFetch bool
+	// Revocations records the outcome of every token revocation
+	Revocations *RevocationLog
+	// Personas are the made up patients shown at /showCallback. The built in
+	// ones are used if it's nil.
+	Personas *PersonaCatalog
+
+	// AppleWallet is nil unless Apple Wallet passes are configured
+	AppleWallet *wallet.AppleWallet
+	// GoogleWallet is nil unless Google Wallet passes are configured
+	GoogleWallet *wallet.GoogleWallet
+	// DCC is nil unless EU Digital COVID Certificates are configured
+	DCC *dcc.Issuer
+
+	// Limiter limits how often each client can log in or see a demo card,
+	// and how many records we fetch at once. Nothing is limited if it's nil.
+	Limiter *RateLimiter
+	// Audit records who accessed which records. Nothing is recorded if it's
+	// nil.
+	Audit *audit.Log
+}
+
+// Handler returns the server's routes. Each enabled provider gets a start and
+// callback route. The routes that show the patient's record aren't cached,
+// and the ones that hand it over are audited.
+func (s *CovidRecord) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, p := range s.Providers.Enabled() {
+		mux.Handle(p.startPath(), logreq(s.authStartHandler(p)))
+		for _, path := range p.callbackPaths() {
+			mux.Handle(path, logreq(noStore(s.rateLimit("callback", callbackLimit, s.authCallbackHandler(p)))))
+		}
+	}
+	mux.Handle("/logout", logreq(s.logoutHandler))
+	mux.Handle("/error", logreq(serveError))
+	mux.Handle("/showCallback", logreq(noStore(s.rateLimit("showCallback", demoLimit, s.staticCallback))))
+	mux.Handle("/export/fhir", logreq(noStore(s.auditExport(s.exportFHIRHandler))))
+	mux.Handle("/card.pdf", logreq(noStore(s.auditExport(s.cardPDFHandler))))
+	mux.Handle("/card.pkpass", logreq(noStore(s.auditExport(s.applePassHandler))))
+	mux.Handle("/googlewallet", logreq(noStore(s.auditExport(s.googlePassHandler))))
+	mux.Handle("/nextdose.ics", logreq(noStore(s.auditExport(s.nextDoseHandler))))
+	mux.Handle("/dcc", logreq(noStore(s.auditExport(s.dccHandler))))
+	mux.Handle("/api/v1/me", logreq(noStore(s.auditExport(s.apiHandler(apiMe)))))
+	mux.Handle("/api/v1/vaccinations", logreq(noStore(s.auditExport(s.apiHandler(apiVaccinations)))))
+	mux.Handle("/api/v1/tests", logreq(noStore(s.auditExport(s.apiHandler(apiTests)))))
+	mux.Handle("/api/v1/status", logreq(noStore(s.auditExport(s.apiHandler(apiStatus)))))
+	mux.Handle("/api/v1/openapi.json", logreq(serveOpenAPI))
+	mux.Handle("/api/", logreq(apiNotFound))
+	mux.Handle("/", logreq(s.defaultHandler))
+	return withSecurityHeaders(withLanguage(mux))
 }
 
 // Start a covid record server
 func (s *CovidRecord) Start(cert, key string) {
-	http.Handle("/callback", logreq(s.callbackHandler))
-	http.Handle("/bbcallback", logreq(s.bbcallbackHandler))
-	http.Handle("/error", logreq(serveError))
-	http.Handle("/showCallback", logreq(staticCallback))
-	http.Handle("/", logreq(s.defaultHandler))
+	handler := s.Handler()
 	addr := fmt.Sprintf(":%s", s.Port)
 	log.Printf("Starting covid record on %s", addr)
 	if cert != "" {
-		log.Fatal(http.ListenAndServeTLS(addr, cert, key, nil))
+		log.Fatal(http.ListenAndServeTLS(addr, cert, key, handler))
 	} else {
-		log.Fatal(http.ListenAndServe(addr, nil))
+		log.Fatal(http.ListenAndServe(addr, handler))
 	}
 }
 
+// vaScopes are the oauth scopes we request from VA Lighthouse
+// fhirUser puts the patient in the signed ID token, so we don't have to trust
+// the token response's unsigned patient field
+const vaScopes = "openid profile email fhirUser launch/patient patient/Patient.read patient/Immunization.read patient/Observation.read"
+
 func (c *CovidRecord) defaultHandler(w http.ResponseWriter, r *http.Request) {
-	renderTemplate(w, "index.html", struct {
-		VAAuthURL string
-		BBAuthURL string
+	renderTemplate(w, r, "index.html", struct {
+		Providers []providerLink
 	}{
-		BBAuthURL: c.BBClient.AuthURL(),
-		VAAuthURL: c.VAClient.AuthURL("openid profile email launch/patient patient/Patient.read patient/Immunization.read"),
+		Providers: c.Providers.Links(nil),
 	})
 }
 
-func logHeaders(r *http.Request) {
-	log.Printf("Headers:\n")
-	for header, values := range r.Header {
-		log.Printf("    %s: %s\n", header, values)
-	}
-}
-
 // serveError is here so that we can test the error page when required
 func serveError(w http.ResponseWriter, r *http.Request) {
-	renderTemplate(w, "error.html", fmt.Errorf("This is an example error"))
-}
-
-func mustParse(format, dt string) time.Time {
-	tm, err := time.Parse(format, dt)
-	if err != nil {
-		panic(err)
-	}
-	return tm
-}
-
-// fakeVaccinations returns a given number of bluebutton vaccionations
-func fakeVaccinations(nvax int) ([]bluebutton.Vaccination, *bluebutton.Patient) {
-	vaxes := []bluebutton.Vaccination{}
-	for i := 0; i < nvax; i++ {
-		dt, err := time.Parse(time.RFC3339Nano, "2021-02-01T16:00:00.000+00:00")
-		if err != nil {
-			log.Printf(err.Error())
-			panic(err)
-		}
-
-		// add 28 days for the second vax if present
-		dt = dt.Add(time.Duration(i*28*24) * time.Hour)
-
-		vaxes = append(vaxes, bluebutton.Vaccination{
-			Date:     dt,
-			Code:     "91300-0001A",
-			Display:  fmt.Sprintf("COVID-19 Vaccination dose %d", i),
-			Location: "Northshore Clinic - Skokie",
-			Lot:      "1S892X78-B",
-		})
-	}
-	patient := &bluebutton.Patient{
-		BirthDate: bluebutton.YearMonthDay{Time: mustParse("2006-01-02", "1999-06-01")},
-		Name: []bluebutton.PatientName{{
-			Family: "Esposito",
-			Given:  []string{"Joseph"},
-		}},
-	}
-
-	return vaxes, patient
+	renderError(w, r, http.StatusInternalServerError, errors.New(catalog(r).T("error.example")))
 }
 
-func staticCallback(w http.ResponseWriter, r *http.Request) {
-	var nvax int
-	if svax, ok := r.URL.Query()["vax"]; ok {
-		var err error
-		nvax, err = strconv.Atoi(svax[0])
-		if err != nil {
-			log.Printf(err.Error())
-			nvax = 1
-		}
-	} else {
-		nvax = 1
-	}
+// defaultPersona is shown at /showCallback if no persona is asked for
+const defaultPersona = "pfizer-partial"
 
-	vaxes, patient := fakeVaccinations(nvax)
-
-	fullToken := &bluebutton.FullToken{
-		AccessToken: "123545",
+// staticCallback shows the card for a persona, given by ?persona={id}, without
+// logging in to a provider
+func (c *CovidRecord) staticCallback(w http.ResponseWriter, r *http.Request) {
+	personas := c.Personas
+	if personas == nil {
+		personas = builtinPersonaCatalog()
 	}
-
-	dosesRemaining := fmt.Sprintf(`<span class="font-sans-lg">%d</span> doses remaining`, 2-len(vaxes))
-
-	vaxComplete := len(vaxes) > 1
-
-	name := fmt.Sprintf("%s %s", strings.Join(patient.Name[0].Given, " "), patient.Name[0].Family)
-
-	var qrCode string
-	var err error
-	if vaxComplete {
-		qrCode, err = genQrCode("✓")
-	} else {
-		qrCode, err = genQrCode("❌")
+	id := r.URL.Query().Get("persona")
+	if id == "" {
+		id = defaultPersona
 	}
-	if err != nil {
-		log.Printf("error getting eob: %s", err)
-		renderTemplate(w, "error.html", err)
+	persona, ok := personas.Get(id)
+	if !ok {
+		renderError(w, r, http.StatusNotFound, errors.New(catalog(r).T("error.noPersona", id, strings.Join(personas.IDs(), ", "))))
 		return
 	}
 
-	data := struct {
-		User           *bluebutton.UserInfo
-		Vaccinations   []bluebutton.Vaccination
-		VaxComplete    bool
-		FullToken      *bluebutton.FullToken
-		Patient        *bluebutton.Patient
-		QrCodePng      string
-		DosesRemaining template.HTML
-		Name           string
-	}{
-		// TODO: do I have access to the DOB?
-		User: &bluebutton.UserInfo{
-			GivenName:  "Benjamin",
-			FamilyName: "Esposito",
-			Name:       "Benjamin Esposito",
-			Email:      "bennyespo@hotmail.com",
-			FhirID:     "-209838199",
-		},
-		Vaccinations:   vaxes,
-		VaxComplete:    vaxComplete,
-		FullToken:      fullToken,
-		Patient:        patient,
-		QrCodePng:      qrCode,
-		DosesRemaining: template.HTML(dosesRemaining),
-		Name:           name,
-	}
-
-	renderTemplate(w, "callback.html", data)
+	sess := c.Sessions.Create(w, r, persona.Record())
+	// the demo card doesn't offer to connect real providers
+	c.renderCard(w, r, sess, nil)
 }
 
-// https://bluebutton.cms.gov/developers/#client-application-flow
-func (c *CovidRecord) bbcallbackHandler(w http.ResponseWriter, r *http.Request) {
-	logHeaders(r)
+func (c *CovidRecord) String() string {
+	return fmt.Sprintf(`Covid Record
+	port: %s%s`, c.Port, c.Providers)
+}
 
-	// pull the token out of the callback parameters
-	// XXX: check state param?
-	codes := r.URL.Query()["code"]
-	if len(codes) == 0 {
-		renderTemplate(w, "error.html", fmt.Errorf("Unable to find a token in response %#v", r.URL))
-		return
+func mustEnv(key string) string {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		panic(fmt.Sprintf("Unable to find key %s", key))
 	}
+	return val
+}
 
-	callbackToken := codes[0]
-
-	fullToken, err := c.BBClient.GetFullToken(callbackToken)
-	if err != nil {
-		log.Printf("error getting full token: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+func env(key, adefault string) string {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return adefault
 	}
+	return val
+}
 
-	user, err := c.BBClient.GetUserInfo(fullToken.AccessToken)
-	log.Printf("%#v", user)
-	if err != nil {
-		log.Printf("error getting user: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
-	}
+// secret returns the value of a given secret key for the current project
+func secret(key string) string {
+	name := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", mustEnv("PROJECT_ID"), key)
 
-	patient, err := c.BBClient.GetPatient(user.FhirID, fullToken.AccessToken)
-	log.Printf("%#v", patient)
+	ctx := context.Background()
+	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
-		log.Printf("error getting patient: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+		panic(err)
 	}
 
-	// For demo purposes, there are two special users. BBUser00000 is assumed
-	// to have completed both their courses of vaccination, and BBUser11111
-	// only one
-	var vaxes []bluebutton.Vaccination
-	if user.FhirID == "-19990000000001" {
-		vaxes, _ = fakeVaccinations(2)
-	} else if user.FhirID == "-20000000001112" {
-		vaxes, _ = fakeVaccinations(1)
-	} else {
-		// XXX: in real life we should probably show the user a "you have
-		// successfully loaded" page, show a spinner, and say "checking vaccination
-		// records..." or something alike
-		vaxes, err = c.BBClient.FindVaccionations(fullToken.AccessToken, user.FhirID)
-		if err != nil {
-			log.Printf("error getting eob: %s", err)
-			renderTemplate(w, "error.html", err)
-			return
-		}
+	req := &secretmanagerpb.AccessSecretVersionRequest{
+		Name: name,
 	}
 
-	log.Printf("vaxes: %v", vaxes)
-
-	dosesRemaining := fmt.Sprintf(`<span class="font-sans-lg">%d</span> doses remaining`, 2-len(vaxes))
-	vaxComplete := len(vaxes) > 1
-
-	var qrCode string
-	if vaxComplete {
-		qrCode, err = genQrCode("✓")
-	} else {
-		qrCode, err = genQrCode("❌")
-	}
+	result, err := client.AccessSecretVersion(ctx, req)
 	if err != nil {
-		log.Printf("error getting eob: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+		panic(err)
 	}
 
-	// this is a tricky one. This will do for now, but would bear a lot more
-	// thought in a real app
-	name := fmt.Sprintf("%s %s", strings.Join(patient.Name[0].Given, " "), patient.Name[0].Family)
-
-	data := struct {
-		Vaccinations   []bluebutton.Vaccination
-		Patient        *bluebutton.Patient
-		QrCodePng      string
-		DosesRemaining template.HTML
-		Name           string
-	}{
-		Vaccinations:   vaxes,
-		Patient:        patient,
-		QrCodePng:      qrCode,
-		DosesRemaining: template.HTML(dosesRemaining),
-		Name:           name,
-	}
-	renderTemplate(w, "callback.html", data)
+	return string(result.Payload.Data)
 }
 
-// https://developer.va.gov/explore/health/docs/authorization
-// https://github.com/department-of-veterans-affairs/vets-api-clients/blob/master/test_accounts.md
-func (c *CovidRecord) callbackHandler(w http.ResponseWriter, r *http.Request) {
-	logHeaders(r)
-
-	// pull the token out of the callback parameters
-	// XXX: check state param?
-	codes := r.URL.Query()["code"]
-	if len(codes) == 0 {
-		renderTemplate(w, "error.html", fmt.Errorf("Unable to find a token in response %#v", r.URL))
-		return
+// envOrSecret returns the value of key from the environment if it's set, and
+// from the secret manager otherwise
+func envOrSecret(key string) string {
+	if val := env(key, ""); val != "" {
+		return val
 	}
+	return secret(key)
+}
 
-	callbackToken := codes[0]
-
-	states := r.URL.Query()["state"]
-	if len(states) == 0 {
-		renderTemplate(w, "error.html", fmt.Errorf("Unable to find a token in response %#v", r.URL))
-		return
+// the app icon, used for wallet passes
+//
+//go:embed static/icon.png
+var appIcon []byte
+
+// newAppleWallet loads the Apple Wallet configuration, or returns nil if it
+// isn't configured. Apple issues the pass certificate and key; the WWDR
+// intermediate certificate is available from Apple's certificate authority.
+func newAppleWallet() *wallet.AppleWallet {
+	passTypeID := env("APPLE_PASS_TYPE_ID", "")
+	if passTypeID == "" {
+		return nil
+	}
+
+	aw, err := wallet.NewAppleWallet(passTypeID,
+		mustEnv("APPLE_TEAM_ID"),
+		envOrSecret("APPLE_PASS_CERT"),
+		envOrSecret("APPLE_PASS_KEY"),
+		envOrSecret("APPLE_WWDR_CERT"))
+	if err != nil {
+		panic(err)
 	}
-	state := states[0]
-
-	fullToken, err := c.VAClient.GetFullToken(callbackToken, state)
+	aw.Images, err = wallet.IconSet(appIcon)
 	if err != nil {
-		log.Printf("error getting full token: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+		panic(err)
 	}
+	return aw
+}
 
-	patient, err := c.VAClient.GetPatient(fullToken.AccessToken, fullToken.PatientID)
-	log.Printf("%#v", patient)
-	if err != nil {
-		log.Printf("error getting user: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+// newGoogleWallet loads the Google Wallet configuration, or returns nil if it
+// isn't configured. The service account key is the json key file google
+// provides for the account that issues passes.
+func newGoogleWallet() *wallet.GoogleWallet {
+	issuerID := env("GOOGLE_WALLET_ISSUER_ID", "")
+	if issuerID == "" {
+		return nil
 	}
 
-	vaxes, err := c.VAClient.GetVaccinations(fullToken.AccessToken, fullToken.PatientID)
-	log.Printf("%#v", vaxes)
+	gw, err := wallet.NewGoogleWallet(issuerID,
+		env("GOOGLE_WALLET_CLASS_ID", "covid_vaccination"),
+		envOrSecret("GOOGLE_WALLET_SERVICE_ACCOUNT"))
 	if err != nil {
-		log.Printf("error getting user: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+		panic(err)
 	}
+	gw.LogoURL = "https://storage.googleapis.com/covidrecord-static-assets/icon.png"
+	return gw
+}
 
-	dosesRemaining := fmt.Sprintf(`<span class="font-sans-lg">%d</span> doses remaining`, 2-len(vaxes))
-	vaxComplete := len(vaxes) > 1
-
-	var qrCode string
-	if vaxComplete {
-		qrCode, err = genQrCode("✓")
-	} else {
-		qrCode, err = genQrCode("❌")
-	}
-	if err != nil {
-		log.Printf("error getting eob: %s", err)
-		renderTemplate(w, "error.html", err)
-		return
+// newDCCIssuer loads the EU Digital COVID Certificate configuration, or
+// returns nil if it isn't configured. The document signer certificate is
+// issued by the country's certificate authority, and its key must be P-256.
+func newDCCIssuer() *dcc.Issuer {
+	name := env("DCC_ISSUER", "")
+	if name == "" {
+		return nil
 	}
 
-	data := struct {
-		Vaccinations   []lighthouse.Vaccination
-		Patient        *lighthouse.Patient
-		QrCodePng      string
-		DosesRemaining template.HTML
-		Name           string
-	}{
-		Vaccinations:   vaxes,
-		Patient:        patient,
-		QrCodePng:      qrCode,
-		DosesRemaining: template.HTML(dosesRemaining),
-		Name:           patient.Name,
+	issuer, err := dcc.NewIssuer(env("DCC_COUNTRY", "US"),
+		name,
+		envOrSecret("DCC_SIGNING_CERT"),
+		envOrSecret("DCC_SIGNING_KEY"))
+	if err != nil {
+		panic(err)
 	}
-	renderTemplate(w, "callback.html", data)
+	return issuer
 }
 
-func (c *CovidRecord) String() string {
-	return fmt.Sprintf(`Covid Record
-	port: %s
-	BBclient: %s
-	VAclient: %s`, c.Port, c.BBClient.String(), c.VAClient.String())
+// envProviders configures Blue Button and VA Lighthouse from the environment,
+// for when there's no providers file
+func envProviders() []ProviderConfig {
+	return []ProviderConfig{{
+		ID:              "bluebutton",
+		Type:            providerBlueButton,
+		Name:            "Blue Button",
+		AuthURL:         mustEnv("BB_URL"),
+		ClientID:        mustEnv("BB_CLIENT_ID"),
+		ClientSecretKey: "BB_CLIENT_SECRET",
+		RedirectURL:     mustEnv("BB_REDIRECT_URL"),
+	}, {
+		ID:              "lighthouse",
+		Type:            providerLighthouse,
+		Name:            "VA Lighthouse",
+		AuthURL:         mustEnv("VA_URL"),
+		FhirURL:         mustEnv("VA_FHIR_URL"),
+		ClientID:        mustEnv("VA_CLIENT_ID"),
+		ClientSecretKey: "VA_CLIENT_SECRET",
+		RedirectURL:     mustEnv("VA_REDIRECT_URL"),
+	}}
 }
 
-func mustEnv(key string) string {
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		panic(fmt.Sprintf("Unable to find key %s", key))
+// newRegistry loads the providers file named by PROVIDERS, or configures the
+// default providers from the environment if it isn't set. Client secrets set
+// in the environment override the google app secrets, which is useful for
+// local testing.
+func newRegistry() *Registry {
+	path := env("PROVIDERS", "")
+	if path == "" {
+		reg, err := NewRegistry(envProviders(), envOrSecret)
+		if err != nil {
+			panic(err)
+		}
+		return reg
 	}
-	return val
-}
 
-func env(key, adefault string) string {
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		return adefault
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
 	}
-	return val
-}
-
-// secret returns the value of a given secret key for the current project
-func secret(key string) string {
-	name := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", mustEnv("PROJECT_ID"), key)
-
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
+	defer f.Close()
+	reg, err := LoadProviders(f, envOrSecret)
 	if err != nil {
 		panic(err)
 	}
+	return reg
+}
 
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: name,
+// newRevocationLog writes revocation events to the file named by
+// REVOCATION_LOG, or to stdout, which App Engine keeps in Cloud Logging
+func newRevocationLog() *RevocationLog {
+	path := env("REVOCATION_LOG", "")
+	if path == "" {
+		return NewRevocationLog(os.Stdout)
 	}
-
-	result, err := client.AccessSecretVersion(ctx, req)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		panic(err)
 	}
-
-	return string(result.Payload.Data)
+	return NewRevocationLog(f)
 }
 
-func main() {
-	// a local VA_CLIENT_SECRET overrides the google app secret, useful for
-	// local testing
-	vaClientSecret := env("VA_CLIENT_SECRET", "")
-	if vaClientSecret == "" {
-		vaClientSecret = secret("VA_CLIENT_SECRET")
+// newRateLimiter limits each client's requests, finding the client behind the
+// proxies listed in TRUSTED_PROXIES, and fetches up to MAX_UPSTREAM_FETCHES
+// records at once
+func newRateLimiter() *RateLimiter {
+	proxies, err := ParseTrustedProxies(env("TRUSTED_PROXIES", ""))
+	if err != nil {
+		panic(err)
 	}
-	vaClient := lighthouse.Client{
-		ClientID:     mustEnv("VA_CLIENT_ID"),
-		ClientSecret: vaClientSecret,
-		URL:          mustEnv("VA_URL"),
-		FhirURL:      mustEnv("VA_FHIR_URL"),
-		CallbackURL:  mustEnv("VA_REDIRECT_URL"),
+	maxFetches := defaultMaxFetches
+	if max := env("MAX_UPSTREAM_FETCHES", ""); max != "" {
+		maxFetches, err = strconv.Atoi(max)
+		if err != nil || maxFetches < 1 {
+			panic(fmt.Sprintf("MAX_UPSTREAM_FETCHES must be a positive number, got %q", max))
+		}
 	}
+	return NewRateLimiter(maxFetches, proxies)
+}
 
-	// local BB_CLIENT_SECRET will override the google app secret
-	bbClientSecret := env("BB_CLIENT_SECRET", "")
-	if bbClientSecret == "" {
-		bbClientSecret = secret("BB_CLIENT_SECRET")
-	}
-	bbClient := bluebutton.Client{
-		BBClientID:     mustEnv("BB_CLIENT_ID"),
-		BBClientSecret: mustEnv("BB_CLIENT_SECRET"),
-		BBURL:          mustEnv("BB_URL"),
-		CallbackURL:    mustEnv("BB_REDIRECT_URL"),
-	}
+func main() {
+	sandboxMode := flag.Bool("sandbox", false, "log in to fake Blue Button and VA Lighthouse servers run in process; no oauth clients, certificates or secrets needed")
+	flag.Parse()
 
 	cert := os.Getenv("SSL_CERT")
 	key := os.Getenv("SSL_KEY")
 	covidRecordPort := env("COVID_RECORD_PORT", "6655")
 
-	server := CovidRecord{
-		Port:     covidRecordPort,
-		VAClient: vaClient,
-		BBClient: bbClient,
+	var providers *Registry
+	if *sandboxMode {
+		// the sandbox is served over plain http, so there's no need for
+		// mkcert
+		cert, key = "", ""
+		base := fmt.Sprintf("http://localhost:%s", covidRecordPort)
+		sb := newSandbox()
+		defer sb.Close()
+		var err error
+		providers, err = sb.Providers(base)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Sandbox mode: open %s and log in as one of the fake providers' people", base)
+	} else {
+		providers = newRegistry()
 	}
+	personas := newPersonas()
+	providers.UsePersonas(personas)
+
+	sessions := NewSessionStore(30 * time.Minute)
+	if threshold := env("IDENTITY_MATCH_THRESHOLD", ""); threshold != "" {
+		t, err := strconv.ParseFloat(threshold, 64)
+		if err != nil || t < 0 || t > 1 {
+			panic(fmt.Sprintf("IDENTITY_MATCH_THRESHOLD must be a number between 0 and 1, got %q", threshold))
+		}
+		sessions.Identity.Threshold = t
+	}
+
+	server := CovidRecord{
+		Port:             covidRecordPort,
+		Sessions:         sessions,
+		Providers:        providers,
+		Personas:         personas,
+		RevokeAfterFetch: env("REVOKE_TOKENS_AFTER_FETCH", "") != "",
+		Revocations:      newRevocationLog(),
+		Limiter:          newRateLimiter(),
+		Audit:            newAuditLog(*sandboxMode),
+
+		AppleWallet:  newAppleWallet(),
+		GoogleWallet: newGoogleWallet(),
+		DCC:          newDCCIssuer(),
+	}
+	sessions.Expired = server.revokeExpired
+	go sessions.RunJanitor(time.Minute, nil)
 
 	log.Printf("%s", server.String())
 	server.Start(cert, key)
@@ -0,0 +1,238 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pdf
+
+import (
+	"fmt"
+
+	"github.com/adhocteam/covidreport/record"
+	"github.com/skip2/go-qrcode"
+)
+
+// Layout is the paper size of the card
+type Layout string
+
+const (
+	// FullPage is a letter-sized sheet with the full dose table
+	FullPage Layout = "full"
+	// Wallet is a two-sided credit card sized card
+	Wallet Layout = "wallet"
+)
+
+var gray = Hex("#71767A")
+
+// statusStyle holds the label and colors for each status, matching the css
+// on the html card
+type statusStyle struct {
+	Label      string
+	Band, Text Color
+}
+
+var statusStyles = map[record.Status]statusStyle{
+	record.StatusPending:  {"VACCINATION PENDING", Hex("#D83933"), White},
+	record.StatusPartial:  {"PARTIAL VACCINATION", Hex("#FACE00"), Black},
+	record.StatusComplete: {"VACCINATION COMPLETE", Hex("#00A91C"), White},
+	record.StatusBoosted:  {"VACCINATED + BOOSTED", Hex("#008817"), White},
+}
+
+// remaining describes how far along the schedule the patient is
+func remaining(summary record.Summary) string {
+	switch summary.DosesRemaining {
+	case 0:
+		return "Dosing schedule complete"
+	case 1:
+		return "1 dose remaining"
+	default:
+		return fmt.Sprintf("%d doses remaining", summary.DosesRemaining)
+	}
+}
+
+func productName(dose record.Dose) string {
+	if dose.Product != "" {
+		return dose.Product
+	}
+	return dose.Display
+}
+
+// drawQR draws a qr code encoding payload as a size x size square with its
+// bottom left corner at x, y
+func drawQR(p *Page, x, y, size float64, payload string) error {
+	q, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	bitmap := q.Bitmap()
+	module := size / float64(len(bitmap))
+
+	p.FillRect(x, y, size, size, White)
+	for row, line := range bitmap {
+		// draw each horizontal run of dark modules as one rectangle to keep
+		// the content stream small
+		for col := 0; col < len(line); col++ {
+			if !line[col] {
+				continue
+			}
+			start := col
+			for col < len(line) && line[col] {
+				col++
+			}
+			p.FillRect(x+float64(start)*module, y+size-float64(row+1)*module,
+				float64(col-start)*module, module, Black)
+		}
+	}
+	return nil
+}
+
+// RenderCard renders the vaccination card for rec as a PDF, with a qr code
+// encoding qrPayload
+func RenderCard(rec *record.Record, qrPayload string, layout Layout) ([]byte, error) {
+	doc := &Document{Title: "COVID-19 Vaccination Record"}
+
+	var err error
+	switch layout {
+	case Wallet:
+		err = walletCard(doc, rec, qrPayload)
+	case FullPage, "":
+		err = fullPageCard(doc, rec, qrPayload)
+	default:
+		err = fmt.Errorf("unknown card layout %q", layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.Bytes()
+}
+
+func fullPageCard(doc *Document, rec *record.Record, qrPayload string) error {
+	const margin = 54.0
+	const width = LetterWidth - 2*margin
+
+	p := doc.AddPage(LetterWidth, LetterHeight)
+	summary := rec.Summary()
+	style := statusStyles[summary.Status]
+
+	p.Text(margin, 730, HelveticaBold, 22, Black, "COVID-19 Vaccination Record")
+
+	p.FillRect(margin, 680, width, 30, style.Band)
+	p.CenteredText(LetterWidth/2, 690, HelveticaBold, 14, style.Text, style.Label)
+
+	p.Text(margin, 650, HelveticaBold, 18, Black, Truncate(HelveticaBold, 18, width, rec.Patient.Name))
+	if !rec.Patient.BirthDate.IsZero() {
+		p.Text(margin, 630, Helvetica, 12, gray, "DOB — "+rec.Patient.BirthDate.Format("02 Jan 2006"))
+	}
+
+	const qrSize = 216.0
+	if err := drawQR(p, (LetterWidth-qrSize)/2, 395, qrSize, qrPayload); err != nil {
+		return err
+	}
+	p.CenteredText(LetterWidth/2, 372, HelveticaBold, 14, Black, remaining(summary))
+
+	// dose table
+	columns := []struct {
+		title string
+		x, w  float64
+	}{
+		{"Dose", margin, 50},
+		{"Date Given", margin + 50, 80},
+		{"Product", margin + 130, 170},
+		{"Location", margin + 300, 130},
+		{"Lot Number", margin + 430, 74},
+	}
+	y := 330.0
+	for _, col := range columns {
+		p.Text(col.x, y, HelveticaBold, 10, Black, col.title)
+	}
+	p.Line(margin, y-6, margin+width, y-6, 1, Black)
+
+	if len(rec.Doses) == 0 {
+		p.Text(margin, y-24, Helvetica, 10, gray, "No record")
+	}
+	for i, dose := range rec.Doses {
+		y -= 20
+		if y < margin {
+			p.Text(margin, y, Helvetica, 10, gray, fmt.Sprintf("%d more doses not shown", len(rec.Doses)-i))
+			break
+		}
+		cells := []string{
+			fmt.Sprintf("%d", i+1),
+			dose.Date.Format("2 Jan 2006"),
+			productName(dose),
+			dose.Location,
+			dose.Lot,
+		}
+		for j, col := range columns {
+			p.Text(col.x, y, Helvetica, 10, Black, Truncate(Helvetica, 10, col.w-6, cells[j]))
+		}
+		p.Line(margin, y-6, margin+width, y-6, 0.25, gray)
+	}
+	return nil
+}
+
+func walletCard(doc *Document, rec *record.Record, qrPayload string) error {
+	const margin = 8.0
+	summary := rec.Summary()
+	style := statusStyles[summary.Status]
+
+	// front: status, name, and qr code
+	front := doc.AddPage(WalletWidth, WalletHeight)
+	front.StrokeRect(0.5, 0.5, WalletWidth-1, WalletHeight-1, 0.5, gray)
+	front.FillRect(0, WalletHeight-20, WalletWidth, 20, style.Band)
+	front.CenteredText(WalletWidth/2, WalletHeight-14, HelveticaBold, 9, style.Text, style.Label)
+
+	const qrSize = 96.0
+	if err := drawQR(front, WalletWidth-qrSize-margin, margin+4, qrSize, qrPayload); err != nil {
+		return err
+	}
+
+	textWidth := WalletWidth - qrSize - 3*margin
+	front.Text(margin, 100, HelveticaBold, 10, Black, Truncate(HelveticaBold, 10, textWidth, rec.Patient.Name))
+	if !rec.Patient.BirthDate.IsZero() {
+		front.Text(margin, 88, Helvetica, 8, gray, "DOB — "+rec.Patient.BirthDate.Format("02 Jan 2006"))
+	}
+	front.Text(margin, 20, HelveticaBold, 8, Black, remaining(summary))
+
+	// back: the doses
+	back := doc.AddPage(WalletWidth, WalletHeight)
+	back.StrokeRect(0.5, 0.5, WalletWidth-1, WalletHeight-1, 0.5, gray)
+	back.Text(margin, WalletHeight-16, HelveticaBold, 9, Black, "COVID-19 Vaccination Doses")
+	back.Line(margin, WalletHeight-21, WalletWidth-margin, WalletHeight-21, 0.5, gray)
+
+	if len(rec.Doses) == 0 {
+		back.Text(margin, WalletHeight-36, Helvetica, 8, gray, "No record")
+	}
+
+	// five rows fit between the title and the bottom of the card
+	const rowHeight = 21.0
+	maxRows := 5
+	y := WalletHeight - 33
+	for i, dose := range rec.Doses {
+		if i == maxRows-1 && len(rec.Doses) > maxRows {
+			back.Text(margin, y, Helvetica, 7, gray, fmt.Sprintf("+%d more doses, see the full page card", len(rec.Doses)-i))
+			break
+		}
+		line := fmt.Sprintf("%d. %s — %s", i+1, dose.Date.Format("2 Jan 2006"), productName(dose))
+		back.Text(margin, y, HelveticaBold, 7, Black, Truncate(HelveticaBold, 7, WalletWidth-2*margin, line))
+
+		detail := dose.Location
+		if dose.Lot != "" {
+			if detail != "" {
+				detail += " • "
+			}
+			detail += "Lot " + dose.Lot
+		}
+		back.Text(margin+9, y-8, Helvetica, 6, gray, Truncate(Helvetica, 6, WalletWidth-2*margin-9, detail))
+		y -= rowHeight
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pdf renders the vaccination card as a PDF. It includes just enough
+// of a PDF writer to draw text in the standard fonts, filled rectangles and
+// lines, so that we don't need a headless browser or cgo to run on App Engine.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+)
+
+// Page sizes, in points
+const (
+	LetterWidth  = 612.0
+	LetterHeight = 792.0
+	// the size of a credit card, 3.375" x 2.125"
+	WalletWidth  = 243.0
+	WalletHeight = 153.0
+)
+
+// Font is one of the standard PDF fonts, which every reader has built in
+type Font int
+
+const (
+	Helvetica Font = iota
+	HelveticaBold
+)
+
+// resource name and base font for each Font
+var fontNames = [...][2]string{
+	Helvetica:     {"F1", "Helvetica"},
+	HelveticaBold: {"F2", "Helvetica-Bold"},
+}
+
+// Color is an rgb color with components from 0 to 1
+type Color struct {
+	R, G, B float64
+}
+
+// Hex converts a color like "#00A91C" into a Color
+func Hex(hex string) Color {
+	var r, g, b uint8
+	fmt.Sscanf(strings.TrimPrefix(hex, "#"), "%02x%02x%02x", &r, &g, &b)
+	return Color{float64(r) / 255, float64(g) / 255, float64(b) / 255}
+}
+
+var (
+	Black = Color{0, 0, 0}
+	White = Color{1, 1, 1}
+)
+
+// Page is a single page of a document. Coordinates are in points with the
+// origin at the bottom left of the page, as in PDF itself.
+type Page struct {
+	Width, Height float64
+	content       bytes.Buffer
+}
+
+// Document is a PDF document under construction
+type Document struct {
+	Title string
+	pages []*Page
+}
+
+// AddPage adds a blank page of the given size to the document
+func (d *Document) AddPage(width, height float64) *Page {
+	p := &Page{Width: width, Height: height}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+func num(f float64) string {
+	s := fmt.Sprintf("%.2f", f)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// FillRect draws a filled rectangle with its bottom left corner at x, y
+func (p *Page) FillRect(x, y, w, h float64, c Color) {
+	fmt.Fprintf(&p.content, "%s %s %s rg %s %s %s %s re f\n",
+		num(c.R), num(c.G), num(c.B), num(x), num(y), num(w), num(h))
+}
+
+// Line draws a line from x1, y1 to x2, y2
+func (p *Page) Line(x1, y1, x2, y2, width float64, c Color) {
+	fmt.Fprintf(&p.content, "%s %s %s RG %s w %s %s m %s %s l S\n",
+		num(c.R), num(c.G), num(c.B), num(width), num(x1), num(y1), num(x2), num(y2))
+}
+
+// StrokeRect draws the outline of a rectangle
+func (p *Page) StrokeRect(x, y, w, h, width float64, c Color) {
+	fmt.Fprintf(&p.content, "%s %s %s RG %s w %s %s %s %s re S\n",
+		num(c.R), num(c.G), num(c.B), num(width), num(x), num(y), num(w), num(h))
+}
+
+// Text draws s with its baseline starting at x, y
+func (p *Page) Text(x, y float64, font Font, size float64, c Color, s string) {
+	fmt.Fprintf(&p.content, "BT %s %s %s rg /%s %s Tf %s %s Td (%s) Tj ET\n",
+		num(c.R), num(c.G), num(c.B), fontNames[font][0], num(size), num(x), num(y), escape(s))
+}
+
+// CenteredText draws s centered horizontally on x
+func (p *Page) CenteredText(x, y float64, font Font, size float64, c Color, s string) {
+	p.Text(x-TextWidth(font, size, s)/2, y, font, size, c, s)
+}
+
+// escape encodes s in WinAnsiEncoding and escapes it for use in a PDF string.
+// Characters that can't be represented become "?".
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c, ok := winAnsi(r)
+		if !ok {
+			c = '?'
+		}
+		switch c {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			if c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// winAnsi maps a rune to its byte in WinAnsiEncoding. It covers ascii, latin-1
+// and the handful of punctuation marks we're likely to use.
+func winAnsi(r rune) (byte, bool) {
+	switch {
+	case r >= 0x20 && r <= 0x7e:
+		return byte(r), true
+	case r >= 0xa0 && r <= 0xff:
+		return byte(r), true
+	}
+	switch r {
+	case '—':
+		return 0x97, true
+	case '–':
+		return 0x96, true
+	case '’':
+		return 0x92, true
+	case '•':
+		return 0x95, true
+	case '…':
+		return 0x85, true
+	}
+	return 0, false
+}
+
+// TextWidth returns the width of s in points when set in font at size
+func TextWidth(font Font, size float64, s string) float64 {
+	widths := &helveticaWidths
+	if font == HelveticaBold {
+		widths = &helveticaBoldWidths
+	}
+
+	total := 0
+	for _, r := range s {
+		c, ok := winAnsi(r)
+		if !ok {
+			c = '?'
+		}
+		switch {
+		case c >= 0x20 && c <= 0x7e:
+			total += widths[c-0x20]
+		case c == 0x97 || c == 0x85:
+			total += 1000
+		default:
+			// close enough for accented letters and punctuation
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// Truncate shortens s with an ellipsis so that it fits in width
+func Truncate(font Font, size, width float64, s string) string {
+	if TextWidth(font, size, s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		t := strings.TrimSpace(string(runes)) + "…"
+		if TextWidth(font, size, t) <= width {
+			return t
+		}
+	}
+	return ""
+}
+
+// Bytes serializes the document
+func (d *Document) Bytes() ([]byte, error) {
+	var out bytes.Buffer
+	var offsets []int
+
+	// objects are numbered from 1 in the order they're written
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// 1: catalog, 2: page tree, 3-4: fonts, 5: info, then a page and its
+	// content stream for each page
+	const firstPage = 6
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, f := range fontNames {
+		obj(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f[1]))
+	}
+	obj(fmt.Sprintf("<< /Title (%s) /Producer (covidreport) >>", escape(d.Title)))
+
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			num(p.Width), num(p.Height), firstPage+2*i+1))
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(p.content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+func testRecord(ndoses int) *record.Record {
+	rec := &record.Record{
+		Patient: record.Patient{
+			Name:      "Jane X Doe",
+			BirthDate: record.Date{Time: time.Date(1999, 6, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	for i := 0; i < ndoses; i++ {
+		rec.Doses = append(rec.Doses, record.Dose{
+			Date:     record.Date{Time: time.Date(2021, 2, 1+28*i, 0, 0, 0, 0, time.UTC)},
+			Code:     "0001A",
+			Product:  "Pfizer-BioNTech COVID-19 Vaccine",
+			Location: "Northshore Clinic (Skokie)",
+			Lot:      fmt.Sprintf("LOT%d", i),
+		})
+	}
+	return rec
+}
+
+var streamRe = regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`)
+
+// checkStructure verifies the xref table points at each object and returns
+// the decompressed page content streams
+func checkStructure(t *testing.T, b []byte) []string {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(b, []byte("%%EOF\n")) {
+		t.Fatalf("missing pdf header or trailer")
+	}
+
+	idx := bytes.LastIndex(b, []byte("startxref\n"))
+	xrefOffset, err := strconv.Atoi(strings.Fields(string(b[idx+len("startxref\n"):]))[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b[xrefOffset:]), "\n")
+	if lines[0] != "xref" {
+		t.Fatalf("startxref doesn't point at the xref table: %q", lines[0])
+	}
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for i := 1; i < count; i++ {
+		off, _ := strconv.Atoi(strings.Fields(lines[2+i])[0])
+		want := fmt.Sprintf("%d 0 obj", i)
+		if !bytes.HasPrefix(b[off:], []byte(want)) {
+			t.Errorf("xref entry %d doesn't point at %q", i, want)
+		}
+	}
+
+	var streams []string
+	for _, m := range streamRe.FindAllSubmatch(b, -1) {
+		r, err := zlib.NewReader(bytes.NewReader(m[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, string(content))
+	}
+	return streams
+}
+
+func TestFullPageCard(t *testing.T) {
+	b, err := RenderCard(testRecord(2), "✓", FullPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := checkStructure(t, b)
+	if len(streams) != 1 {
+		t.Fatalf("expected one page, got %d", len(streams))
+	}
+	for _, want := range []string{"(Jane X Doe)", "(VACCINATION COMPLETE)", "(DOB \\227 01 Jun 1999)", "(1 Mar 2021)", "(LOT1)", "Northshore Clinic \\(Skokie\\)"} {
+		if !strings.Contains(streams[0], want) {
+			t.Errorf("expected page to contain %s", want)
+		}
+	}
+}
+
+func TestWalletCard(t *testing.T) {
+	b, err := RenderCard(testRecord(8), "❌", Wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := checkStructure(t, b)
+	if len(streams) != 2 {
+		t.Fatalf("expected front and back pages, got %d", len(streams))
+	}
+	if !strings.Contains(streams[0], "(Jane X Doe)") {
+		t.Errorf("expected the name on the front")
+	}
+	if !strings.Contains(streams[1], "(+4 more doses, see the full page card)") {
+		t.Errorf("expected the extra doses to be summarized on the back:\n%s", streams[1])
+	}
+	if !bytes.Contains(b, []byte("/MediaBox [0 0 243 153]")) {
+		t.Errorf("expected a wallet sized page")
+	}
+}
+
+func TestUnknownLayout(t *testing.T) {
+	if _, err := RenderCard(testRecord(1), "❌", Layout("poster")); err == nil {
+		t.Errorf("expected an error for an unknown layout")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	s := Truncate(Helvetica, 10, 50, "Pfizer-BioNTech COVID-19 Vaccine")
+	if !strings.HasSuffix(s, "…") || TextWidth(Helvetica, 10, s) > 50 {
+		t.Errorf("unexpected truncation %q", s)
+	}
+	if s := Truncate(Helvetica, 10, 500, "short"); s != "short" {
+		t.Errorf("expected short text to be left alone, got %q", s)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+	"github.com/adhocteam/covidreport/record"
+)
+
+// builtinPersonas is the catalog used unless PERSONAS names another
+//
+//go:embed personas.json
+var builtinPersonas []byte
+
+// Persona is a made up patient and their doses, for demos and QA. A persona
+// can be shown at /showCallback?persona={id}, and if it has a FhirID, logging
+// in to the Blue Button sandbox as that user shows the persona's doses in
+// place of the user's claims.
+type Persona struct {
+	ID          string         `json:"id"`
+	Description string         `json:"description"`
+	FhirID      string         `json:"fhir_id,omitempty"`
+	Patient     personaPatient `json:"patient"`
+	Doses       []personaDose  `json:"doses"`
+}
+
+type personaPatient struct {
+	GivenName  string      `json:"given_name"`
+	FamilyName string      `json:"family_name"`
+	BirthDate  record.Date `json:"birth_date"`
+	Gender     string      `json:"gender"`
+}
+
+type personaDose struct {
+	Date     record.Date `json:"date"`
+	Code     string      `json:"code"`
+	Display  string      `json:"display"`
+	Location string      `json:"location,omitempty"`
+	Lot      string      `json:"lot,omitempty"`
+	// Status is completed if it's unset. Doses with any other status, like
+	// entered-in-error, are left off the record, like a provider would.
+	Status string `json:"status,omitempty"`
+}
+
+// Vaccinations returns the persona's doses as Blue Button would report them
+func (p *Persona) Vaccinations() []bluebutton.Vaccination {
+	vaxes := []bluebutton.Vaccination{}
+	for _, d := range p.Doses {
+		if d.Status != "" && d.Status != "completed" {
+			continue
+		}
+		vaxes = append(vaxes, bluebutton.Vaccination{
+			Date:     d.Date.Time,
+			Code:     d.Code,
+			Display:  d.Display,
+			Location: d.Location,
+			Lot:      d.Lot,
+		})
+	}
+	return vaxes
+}
+
+// Record returns the persona's record, as if it came from Blue Button
+func (p *Persona) Record() *record.Record {
+	patient := &bluebutton.Patient{
+		Gender:    p.Patient.Gender,
+		BirthDate: bluebutton.YearMonthDay{Time: p.Patient.BirthDate.Time},
+		Name: []bluebutton.PatientName{{
+			Family: p.Patient.FamilyName,
+			Given:  strings.Fields(p.Patient.GivenName),
+		}},
+	}
+	rec := record.FromBlueButton(patient, p.Vaccinations())
+	// the doses are shaped like claims, but aren't anyone's Medicare data
+	rec.Patient.Source = record.SourceDemo
+	for i := range rec.Doses {
+		rec.Doses[i].Source = record.SourceDemo
+	}
+	rec.Patient.ID = "persona:" + p.ID
+	return rec
+}
+
+// PersonaCatalog holds the personas, in the order they're listed
+type PersonaCatalog struct {
+	personas []*Persona
+}
+
+// LoadPersonas reads a json list of personas
+func LoadPersonas(r io.Reader) (*PersonaCatalog, error) {
+	var personas []*Persona
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&personas); err != nil {
+		return nil, fmt.Errorf("reading personas: %w", err)
+	}
+
+	ids := map[string]bool{}
+	fhirIDs := map[string]string{}
+	for i, p := range personas {
+		if p.ID == "" {
+			return nil, fmt.Errorf("persona %d has no id", i)
+		}
+		if ids[p.ID] {
+			return nil, fmt.Errorf("persona %q is listed twice", p.ID)
+		}
+		ids[p.ID] = true
+		if p.FhirID != "" {
+			if other, ok := fhirIDs[p.FhirID]; ok {
+				return nil, fmt.Errorf("personas %q and %q both have fhir id %s", other, p.ID, p.FhirID)
+			}
+			fhirIDs[p.FhirID] = p.ID
+		}
+		if p.Patient.FamilyName == "" || p.Patient.BirthDate.IsZero() {
+			return nil, fmt.Errorf("persona %q needs a family name and birth date", p.ID)
+		}
+		for j, d := range p.Doses {
+			if d.Date.IsZero() || d.Code == "" {
+				return nil, fmt.Errorf("persona %q dose %d needs a date and code", p.ID, j)
+			}
+		}
+	}
+	return &PersonaCatalog{personas: personas}, nil
+}
+
+// builtinPersonaCatalog returns the personas built in to the server
+func builtinPersonaCatalog() *PersonaCatalog {
+	catalog, err := LoadPersonas(bytes.NewReader(builtinPersonas))
+	if err != nil {
+		panic(err)
+	}
+	return catalog
+}
+
+// newPersonas loads the catalog in the file named by PERSONAS, or the built
+// in one
+func newPersonas() *PersonaCatalog {
+	path := env("PERSONAS", "")
+	if path == "" {
+		return builtinPersonaCatalog()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	catalog, err := LoadPersonas(f)
+	if err != nil {
+		panic(err)
+	}
+	return catalog
+}
+
+// Get returns the persona with the given id
+func (c *PersonaCatalog) Get(id string) (*Persona, bool) {
+	if c == nil {
+		return nil, false
+	}
+	for _, p := range c.personas {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// ByFhirID returns the persona standing in for the Blue Button user with the
+// given FHIR id
+func (c *PersonaCatalog) ByFhirID(fhirID string) (*Persona, bool) {
+	if c == nil || fhirID == "" {
+		return nil, false
+	}
+	for _, p := range c.personas {
+		if p.FhirID == fhirID {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// IDs lists the personas' ids
+func (c *PersonaCatalog) IDs() []string {
+	var ids []string
+	for _, p := range c.personas {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
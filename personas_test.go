@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// mustPersona returns one of the built in personas
+func mustPersona(t *testing.T, id string) *Persona {
+	t.Helper()
+	p, ok := builtinPersonaCatalog().Get(id)
+	if !ok {
+		t.Fatalf("no persona %q", id)
+	}
+	return p
+}
+
+// claimsRecord returns a persona's record as if it came from their Medicare
+// claims, for tests that need a provider's record rather than a demo
+func claimsRecord(p *Persona) *record.Record {
+	rec := p.Record()
+	rec.Patient.Source = record.SourceBlueButton
+	for i := range rec.Doses {
+		rec.Doses[i].Source = record.SourceBlueButton
+	}
+	return rec
+}
+
+func TestPersonaRecords(t *testing.T) {
+	tests := []struct {
+		id     string
+		status record.Status
+		doses  int
+	}{
+		{"pending", record.StatusPending, 0},
+		{"pfizer-partial", record.StatusPartial, 1},
+		{"pfizer-complete", record.StatusComplete, 2},
+		{"moderna-complete", record.StatusComplete, 2},
+		{"janssen", record.StatusComplete, 1},
+		{"mixed-manufacturers", record.StatusComplete, 2},
+		{"boosted", record.StatusBoosted, 3},
+		// the entered-in-error dose doesn't count
+		{"entered-in-error", record.StatusPartial, 1},
+		{"missing-location", record.StatusComplete, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			rec := mustPersona(t, tt.id).Record()
+			if rec.Patient.Source != record.SourceDemo {
+				t.Errorf("expected a demo record, got one from %s", rec.Patient.Source)
+			}
+			if len(rec.Doses) != tt.doses {
+				t.Errorf("expected %d doses, got %d", tt.doses, len(rec.Doses))
+			}
+			if got := rec.Summary().Status; got != tt.status {
+				t.Errorf("expected %s, got %s", tt.status, got)
+			}
+		})
+	}
+}
+
+func TestShowEveryPersona(t *testing.T) {
+	catalog := builtinPersonaCatalog()
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute), Personas: catalog}
+
+	for _, id := range catalog.IDs() {
+		p, _ := catalog.Get(id)
+		w := httptest.NewRecorder()
+		server.staticCallback(w, httptest.NewRequest("GET", "/showCallback?persona="+id, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), p.Patient.FamilyName) {
+			t.Errorf("expected %s's card, got %d: %s", id, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.staticCallback(w, httptest.NewRequest("GET", "/showCallback?persona=nobody", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "pfizer-complete") {
+		t.Errorf("expected a 404 listing the personas, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoadPersonas(t *testing.T) {
+	catalog := builtinPersonaCatalog()
+	if p, ok := catalog.ByFhirID("-19990000000001"); !ok || p.ID != "pfizer-complete" {
+		t.Errorf("expected -19990000000001 to be pfizer-complete, got %v", p)
+	}
+	if _, ok := catalog.ByFhirID("-20000000002001"); ok {
+		t.Errorf("didn't expect a persona for an ordinary user")
+	}
+
+	bad := map[string]string{
+		"duplicate id":      `[{"id": "a", "patient": {"family_name": "A", "birth_date": "1950-01-01"}}, {"id": "a", "patient": {"family_name": "B", "birth_date": "1950-01-01"}}]`,
+		"duplicate fhir id": `[{"id": "a", "fhir_id": "-1", "patient": {"family_name": "A", "birth_date": "1950-01-01"}}, {"id": "b", "fhir_id": "-1", "patient": {"family_name": "B", "birth_date": "1950-01-01"}}]`,
+		"dose without code": `[{"id": "a", "patient": {"family_name": "A", "birth_date": "1950-01-01"}, "doses": [{"date": "2021-01-01"}]}]`,
+		"unknown field":     `[{"id": "a", "vax": 2, "patient": {"family_name": "A", "birth_date": "1950-01-01"}}]`,
+	}
+	for name, js := range bad {
+		if _, err := LoadPersonas(strings.NewReader(js)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+	"github.com/adhocteam/covidreport/lighthouse"
+	"github.com/adhocteam/covidreport/record"
+	"github.com/adhocteam/covidreport/smart"
+)
+
+// Provider is a source of vaccination records that users log in to with oauth
+type Provider interface {
+	// AuthURL returns the url to send the user to to log in. state is handed
+	// back to our callback.
+	AuthURL(state string) (string, error)
+	// FetchRecord exchanges the code from the callback for tokens, and loads
+	// the user's record with them. It calls fetched with the type of each
+	// FHIR resource it reads, for the audit log.
+	FetchRecord(code, state string, fetched func(resource string)) (*record.Record, Tokens, error)
+	// Revoke revokes the tokens issued for a login
+	Revoke(t Tokens) error
+	// Source is the source of the records the provider returns
+	Source() string
+}
+
+// Tokens are what a provider issued for a login. We keep them only so we can
+// revoke them.
+type Tokens struct {
+	Access  string
+	Refresh string
+	// Issued is when we received them
+	Issued time.Time
+}
+
+func newTokens(access, refresh string) Tokens {
+	return Tokens{Access: access, Refresh: refresh, Issued: time.Now()}
+}
+
+// The kinds of provider we know how to talk to
+const (
+	providerBlueButton = "bluebutton"
+	providerLighthouse = "lighthouse"
+	providerSMART      = "smart"
+)
+
+// ProviderConfig describes a provider in the providers file
+type ProviderConfig struct {
+	// ID appears in the provider's urls, /auth/{id}/start and
+	// /auth/{id}/callback
+	ID string `json:"id"`
+	// Type is bluebutton, lighthouse or smart
+	Type string `json:"type"`
+	// Name and Logo are shown on the provider's connect button
+	Name string `json:"name"`
+	Logo string `json:"logo,omitempty"`
+	// Enabled defaults to true. Set it to false to take a provider out of
+	// service without removing its configuration.
+	Enabled *bool `json:"enabled,omitempty"`
+	// AuthURL is the base url of the provider's oauth server. SMART health
+	// systems publish their endpoints under FhirURL instead.
+	AuthURL      string `json:"auth_url,omitempty"`
+	FhirURL      string `json:"fhir_url,omitempty"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// ClientSecretKey names the environment variable or secret manager
+	// secret holding the client secret, so it needn't be in the file
+	ClientSecretKey string `json:"client_secret_key,omitempty"`
+	RedirectURL     string `json:"redirect_url"`
+	Scopes          string `json:"scopes,omitempty"`
+}
+
+// registeredProvider is a configured provider
+type registeredProvider struct {
+	ProviderConfig
+	impl Provider
+}
+
+func (p *registeredProvider) enabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+func (p *registeredProvider) startPath() string {
+	return fmt.Sprintf("/auth/%s/start", p.ID)
+}
+
+// callbackPaths are the paths the provider's callback is served at. Besides
+// /auth/{id}/callback, that's the path of the redirect url, since that's what
+// is registered with the provider; Blue Button and VA Lighthouse were
+// registered with /bbcallback and /callback before we had a registry.
+func (p *registeredProvider) callbackPaths() []string {
+	paths := []string{fmt.Sprintf("/auth/%s/callback", p.ID)}
+	if u, err := url.Parse(p.RedirectURL); err == nil && u.Path != paths[0] {
+		paths = append(paths, u.Path)
+	}
+	return paths
+}
+
+// Registry holds the providers users can connect, in the order their buttons
+// are shown
+type Registry struct {
+	providers []*registeredProvider
+}
+
+// ids end up in urls, so keep them simple
+var validProviderID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// NewRegistry builds a provider from each config. secret looks up the client
+// secrets named by ClientSecretKey.
+func NewRegistry(configs []ProviderConfig, secret func(key string) string) (*Registry, error) {
+	reg := &Registry{}
+	ids := map[string]bool{}
+	sources := map[string]string{}
+	paths := map[string]string{}
+	for i, pc := range configs {
+		if !validProviderID.MatchString(pc.ID) {
+			return nil, fmt.Errorf("provider %d: id %q must be lowercase letters, numbers and dashes", i, pc.ID)
+		}
+		if ids[pc.ID] {
+			return nil, fmt.Errorf("provider %q is listed twice", pc.ID)
+		}
+		ids[pc.ID] = true
+		if pc.Name == "" || pc.ClientID == "" || pc.RedirectURL == "" {
+			return nil, fmt.Errorf("provider %q needs a name, client_id and redirect_url", pc.ID)
+		}
+		if pc.ClientSecret == "" && pc.ClientSecretKey != "" {
+			pc.ClientSecret = secret(pc.ClientSecretKey)
+		}
+
+		impl, err := newProvider(pc)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", pc.ID, err)
+		}
+		p := &registeredProvider{ProviderConfig: pc, impl: impl}
+
+		// two providers returning records from the same source would
+		// overwrite each other in a session
+		if other, ok := sources[impl.Source()]; ok {
+			return nil, fmt.Errorf("providers %q and %q are both %s providers; only one is allowed", other, pc.ID, pc.Type)
+		}
+		sources[impl.Source()] = pc.ID
+		for _, path := range p.callbackPaths() {
+			if other, ok := paths[path]; ok {
+				return nil, fmt.Errorf("providers %q and %q both have their callback at %s", other, pc.ID, path)
+			}
+			paths[path] = pc.ID
+		}
+
+		if pc.Type == providerSMART {
+			record.RegisterSourceName(impl.Source(), pc.Name)
+		}
+		reg.providers = append(reg.providers, p)
+	}
+	return reg, nil
+}
+
+// UsePersonas has Blue Button providers show the doses of the persona with a
+// user's FhirID, if there is one, in place of their claims
+func (reg *Registry) UsePersonas(personas *PersonaCatalog) {
+	for _, rp := range reg.providers {
+		if bb, ok := rp.impl.(*bbProvider); ok {
+			bb.personas = personas
+		}
+	}
+}
+
+// LoadProviders reads a json list of ProviderConfigs. Environment variables
+// in the file, like ${BB_CLIENT_ID}, are expanded, so one file can serve every
+// environment.
+func LoadProviders(r io.Reader, secret func(key string) string) (*Registry, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ProviderConfig
+	err = json.Unmarshal([]byte(os.ExpandEnv(string(b))), &configs)
+	if err != nil {
+		return nil, fmt.Errorf("reading providers: %w", err)
+	}
+	return NewRegistry(configs, secret)
+}
+
+func newProvider(pc ProviderConfig) (Provider, error) {
+	switch pc.Type {
+	case providerBlueButton:
+		if pc.AuthURL == "" {
+			return nil, fmt.Errorf("blue button needs an auth_url")
+		}
+		return &bbProvider{client: bluebutton.Client{
+			BBClientID:     pc.ClientID,
+			BBClientSecret: pc.ClientSecret,
+			BBURL:          pc.AuthURL,
+			CallbackURL:    pc.RedirectURL,
+		}}, nil
+	case providerLighthouse:
+		if pc.AuthURL == "" || pc.FhirURL == "" {
+			return nil, fmt.Errorf("va lighthouse needs an auth_url and fhir_url")
+		}
+		scopes := pc.Scopes
+		if scopes == "" {
+			scopes = vaScopes
+		}
+		return &vaProvider{scopes: scopes, client: &lighthouse.Client{
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			URL:          pc.AuthURL,
+			FhirURL:      pc.FhirURL,
+			CallbackURL:  pc.RedirectURL,
+		}}, nil
+	case providerSMART:
+		if pc.FhirURL == "" {
+			return nil, fmt.Errorf("smart health systems need a fhir_url")
+		}
+		return &smartProvider{client: &smart.Client{
+			ID:           pc.ID,
+			Name:         pc.Name,
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			FhirURL:      pc.FhirURL,
+			CallbackURL:  pc.RedirectURL,
+			Scopes:       pc.Scopes,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", pc.Type)
+	}
+}
+
+// Enabled returns the providers that are in service
+func (reg *Registry) Enabled() []*registeredProvider {
+	var enabled []*registeredProvider
+	for _, p := range reg.providers {
+		if p.enabled() {
+			enabled = append(enabled, p)
+		}
+	}
+	return enabled
+}
+
+// bySource returns the provider whose records have the given source, whether
+// or not it's enabled; a provider taken out of service may still have tokens
+// to revoke
+func (reg *Registry) bySource(source string) (*registeredProvider, bool) {
+	for _, p := range reg.providers {
+		if p.impl.Source() == source {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Links returns a connect button for each enabled provider whose source isn't
+// in sources
+func (reg *Registry) Links(sources map[string]*record.Record) []providerLink {
+	var links []providerLink
+	for _, p := range reg.Enabled() {
+		if _, ok := sources[p.impl.Source()]; ok {
+			continue
+		}
+		links = append(links, providerLink{Name: p.Name, Logo: p.Logo, URL: p.startPath()})
+	}
+	return links
+}
+
+func (reg *Registry) String() string {
+	var s string
+	for _, p := range reg.providers {
+		status := "enabled"
+		if !p.enabled() {
+			status = "disabled"
+		}
+		s += fmt.Sprintf("\n\tprovider %s (%s, %s): %s", p.ID, p.Type, status, p.impl)
+	}
+	return s
+}
+
+// bbProvider loads records from Medicare claims through Blue Button
+// https://bluebutton.cms.gov/developers/#client-application-flow
+type bbProvider struct {
+	client bluebutton.Client
+	// personas stand in for the claims of sandbox users with their FhirID
+	personas *PersonaCatalog
+}
+
+func (p *bbProvider) String() string { return p.client.String() }
+
+func (p *bbProvider) Source() string { return record.SourceBlueButton }
+
+func (p *bbProvider) AuthURL(state string) (string, error) {
+	return p.client.AuthURL(state), nil
+}
+
+func (p *bbProvider) FetchRecord(code, state string, fetched func(resource string)) (*record.Record, Tokens, error) {
+	fullToken, err := p.client.GetFullToken(code)
+	if err != nil {
+		log.Printf("error getting full token: %s", err)
+		return nil, Tokens{}, err
+	}
+	tokens := newTokens(fullToken.AccessToken, fullToken.RefreshToken)
+
+	user, err := p.client.GetUserInfo(fullToken.AccessToken)
+	log.Printf("%#v", user)
+	if err != nil {
+		log.Printf("error getting user: %s", err)
+		return nil, tokens, err
+	}
+
+	patient, err := p.client.GetPatient(user.FhirID, fullToken.AccessToken)
+	log.Printf("%#v", patient)
+	if err != nil {
+		log.Printf("error getting patient: %s", err)
+		return nil, tokens, err
+	}
+	fetched("Patient")
+
+	// For demos, some sandbox users are stood in for by a persona, whose doses
+	// we show instead of their claims
+	var vaxes []bluebutton.Vaccination
+	var tests []bluebutton.LabTest
+	if persona, ok := p.personas.ByFhirID(user.FhirID); ok {
+		log.Printf("showing persona %s for %s", persona.ID, user.FhirID)
+		vaxes = persona.Vaccinations()
+	} else {
+		// XXX: in real life we should probably show the user a "you have
+		// successfully loaded" page, show a spinner, and say "checking vaccination
+		// records..." or something alike
+		vaxes, tests, err = p.client.FindCovidClaims(fullToken.AccessToken, user.FhirID, record.IsTestCode)
+		if err != nil {
+			log.Printf("error getting eob: %s", err)
+			return nil, tokens, err
+		}
+		fetched("ExplanationOfBenefit")
+	}
+
+	log.Printf("vaxes: %v", vaxes)
+	rec := record.FromBlueButton(patient, vaxes)
+	rec.Tests = record.BlueButtonTests(tests)
+	rec.Patient.ID = user.FhirID
+	return rec, tokens, nil
+}
+
+// Revoke revokes the access token. Blue Button revokes the grant along with
+// it, so the refresh token stops working too.
+func (p *bbProvider) Revoke(t Tokens) error {
+	return p.client.RevokeToken(t.Access)
+}
+
+// vaProvider loads records from VA Lighthouse
+// https://developer.va.gov/explore/health/docs/authorization
+// https://github.com/department-of-veterans-affairs/vets-api-clients/blob/master/test_accounts.md
+type vaProvider struct {
+	client *lighthouse.Client
+	scopes string
+}
+
+func (p *vaProvider) String() string { return p.client.String() }
+
+func (p *vaProvider) Source() string { return record.SourceLighthouse }
+
+func (p *vaProvider) AuthURL(state string) (string, error) {
+	return p.client.AuthURL(p.scopes, state)
+}
+
+func (p *vaProvider) FetchRecord(code, state string, fetched func(resource string)) (*record.Record, Tokens, error) {
+	fullToken, err := p.client.GetFullToken(code, state)
+	if err != nil {
+		log.Printf("error getting full token: %s", err)
+		return nil, Tokens{}, err
+	}
+	tokens := newTokens(fullToken.AccessToken, fullToken.RefreshToken)
+
+	patient, err := p.client.GetPatient(fullToken.AccessToken, fullToken.PatientID)
+	log.Printf("%#v", patient)
+	if err != nil {
+		log.Printf("error getting user: %s", err)
+		return nil, tokens, vaError(err)
+	}
+	fetched("Patient")
+
+	vaxes, err := p.client.GetVaccinations(fullToken.AccessToken, fullToken.PatientID)
+	log.Printf("%#v", vaxes)
+	if err != nil {
+		log.Printf("error getting vaccinations: %s", err)
+		return nil, tokens, vaError(err)
+	}
+	fetched("Immunization")
+
+	rec := record.FromLighthouse(patient, vaxes)
+
+	// test results are extra, so the card is still shown without them
+	labs, err := p.client.GetLabResults(fullToken.AccessToken, fullToken.PatientID, record.IsTestCode)
+	if err != nil {
+		log.Printf("error getting lab results, showing the card without them: %s", err)
+	} else {
+		fetched("Observation")
+		rec.Tests = record.LighthouseTests(labs)
+	}
+	rec.Patient.ID = fullToken.PatientID
+	return rec, tokens, nil
+}
+
+// vaError explains the VA errors the user can do something about
+func vaError(err error) error {
+	switch {
+	case errors.Is(err, lighthouse.ErrTokenRejected):
+		return &messageError{key: "error.vaLoginExpired", err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &messageError{key: "error.vaTimeout", err: err}
+	}
+	return err
+}
+
+// Revoke revokes the refresh token first, so a new access token can't be
+// minted while we revoke the old one
+func (p *vaProvider) Revoke(t Tokens) error {
+	return revokeRFC7009(p.client.RevokeToken, t)
+}
+
+// smartProvider loads records from a SMART on FHIR health system
+type smartProvider struct {
+	client *smart.Client
+}
+
+func (p *smartProvider) String() string { return p.client.String() }
+
+func (p *smartProvider) Source() string { return record.SourceSMART(p.client.ID) }
+
+func (p *smartProvider) AuthURL(state string) (string, error) {
+	return p.client.AuthURL(state)
+}
+
+func (p *smartProvider) FetchRecord(code, state string, fetched func(resource string)) (*record.Record, Tokens, error) {
+	fullToken, err := p.client.GetFullToken(code)
+	if err != nil {
+		log.Printf("error getting full token from %s: %s", p.client.ID, err)
+		return nil, Tokens{}, err
+	}
+	tokens := newTokens(fullToken.AccessToken, fullToken.RefreshToken)
+
+	patient, err := p.client.GetPatient(fullToken.AccessToken, fullToken.PatientID)
+	if err != nil {
+		log.Printf("error getting patient from %s: %s", p.client.ID, err)
+		return nil, tokens, err
+	}
+	fetched("Patient")
+
+	vaxes, err := p.client.GetVaccinations(fullToken.AccessToken, fullToken.PatientID)
+	if err != nil {
+		log.Printf("error getting immunizations from %s: %s", p.client.ID, err)
+		return nil, tokens, err
+	}
+	fetched("Immunization")
+	rec := record.FromSMART(p.client.ID, patient, vaxes)
+	rec.Patient.ID = fullToken.PatientID
+	return rec, tokens, nil
+}
+
+func (p *smartProvider) Revoke(t Tokens) error {
+	return revokeRFC7009(p.client.RevokeToken, t)
+}
+
+// revokeRFC7009 revokes the refresh token, if there is one, and then the
+// access token, with an RFC 7009 revoke function
+// https://tools.ietf.org/html/rfc7009#section-2.1
+func revokeRFC7009(revoke func(token, hint string) error, t Tokens) error {
+	if t.Refresh != "" {
+		if err := revoke(t.Refresh, "refresh_token"); err != nil {
+			return err
+		}
+	}
+	return revoke(t.Access, "access_token")
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testProviders = `[{
+	"id": "bluebutton",
+	"type": "bluebutton",
+	"name": "Blue Button",
+	"auth_url": "https://sandbox.bluebutton.cms.gov",
+	"client_id": "${TEST_BB_CLIENT_ID}",
+	"client_secret_key": "BB_CLIENT_SECRET",
+	"redirect_url": "https://localhost.dev:6655/bbcallback"
+}, {
+	"id": "lighthouse",
+	"type": "lighthouse",
+	"name": "VA Lighthouse",
+	"logo": "/static/va.png",
+	"auth_url": "https://sandbox-api.va.gov",
+	"fhir_url": "https://sandbox-api.va.gov/services/fhir/v0/r4",
+	"client_id": "va-client",
+	"redirect_url": "https://localhost.dev:6655/callback"
+}, {
+	"id": "valley",
+	"type": "smart",
+	"name": "Valley Medical",
+	"enabled": false,
+	"fhir_url": "https://fhir.valley.example/r4",
+	"client_id": "covidrecord",
+	"redirect_url": "https://localhost.dev:6655/auth/valley/callback"
+}]`
+
+// newTestServer returns a server with the providers in testProviders
+func newTestServer(t *testing.T) *CovidRecord {
+	t.Helper()
+	os.Setenv("TEST_BB_CLIENT_ID", "bb-client")
+	defer os.Unsetenv("TEST_BB_CLIENT_ID")
+	reg, err := LoadProviders(strings.NewReader(testProviders), func(key string) string {
+		return "secret for " + key
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CovidRecord{Sessions: NewSessionStore(time.Minute), Providers: reg}
+}
+
+func TestLoadProviders(t *testing.T) {
+	server := newTestServer(t)
+
+	links := server.Providers.Links(nil)
+	if len(links) != 2 {
+		t.Fatalf("expected the disabled provider to be left out, got %#v", links)
+	}
+	if links[0].URL != "/auth/bluebutton/start" || links[1].Logo != "/static/va.png" {
+		t.Errorf("unexpected links %#v", links)
+	}
+
+	bb := server.Providers.Enabled()[0].impl.(*bbProvider)
+	if bb.client.BBClientID != "bb-client" || bb.client.BBClientSecret != "secret for BB_CLIENT_SECRET" {
+		t.Errorf("expected the client id from the environment and the secret from the secret store, got %#v", bb.client)
+	}
+
+	w := httptest.NewRecorder()
+	server.defaultHandler(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "Connect with Blue Button") || strings.Contains(body, "Valley Medical") {
+		t.Errorf("expected a button for each enabled provider, got %s", body)
+	}
+}
+
+func TestLoadProvidersErrors(t *testing.T) {
+	provider := func(id, typ, extra string) string {
+		return fmt.Sprintf(`{"id": %q, "type": %q, "name": "x", "client_id": "x", "auth_url": "https://x", "fhir_url": "https://x", "redirect_url": "https://localhost.dev/auth/%s/callback"%s}`, id, typ, id, extra)
+	}
+	for _, bad := range []string{
+		`[` + provider("Blue Button", "bluebutton", "") + `]`,
+		`[` + provider("bb", "carrier-pigeon", "") + `]`,
+		`[` + provider("bb", "bluebutton", "") + `,` + provider("bb", "lighthouse", "") + `]`,
+		`[` + provider("bb", "bluebutton", "") + `,` + provider("bb2", "bluebutton", "") + `]`,
+		`[` + provider("va", "lighthouse", `, "redirect_url": ""`) + `]`,
+	} {
+		if _, err := LoadProviders(strings.NewReader(bad), func(string) string { return "" }); err == nil {
+			t.Errorf("expected an error loading %s", bad)
+		}
+	}
+}
+
+func TestAuthRoutes(t *testing.T) {
+	handler := newTestServer(t).Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/bluebutton/start", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Host != "sandbox.bluebutton.cms.gov" || loc.Query().Get("client_id") != "bb-client" {
+		t.Errorf("unexpected authorization url %s", loc)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookie || cookies[0].Value != loc.Query().Get("state") {
+		t.Fatalf("expected the state to be kept in a cookie, got %v and %s", cookies, loc)
+	}
+
+	// a callback whose state doesn't match the cookie is refused, at both of
+	// the provider's callback paths
+	for _, path := range []string{"/bbcallback", "/auth/bluebutton/callback"} {
+		r := httptest.NewRequest("GET", path+"?code=abc&state=forged", nil)
+		r.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "expired or didn") {
+			t.Errorf("expected a forged state to be refused at %s, got %d", path, w.Code)
+		}
+	}
+
+	// the disabled provider has no routes
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/valley/start", nil))
+	if w.Code == http.StatusFound {
+		t.Errorf("expected a disabled provider not to have a start route")
+	}
+}
+
+func TestAuthStateCookie(t *testing.T) {
+	server, _, _ := newRevocationServer()
+	handler := server.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "https://localhost.dev/auth/fake/start", nil))
+	state := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest("GET", "https://localhost.dev/auth/fake/callback?code=abc&state="+state.Value, nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	// the state is cleared with the same attributes it was set with
+	for _, c := range w.Result().Cookies() {
+		if c.Name != stateCookie {
+			continue
+		}
+		if c.MaxAge >= 0 || c.Path != "/" || !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+			t.Errorf("expected the state cookie to be cleared like it was set, got %#v", c)
+		}
+		return
+	}
+	t.Errorf("expected the state cookie to be cleared")
+}
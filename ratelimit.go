@@ -0,0 +1,246 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: a client can make Burst requests at once, and then
+// one more every Every
+type Limit struct {
+	Every time.Duration
+	Burst int
+}
+
+// The limits on each client. A real login costs several calls to the
+// provider with our credentials, so it's limited the most.
+var (
+	callbackLimit = Limit{Every: 6 * time.Second, Burst: 10}
+	demoLimit     = Limit{Every: time.Second, Burst: 20}
+)
+
+// The defaults for the number of records we fetch from providers at once,
+// across every user, and how long a login waits for its turn before we give up
+const (
+	defaultMaxFetches = 20
+	fetchWait         = 10 * time.Second
+)
+
+// purgeEvery is how often we forget the clients whose buckets have refilled
+const purgeEvery = time.Minute
+
+type bucketKey struct {
+	route, client string
+}
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits how often each client can use a route, and how many
+// records are being fetched from providers at once
+type RateLimiter struct {
+	// TrustedProxies are the proxies in front of us, like App Engine's front
+	// end, whose X-Forwarded-For we believe
+	TrustedProxies []*net.IPNet
+
+	fetches chan struct{}
+	now     func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastPurge time.Time
+}
+
+// NewRateLimiter returns a limiter that lets maxFetches records be fetched at
+// once
+func NewRateLimiter(maxFetches int, trustedProxies []*net.IPNet) *RateLimiter {
+	return &RateLimiter{
+		TrustedProxies: trustedProxies,
+		fetches:        make(chan struct{}, maxFetches),
+		now:            time.Now,
+		buckets:        map[bucketKey]*bucket{},
+	}
+}
+
+// ParseTrustedProxies parses a comma separated list of networks, like
+// "169.254.0.0/16,35.191.0.0/16". A bare address is a network of one.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", field)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (l *RateLimiter) trusted(ip net.IP) bool {
+	for _, n := range l.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address of the client that made r. If it came through our
+// trusted proxies, that's the last address in X-Forwarded-For that isn't one
+// of them; anything before it could have been made up by the client.
+func (l *RateLimiter) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !l.trusted(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Allow takes a token from the client's bucket for route. If it's empty, it
+// returns false and how long until there's a token again.
+func (l *RateLimiter) Allow(route, client string, limit Limit) (bool, time.Duration) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPurge) > purgeEvery {
+		l.purge(now)
+	}
+
+	key := bucketKey{route, client}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) * float64(limit.Every))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.limit.Every > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.limit.Every)
+	}
+	b.tokens = math.Min(b.tokens, float64(b.limit.Burst))
+	b.last = now
+}
+
+// purge forgets the buckets that have refilled, since they're no different to
+// a new one. Must be called with l.mu held.
+func (l *RateLimiter) purge(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPurge = now
+}
+
+// startFetch waits for a turn to fetch a record from a provider, and returns
+// the function to call when it's done. It returns false if there's no turn
+// before ctx is done or fetchWait is up.
+func (l *RateLimiter) startFetch(ctx context.Context) (func(), bool) {
+	done := func() { <-l.fetches }
+	select {
+	case l.fetches <- struct{}{}:
+		return done, true
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchWait)
+	defer cancel()
+	select {
+	case l.fetches <- struct{}{}:
+		return done, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// rateLimit limits how often each client can call f, to limit for route.
+// Clients over the limit get a 429.
+func (c *CovidRecord) rateLimit(route string, limit Limit, f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.Limiter == nil {
+			f(w, r)
+			return
+		}
+		if ok, wait := c.Limiter.Allow(route, c.Limiter.ClientIP(r), limit); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			renderError(w, r, http.StatusTooManyRequests, errors.New(catalog(r).T("error.tooManyRequests")))
+			return
+		}
+		f(w, r)
+	}
+}
+
+// startFetch waits for a turn to fetch a record from a provider, if the
+// number of fetches at once is limited
+func (c *CovidRecord) startFetch(ctx context.Context) (func(), bool) {
+	if c.Limiter == nil {
+		return func() {}, true
+	}
+	return c.Limiter.startFetch(ctx)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(1, nil)
+	l.now = func() time.Time { return now }
+	limit := Limit{Every: time.Second, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("callback", "1.2.3.4", limit); !ok {
+			t.Fatalf("expected request %d to be allowed", i+1)
+		}
+	}
+	if ok, wait := l.Allow("callback", "1.2.3.4", limit); ok || wait != time.Second {
+		t.Errorf("expected the bucket to be empty for a second, got %v %v", ok, wait)
+	}
+	// other clients and routes have their own buckets
+	if ok, _ := l.Allow("callback", "5.6.7.8", limit); !ok {
+		t.Errorf("expected another client to be allowed")
+	}
+	if ok, _ := l.Allow("showCallback", "1.2.3.4", limit); !ok {
+		t.Errorf("expected another route to be allowed")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, wait := l.Allow("callback", "1.2.3.4", limit); ok || wait != 500*time.Millisecond {
+		t.Errorf("expected to wait another half second, got %v %v", ok, wait)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("callback", "1.2.3.4", limit); !ok {
+		t.Errorf("expected a token after a second")
+	}
+
+	// full buckets are forgotten
+	now = now.Add(time.Hour)
+	l.Allow("callback", "9.9.9.9", limit)
+	if len(l.buckets) != 1 {
+		t.Errorf("expected the idle clients to be purged, have %d buckets", len(l.buckets))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("169.254.0.0/16, 35.191.0.0/16,10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewRateLimiter(1, proxies)
+
+	tests := []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "1.2.3.4:5678", "", "1.2.3.4"},
+		{"untrusted proxy", "1.2.3.4:5678", "5.6.7.8", "1.2.3.4"},
+		{"front end", "169.254.1.1:80", "5.6.7.8, 35.191.2.3", "5.6.7.8"},
+		{"spoofed", "169.254.1.1:80", "6.6.6.6, 5.6.7.8, 35.191.2.3", "5.6.7.8"},
+		{"single address", "10.0.0.1:80", "5.6.7.8", "5.6.7.8"},
+		{"garbage", "169.254.1.1:80", "bogus, 35.191.2.3", "35.191.2.3"},
+		{"no header", "169.254.1.1:80", "", "169.254.1.1"},
+		{"ipv6", "[2001:db8::1]:443", "5.6.7.8", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/callback", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := l.ClientIP(r); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/99"); err == nil {
+		t.Errorf("expected an invalid network to be rejected")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := &CovidRecord{Sessions: NewSessionStore(time.Minute), Limiter: NewRateLimiter(1, nil)}
+	handler := server.rateLimit("showCallback", Limit{Every: time.Minute, Burst: 1}, server.staticCallback)
+
+	serve := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/showCallback", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := serve("1.2.3.4:1000"); w.Code != 200 {
+		t.Fatalf("expected the first request to be served, got %d", w.Code)
+	}
+	w := serve("1.2.3.4:1001")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected a 429 for a minute, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "Error occurred") {
+		t.Errorf("expected the error page, got %s", w.Body)
+	}
+	if w := serve("5.6.7.8:1000"); w.Code != 200 {
+		t.Errorf("expected another client to be served, got %d", w.Code)
+	}
+}
+
+func TestStartFetch(t *testing.T) {
+	l := NewRateLimiter(1, nil)
+	done, ok := l.startFetch(context.Background())
+	if !ok {
+		t.Fatal("expected a turn to fetch")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := l.startFetch(ctx); ok {
+		t.Errorf("expected to wait while another fetch is running")
+	}
+
+	done()
+	if _, ok := l.startFetch(ctx); !ok {
+		t.Errorf("expected a turn once the other fetch finished")
+	}
+}
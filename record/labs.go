@@ -0,0 +1,275 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+	"github.com/adhocteam/covidreport/lighthouse"
+)
+
+// TestKind is the kind of covid test
+type TestKind string
+
+const (
+	// TestMolecular is a PCR or other nucleic acid amplification test
+	TestMolecular TestKind = "molecular"
+	TestAntigen   TestKind = "antigen"
+	// TestAntibody tests show a past infection, but venues don't accept them
+	// as proof of recovery
+	TestAntibody TestKind = "antibody"
+)
+
+// TestOutcome is the result of a covid test
+type TestOutcome string
+
+const (
+	OutcomePositive TestOutcome = "positive"
+	OutcomeNegative TestOutcome = "negative"
+	// OutcomeUnknown is a test we know was done, from a claim, but not the
+	// result of
+	OutcomeUnknown TestOutcome = "unknown"
+)
+
+// TestResult is a single covid test
+type TestResult struct {
+	Date     Date        `json:"date"`
+	Code     string      `json:"code"`
+	Display  string      `json:"display,omitempty"`
+	Kind     TestKind    `json:"kind"`
+	Outcome  TestOutcome `json:"outcome"`
+	Location string      `json:"location,omitempty"`
+	Source   string      `json:"source"`
+}
+
+// testCodes maps the LOINC codes in FHIR Observations, and the CPT/HCPCS codes
+// in Blue Button claims, to the kind of test they represent. The VA returns
+// every lab result the veteran has had, and Blue Button every claim, so these
+// are how we pick out the covid tests.
+// https://loinc.org/sars-cov-2-and-covid-19/
+// https://www.cms.gov/files/document/covid-19-laboratory-billing-codes.pdf
+var testCodes = map[string]TestKind{
+	"94309-2": TestMolecular, // RNA, NAA with probe, specimen
+	"94500-6": TestMolecular, // RNA, NAA with probe, respiratory specimen
+	"94502-2": TestMolecular, // RNA, NAA with probe, respiratory specimen, pooled
+	"94531-1": TestMolecular, // RNA panel, NAA with probe, respiratory specimen
+	"94533-7": TestMolecular, // N gene, NAA with probe, respiratory specimen
+	"94534-5": TestMolecular, // RdRp gene, NAA with probe, respiratory specimen
+	"94559-2": TestMolecular, // ORF1ab region, NAA with probe, respiratory specimen
+	"94756-4": TestMolecular, // RNA, NAA with non-probe detection, respiratory specimen
+	"94757-2": TestMolecular, // RNA, NAA with non-probe detection, nasopharynx
+	"94845-5": TestMolecular, // RNA, NAA with probe, saliva
+	"95406-5": TestMolecular, // RNA, NAA with probe, nose
+	"94558-4": TestAntigen,   // antigen, rapid immunoassay, respiratory specimen
+	"95209-3": TestAntigen,   // antigen, rapid immunoassay, respiratory specimen
+	"96119-3": TestAntigen,   // antigen, immunoassay, upper respiratory specimen
+	"94563-4": TestAntibody,  // IgG antibody
+	"94564-2": TestAntibody,  // IgM antibody
+	"94762-2": TestAntibody,  // antibody
+	"94769-7": TestAntibody,  // antibody, rapid immunoassay
+	"U0001":   TestMolecular, // CDC 2019 Novel Coronavirus (2019-nCoV) Real-Time RT-PCR Diagnostic Panel
+	"U0002":   TestMolecular, // 2019-nCoV Coronavirus, SARS-CoV-2/2019-nCoV (COVID-19), any technique, non-CDC
+	"U0003":   TestMolecular, // high throughput amplified probe technique
+	"U0004":   TestMolecular, // high throughput amplified probe technique, non-CDC
+	// U0005 is billed along with U0003 or U0004 when the result came back
+	// within two days, so it's the same test
+	"U0005": TestMolecular,
+	"87635": TestMolecular, // SARS-CoV-2 amplified probe technique
+}
+
+// LookupTest finds the kind of test for a LOINC, CPT or HCPCS code
+func LookupTest(code string) (TestKind, bool) {
+	kind, ok := testCodes[code]
+	return kind, ok
+}
+
+// IsTestCode reports whether a LOINC, CPT or HCPCS code is for a covid test.
+// The clients use it to pick the tests out of the labs and claims.
+func IsTestCode(code string) bool {
+	_, ok := testCodes[code]
+	return ok
+}
+
+// outcomes maps the SNOMED codes and interpretation codes labs report results
+// with to an outcome
+var outcomes = map[string]TestOutcome{
+	"260373001": OutcomePositive, // Detected
+	"10828004":  OutcomePositive, // Positive
+	"260415000": OutcomeNegative, // Not detected
+	"260385009": OutcomeNegative, // Negative
+	"POS":       OutcomePositive,
+	"DET":       OutcomePositive,
+	"A":         OutcomePositive,
+	"NEG":       OutcomeNegative,
+	"ND":        OutcomeNegative,
+	"N":         OutcomeNegative,
+}
+
+// parseOutcome works out a lab's result from the coded value, the
+// interpretation, or failing those the text of the value
+func parseOutcome(value, interpretation, text string) TestOutcome {
+	for _, code := range []string{value, interpretation} {
+		if outcome, ok := outcomes[code]; ok {
+			return outcome
+		}
+	}
+	switch t := strings.ToLower(strings.TrimSpace(text)); {
+	case strings.HasPrefix(t, "not detected"), strings.HasPrefix(t, "negative"):
+		return OutcomeNegative
+	case strings.HasPrefix(t, "detected"), strings.HasPrefix(t, "positive"):
+		return OutcomePositive
+	}
+	return OutcomeUnknown
+}
+
+// sameTest reports whether a and b are the same test, as reported by two
+// claim lines or two sources. Tests with different results are different
+// tests, even on the same day, unless one of them is a claim that doesn't
+// have the result.
+func sameTest(a, b TestResult) bool {
+	if a.Outcome != b.Outcome && a.Outcome != OutcomeUnknown && b.Outcome != OutcomeUnknown {
+		return false
+	}
+	return daysApart(a.Date, b.Date) <= DuplicateDays && a.Kind == b.Kind
+}
+
+// addTest adds a test to a list, unless it's already there. If it is, we keep
+// whichever report has the result.
+func addTest(tests []TestResult, test TestResult) []TestResult {
+	for i := range tests {
+		if sameTest(tests[i], test) {
+			if tests[i].Outcome == OutcomeUnknown && test.Outcome != OutcomeUnknown {
+				tests[i] = test
+			}
+			return tests
+		}
+	}
+	return append(tests, test)
+}
+
+func sortTests(tests []TestResult) {
+	sort.SliceStable(tests, func(i, j int) bool {
+		return tests[i].Date.Before(tests[j].Date.Time)
+	})
+}
+
+// BlueButtonTests normalizes the covid tests found in Blue Button claims.
+// Claims don't say what the result was.
+func BlueButtonTests(labs []bluebutton.LabTest) []TestResult {
+	var tests []TestResult
+	for _, lab := range labs {
+		kind, ok := LookupTest(lab.Code)
+		if !ok {
+			continue
+		}
+		tests = addTest(tests, TestResult{
+			Date:    Date{lab.Date},
+			Code:    lab.Code,
+			Display: lab.Display,
+			Kind:    kind,
+			Outcome: OutcomeUnknown,
+			Source:  SourceBlueButton,
+		})
+	}
+	sortTests(tests)
+	return tests
+}
+
+// LighthouseTests normalizes the covid lab results from VA Lighthouse
+func LighthouseTests(labs []lighthouse.LabResult) []TestResult {
+	var tests []TestResult
+	for _, lab := range labs {
+		kind, ok := LookupTest(lab.Code)
+		if !ok {
+			continue
+		}
+		tests = addTest(tests, TestResult{
+			Date:     Date{lab.Date},
+			Code:     lab.Code,
+			Display:  lab.Display,
+			Kind:     kind,
+			Outcome:  parseOutcome(lab.Value, lab.Interpretation, lab.ValueText),
+			Location: lab.Performer,
+			Source:   SourceLighthouse,
+		})
+	}
+	sortTests(tests)
+	return tests
+}
+
+// How long a test result is accepted. A negative test is accepted for a day
+// or three depending on the kind, and recovery from 11 days after a positive
+// molecular test for 180 days, like the EU Digital COVID Certificate.
+const (
+	negativeMolecularValidity = 72 * time.Hour
+	negativeAntigenValidity   = 24 * time.Hour
+	recoveryStartDays         = 11
+	recoveryDays              = 180
+)
+
+// TestSummary is what a record's tests say about the patient, as of a given
+// time
+type TestSummary struct {
+	// Latest is the most recent viral test, if there is one
+	Latest *TestResult
+	// NegativeUntil is when the latest test stops being accepted, if it was a
+	// negative viral test that's still accepted
+	NegativeUntil time.Time
+	// Recovered is set if a positive molecular test documents recovery from
+	// RecoveredFrom until RecoveredUntil
+	Recovered      bool
+	RecoveredFrom  Date
+	RecoveredUntil Date
+}
+
+// EvaluateTests summarizes the tests, in date order, as of now
+func EvaluateTests(tests []TestResult, now time.Time) TestSummary {
+	var summary TestSummary
+	for i := len(tests) - 1; i >= 0; i-- {
+		test := tests[i]
+		if test.Kind == TestAntibody || test.Date.After(now) {
+			continue
+		}
+		if summary.Latest == nil {
+			summary.Latest = &tests[i]
+			if test.Outcome == OutcomeNegative {
+				validity := negativeMolecularValidity
+				if test.Kind == TestAntigen {
+					validity = negativeAntigenValidity
+				}
+				if until := test.Date.Add(validity); now.Before(until) {
+					summary.NegativeUntil = until
+				}
+			}
+		}
+		if test.Kind == TestMolecular && test.Outcome == OutcomePositive && !summary.Recovered {
+			from := test.Date.AddDate(0, 0, recoveryStartDays)
+			until := test.Date.AddDate(0, 0, recoveryDays)
+			if !now.Before(from) && now.Before(until) {
+				summary.Recovered = true
+				summary.RecoveredFrom = Date{from}
+				summary.RecoveredUntil = Date{until}
+			}
+		}
+	}
+	return summary
+}
+
+// TestSummary summarizes the record's tests as of now
+func (r *Record) TestSummary(now time.Time) TestSummary {
+	return EvaluateTests(r.Tests, now)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+	"github.com/adhocteam/covidreport/lighthouse"
+)
+
+func TestLighthouseTests(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 9, d, 14, 0, 0, 0, time.UTC) }
+	tests := LighthouseTests([]lighthouse.LabResult{
+		{Date: day(3), Code: "94500-6", Value: "260373001", ValueText: "Detected"},
+		{Date: day(1), Code: "95209-3", Interpretation: "NEG"},
+		{Date: day(5), Code: "94563-4", ValueText: "Positive"},
+		{Date: day(7), Code: "94500-6", ValueText: "Inconclusive"},
+		{Date: day(9), Code: "4548-4", ValueText: "6.1"},
+	})
+
+	want := []struct {
+		kind    TestKind
+		outcome TestOutcome
+	}{
+		{TestAntigen, OutcomeNegative},
+		{TestMolecular, OutcomePositive},
+		{TestAntibody, OutcomePositive},
+		{TestMolecular, OutcomeUnknown},
+	}
+	if len(tests) != len(want) {
+		t.Fatalf("expected %d covid tests in date order, got %#v", len(want), tests)
+	}
+	for i, w := range want {
+		if tests[i].Kind != w.kind || tests[i].Outcome != w.outcome || tests[i].Source != SourceLighthouse {
+			t.Errorf("test %d: expected a %s %s test, got %#v", i, w.outcome, w.kind, tests[i])
+		}
+	}
+}
+
+func TestBlueButtonTests(t *testing.T) {
+	date := time.Date(2021, 8, 30, 0, 0, 0, 0, time.UTC)
+	tests := BlueButtonTests([]bluebutton.LabTest{
+		{Date: date, Code: "U0003"},
+		{Date: date, Code: "U0005"},
+		{Date: date.AddDate(0, 1, 0), Code: "87635"},
+		{Date: date, Code: "99213", Display: "Office outpatient visit 15 minutes"},
+	})
+	if len(tests) != 2 {
+		t.Fatalf("expected the add-on to be counted with its test and the visit left out, got %#v", tests)
+	}
+	if tests[0].Code != "U0003" || tests[0].Outcome != OutcomeUnknown {
+		t.Errorf("unexpected test %#v", tests[0])
+	}
+}
+
+func TestMergeTests(t *testing.T) {
+	date := Date{time.Date(2021, 8, 30, 0, 0, 0, 0, time.UTC)}
+	claim := &Record{Tests: []TestResult{{Date: date, Code: "U0003", Kind: TestMolecular, Outcome: OutcomeUnknown, Source: SourceBlueButton}}}
+	va := &Record{Tests: []TestResult{{Date: Date{date.Add(14 * time.Hour)}, Code: "94500-6", Kind: TestMolecular, Outcome: OutcomeNegative, Source: SourceLighthouse}}}
+
+	merged := Merge(claim, va)
+	if len(merged.Tests) != 1 || merged.Tests[0].Outcome != OutcomeNegative {
+		t.Errorf("expected the VA's result to replace the claim, got %#v", merged.Tests)
+	}
+
+	// a positive retest the same day is another test
+	retest := &Record{Tests: []TestResult{{Date: Date{date.Add(18 * time.Hour)}, Code: "94500-6", Kind: TestMolecular, Outcome: OutcomePositive, Source: SourceLighthouse}}}
+	merged = Merge(merged, retest)
+	if len(merged.Tests) != 2 || merged.Tests[1].Outcome != OutcomePositive {
+		t.Errorf("expected tests with different results to be kept apart, got %#v", merged.Tests)
+	}
+}
+
+func TestEvaluateTests(t *testing.T) {
+	at := func(m time.Month, d, h int) time.Time { return time.Date(2021, m, d, h, 0, 0, 0, time.UTC) }
+	test := func(kind TestKind, outcome TestOutcome, tm time.Time) TestResult {
+		return TestResult{Date: Date{tm}, Kind: kind, Outcome: outcome}
+	}
+	positive := test(TestMolecular, OutcomePositive, at(6, 1, 9))
+	negativePCR := test(TestMolecular, OutcomeNegative, at(9, 20, 9))
+	negativeAntigen := test(TestAntigen, OutcomeNegative, at(9, 20, 9))
+	antibody := test(TestAntibody, OutcomePositive, at(9, 21, 9))
+
+	tests := []struct {
+		name      string
+		tests     []TestResult
+		now       time.Time
+		negative  time.Time
+		recovered bool
+	}{
+		{"none", nil, at(9, 21, 9), time.Time{}, false},
+		{"negative pcr", []TestResult{negativePCR}, at(9, 22, 9), at(9, 23, 9), false},
+		{"expired negative pcr", []TestResult{negativePCR}, at(9, 23, 10), time.Time{}, false},
+		{"negative antigen", []TestResult{negativeAntigen}, at(9, 20, 18), at(9, 21, 9), false},
+		{"expired negative antigen", []TestResult{negativeAntigen}, at(9, 21, 10), time.Time{}, false},
+		{"antibody tests don't count", []TestResult{negativePCR, antibody}, at(9, 22, 9), at(9, 23, 9), false},
+		{"too soon after a positive test", []TestResult{positive}, at(6, 10, 9), time.Time{}, false},
+		{"recovered", []TestResult{positive}, at(6, 12, 9), time.Time{}, true},
+		{"recovered and negative", []TestResult{positive, negativePCR}, at(9, 21, 9), at(9, 23, 9), true},
+		{"recovery expired", []TestResult{positive}, at(11, 28, 9), time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EvaluateTests(tt.tests, tt.now)
+			if !got.NegativeUntil.Equal(tt.negative) {
+				t.Errorf("expected a negative test until %s, got %s", tt.negative, got.NegativeUntil)
+			}
+			if got.Recovered != tt.recovered {
+				t.Errorf("expected recovered %t, got %#v", tt.recovered, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// DuplicateDays is how many calendar days apart two doses of the same product
+// can be and still be considered the same dose. A claim's service date and the
+// VA's administration date can differ by a day, but real doses are weeks apart.
+const DuplicateDays = 1
+
+// sourceNames are the names we show users for each source
+var sourceNames = map[string]string{
+	SourceBlueButton: "Medicare",
+	SourceLighthouse: "VA",
+	SourceDemo:       "Demo",
+}
+
+// RegisterSourceName sets the name we show users for a configured source. It
+// isn't safe to call while requests are being served, so call it at startup.
+func RegisterSourceName(source, name string) {
+	sourceNames[source] = name
+}
+
+// SourceName returns a user-facing name for a source
+func SourceName(source string) string {
+	if name, ok := sourceNames[source]; ok {
+		return name
+	}
+	return source
+}
+
+// Provenance lists the names of the sources that reported the dose, like
+// "VA, Medicare"
+func (d Dose) Provenance() string {
+	sources := d.Sources
+	if len(sources) == 0 {
+		sources = []string{d.Source}
+	}
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = SourceName(source)
+	}
+	return strings.Join(names, ", ")
+}
+
+// sameDose reports whether a and b are the same dose as reported by two
+// sources. If either product is unknown we go by the date alone.
+func sameDose(a, b Dose) bool {
+	if daysApart(a.Date, b.Date) > DuplicateDays {
+		return false
+	}
+	return a.CVX == "" || b.CVX == "" || a.CVX == b.CVX
+}
+
+// daysApart is how many calendar days apart a and b are. A claim only has the
+// day of service, at midnight, so the time of day doesn't count.
+func daysApart(a, b Date) int {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	diff := time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC).Sub(time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC))
+	if diff < 0 {
+		diff = -diff
+	}
+	return int(diff / (24 * time.Hour))
+}
+
+// absorb fills in any details d is missing from a duplicate report of the
+// same dose, and records the duplicate's source
+func (d *Dose) absorb(dup Dose) {
+	for _, f := range []struct{ dst, src *string }{
+		{&d.Display, &dup.Display},
+		{&d.Product, &dup.Product},
+		{&d.Manufacturer, &dup.Manufacturer},
+		{&d.CVX, &dup.CVX},
+		{&d.Location, &dup.Location},
+		{&d.Lot, &dup.Lot},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+	for _, source := range dup.Sources {
+		if !contains(d.Sources, source) {
+			d.Sources = append(d.Sources, source)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge combines records from several sources into one. The patient comes
+// from the first record; doses reported by more than one source are only
+// counted once, but remember every source that reported them. A test reported
+// by more than one source keeps the report with the result.
+func Merge(recs ...*Record) *Record {
+	merged := &Record{}
+	for i, rec := range recs {
+		if i == 0 {
+			merged.Patient = rec.Patient
+		}
+	doses:
+		for _, dose := range rec.Doses {
+			if len(dose.Sources) == 0 {
+				dose.Sources = []string{dose.Source}
+			}
+			for j := range merged.Doses {
+				if sameDose(merged.Doses[j], dose) {
+					merged.Doses[j].absorb(dose)
+					continue doses
+				}
+			}
+			merged.Doses = append(merged.Doses, dose)
+		}
+		for _, test := range rec.Tests {
+			merged.Tests = addTest(merged.Tests, test)
+		}
+	}
+	sortTests(merged.Tests)
+
+	sort.SliceStable(merged.Doses, func(i, j int) bool {
+		return merged.Doses[i].Date.Before(merged.Doses[j].Date.Time)
+	})
+	// a dose's position may have changed, so its role may have too
+	assignRoles(merged.Doses)
+	return merged
+}
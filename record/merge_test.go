@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	day := func(d int) Date { return Date{time.Date(2021, 1, d, 12, 0, 0, 0, time.UTC)} }
+
+	medicare := &Record{
+		Patient: Patient{Name: "Jane Doe", Source: SourceBlueButton},
+		Doses: []Dose{
+			// billed the day after the VA recorded it
+			{Date: day(5), Code: "0011A", CVX: "207", Source: SourceBlueButton},
+		},
+	}
+	va := &Record{
+		Patient: Patient{Name: "JANE DOE", Source: SourceLighthouse},
+		Doses: []Dose{
+			{Date: day(30), Code: "207", CVX: "207", Location: "Hines VA", Source: SourceLighthouse},
+			{Date: day(4), Code: "207", CVX: "207", Location: "Hines VA", Lot: "012L20A", Source: SourceLighthouse},
+		},
+	}
+
+	merged := Merge(medicare, va)
+	if merged.Patient.Name != "Jane Doe" {
+		t.Errorf("expected the patient from the first record, got %#v", merged.Patient)
+	}
+	if len(merged.Doses) != 2 {
+		t.Fatalf("expected the duplicate dose to be merged, got %#v", merged.Doses)
+	}
+
+	first := merged.Doses[0]
+	if first.Source != SourceBlueButton || first.Lot != "012L20A" || first.Location != "Hines VA" {
+		t.Errorf("expected the first dose to be filled in from the VA's copy, got %#v", first)
+	}
+	if first.Provenance() != "Medicare, VA" {
+		t.Errorf("expected both sources, got %s", first.Provenance())
+	}
+	if second := merged.Doses[1]; second.Provenance() != "VA" || second.Date != day(30) {
+		t.Errorf("unexpected second dose %#v", second)
+	}
+}
+
+func TestMergeDifferentProducts(t *testing.T) {
+	day := Date{time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)}
+	a := &Record{Doses: []Dose{{Date: day, CVX: "207", Source: SourceBlueButton}}}
+	b := &Record{Doses: []Dose{{Date: day, CVX: "208", Source: SourceLighthouse}}}
+
+	if merged := Merge(a, b); len(merged.Doses) != 2 {
+		t.Errorf("expected different products on the same day to be kept apart, got %#v", merged.Doses)
+	}
+}
+
+func TestMergeNextDay(t *testing.T) {
+	// billed for the day at midnight, and recorded by the VA the next
+	// afternoon, 40 hours later
+	claim := Date{time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)}
+	given := Date{time.Date(2021, 1, 5, 16, 0, 0, 0, time.UTC)}
+	a := &Record{Doses: []Dose{{Date: claim, CVX: "207", Source: SourceBlueButton}}}
+	b := &Record{Doses: []Dose{{Date: given, CVX: "207", Location: "Hines VA", Source: SourceLighthouse}}}
+
+	merged := Merge(a, b)
+	if len(merged.Doses) != 1 {
+		t.Fatalf("expected doses on consecutive days to be merged, got %#v", merged.Doses)
+	}
+	if merged.Doses[0].Provenance() != "Medicare, VA" {
+		t.Errorf("expected both sources, got %s", merged.Doses[0].Provenance())
+	}
+
+	// but two days apart they're different doses
+	b.Doses[0].Date = Date{given.AddDate(0, 0, 1)}
+	if merged := Merge(a, b); len(merged.Doses) != 2 {
+		t.Errorf("expected doses two days apart to be kept apart, got %#v", merged.Doses)
+	}
+}
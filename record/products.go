@@ -0,0 +1,158 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+import "strings"
+
+// Product describes a covid vaccine product
+type Product struct {
+	Name         string
+	Manufacturer string
+	// CVX is the CDC vaccine code
+	// https://www2.cdc.gov/vaccines/iis/iisstandards/vaccines.asp?rpt=cvx
+	CVX string
+	// SeriesDoses is the number of doses in the primary series
+	SeriesDoses int
+	// MinInterval and RecommendedInterval are the earliest and recommended
+	// number of days between doses in the primary series
+	MinInterval         int
+	RecommendedInterval int
+	// BoosterMonths is how many months after the primary series a booster is
+	// recommended, or 0 if we don't know of one
+	BoosterMonths int
+}
+
+var (
+	pfizer = Product{
+		Name:         "Pfizer-BioNTech COVID-19 Vaccine",
+		Manufacturer: "Pfizer, Inc",
+		CVX:          "208",
+		SeriesDoses:  2,
+		// the CDC allows a grace period of 4 days before the recommended
+		// interval
+		MinInterval:         17,
+		RecommendedInterval: 21,
+		BoosterMonths:       6,
+	}
+	moderna = Product{
+		Name:                "Moderna COVID-19 Vaccine",
+		Manufacturer:        "Moderna US, Inc.",
+		CVX:                 "207",
+		SeriesDoses:         2,
+		MinInterval:         24,
+		RecommendedInterval: 28,
+		BoosterMonths:       6,
+	}
+	astraZeneca = Product{
+		Name:         "AstraZeneca COVID-19 Vaccine",
+		Manufacturer: "AstraZeneca",
+		CVX:          "210",
+		SeriesDoses:  2,
+		// the WHO recommends 8 to 12 weeks between doses, with 4 at minimum
+		MinInterval:         28,
+		RecommendedInterval: 56,
+	}
+	janssen = Product{
+		Name:         "Janssen COVID-19 Vaccine",
+		Manufacturer: "Janssen Products, LP",
+		CVX:          "212",
+		SeriesDoses:  1,
+		// the CDC recommends a booster at least two months after the single
+		// dose
+		BoosterMonths: 2,
+	}
+)
+
+// products maps the CPT/HCPCS codes used in Blue Button claims and the CVX
+// codes used in FHIR Immunization resources to the product they represent
+// https://www.cms.gov/medicare/medicare-part-b-drug-average-sales-price/covid-19-vaccines-and-monoclonal-antibodies
+var products = map[string]Product{
+	"91300": pfizer,
+	"0001A": pfizer,
+	"0002A": pfizer,
+	"0003A": pfizer,
+	"0004A": pfizer,
+	"208":   pfizer,
+	// the ready to use tris-sucrose formulation
+	"91305": pfizer,
+	"0051A": pfizer,
+	"0052A": pfizer,
+	"0053A": pfizer,
+	"0054A": pfizer,
+	"217":   pfizer,
+	"91301": moderna,
+	"0011A": moderna,
+	"0012A": moderna,
+	"0013A": moderna,
+	"207":   moderna,
+	// the half strength booster
+	"91306": moderna,
+	"0064A": moderna,
+	"91302": astraZeneca,
+	"0021A": astraZeneca,
+	"0022A": astraZeneca,
+	"210":   astraZeneca,
+	"91303": janssen,
+	"0031A": janssen,
+	"0034A": janssen,
+	"212":   janssen,
+}
+
+// codeRoles are the administration codes that say which dose was given, for
+// the doses that aren't part of the primary series. CVX codes don't, so those
+// doses are assigned a role by their position in the record.
+var codeRoles = map[string]DoseRole{
+	"0003A": RoleAdditional,
+	"0053A": RoleAdditional,
+	"0013A": RoleAdditional,
+	"0004A": RoleBooster,
+	"0054A": RoleBooster,
+	"91306": RoleBooster,
+	"0064A": RoleBooster,
+	"0034A": RoleBooster,
+}
+
+// defaultSeriesDoses is the number of doses we assume a series has when we
+// don't recognize the product
+const defaultSeriesDoses = 2
+
+// LookupProduct finds the product for a vaccine code. Codes may also be a
+// product code and an administration code joined by a dash, like
+// "91300-0001A".
+func LookupProduct(code string) (Product, bool) {
+	if product, ok := products[code]; ok {
+		return product, true
+	}
+	for _, part := range strings.Split(code, "-") {
+		if product, ok := products[part]; ok {
+			return product, true
+		}
+	}
+	return Product{}, false
+}
+
+// lookupRole finds the role a vaccine code says its dose played, if it says
+func lookupRole(code string) (DoseRole, bool) {
+	if role, ok := codeRoles[code]; ok {
+		return role, true
+	}
+	for _, part := range strings.Split(code, "-") {
+		if role, ok := codeRoles[part]; ok {
+			return role, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package record holds a source-independent view of a patient's covid
+// vaccination record. Blue Button and VA Lighthouse each return their own
+// shapes; this package normalizes them so the rest of the app only has to
+// know about one.
+package record
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+	"github.com/adhocteam/covidreport/lighthouse"
+	"github.com/adhocteam/covidreport/smart"
+)
+
+// The sources we know how to load a record from
+const (
+	SourceBlueButton = "bluebutton"
+	SourceLighthouse = "lighthouse"
+	// SourceDemo is the made up records of the demo personas
+	SourceDemo = "demo"
+)
+
+// SourceSMART returns the source for a SMART on FHIR health system, which are
+// configured rather than built in
+func SourceSMART(id string) string {
+	return "smart:" + id
+}
+
+// Date is a calendar date without a meaningful time of day. It marshals to
+// JSON as year-month-day.
+type Date struct {
+	time.Time
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.Time.Format("2006-01-02"))
+}
+
+func (d *Date) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "null" || s == "" {
+		d.Time = time.Time{}
+		return nil
+	}
+	tm, err := time.Parse("2006-01-02", s)
+	d.Time = tm
+	return err
+}
+
+// Patient is the demographic information we show on the card
+type Patient struct {
+	Name       string `json:"name"`
+	GivenName  string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+	BirthDate  Date   `json:"birth_date"`
+	Gender     string `json:"gender,omitempty"`
+	Source     string `json:"source"`
+	// ID is the patient's id at the source. It's only kept for the audit
+	// log, and isn't shown or exported.
+	ID string `json:"-"`
+}
+
+// DoseRole is the part a dose plays in the patient's vaccination
+type DoseRole string
+
+const (
+	// RolePrimary doses make up the primary series
+	RolePrimary DoseRole = "primary"
+	// RoleAdditional doses are an extra primary dose for people who are
+	// immunocompromised
+	RoleAdditional DoseRole = "additional"
+	// RoleBooster doses are given after the primary series is complete
+	RoleBooster DoseRole = "booster"
+)
+
+// Dose is a single administered vaccine dose
+type Dose struct {
+	Date         Date   `json:"date"`
+	Code         string `json:"code"`
+	Display      string `json:"display,omitempty"`
+	Product      string `json:"product,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	CVX          string `json:"cvx,omitempty"`
+	Location     string `json:"location,omitempty"`
+	Lot          string `json:"lot,omitempty"`
+	Source       string `json:"source"`
+	// Role is set when the record is normalized, by Roles
+	Role DoseRole `json:"role,omitempty"`
+	// Sources lists every source that reported this dose, when a record was
+	// merged from more than one
+	Sources []string `json:"sources,omitempty"`
+}
+
+// Record is a patient and the covid vaccine doses they've received, in the
+// order they were given, and any covid tests they've had, in date order
+type Record struct {
+	Patient Patient      `json:"patient"`
+	Doses   []Dose       `json:"doses"`
+	Tests   []TestResult `json:"tests,omitempty"`
+}
+
+// newDose fills in the product information for a dose from the code table
+func newDose(source string, date time.Time, code, display, location, lot string) Dose {
+	dose := Dose{
+		Date:     Date{date},
+		Code:     code,
+		Display:  display,
+		Location: location,
+		Lot:      lot,
+		Source:   source,
+	}
+	if product, ok := LookupProduct(code); ok {
+		dose.Product = product.Name
+		dose.Manufacturer = product.Manufacturer
+		dose.CVX = product.CVX
+	}
+	return dose
+}
+
+// FromBlueButton normalizes a Blue Button patient and their vaccinations
+func FromBlueButton(pat *bluebutton.Patient, vaxes []bluebutton.Vaccination) *Record {
+	rec := &Record{Patient: Patient{Source: SourceBlueButton}}
+	if pat != nil {
+		rec.Patient.BirthDate = Date{pat.BirthDate.Time}
+		rec.Patient.Gender = pat.Gender
+		// this is a tricky one. This will do for now, but would bear a lot
+		// more thought in a real app
+		if len(pat.Name) > 0 {
+			rec.Patient.GivenName = strings.Join(pat.Name[0].Given, " ")
+			rec.Patient.FamilyName = pat.Name[0].Family
+			rec.Patient.Name = strings.TrimSpace(rec.Patient.GivenName + " " + rec.Patient.FamilyName)
+		}
+	}
+	for _, vax := range vaxes {
+		rec.Doses = append(rec.Doses, newDose(SourceBlueButton, vax.Date, vax.Code, vax.Display, vax.Location, vax.Lot))
+	}
+	assignRoles(rec.Doses)
+	return rec
+}
+
+// FromLighthouse normalizes a VA Lighthouse patient and their vaccinations
+func FromLighthouse(pat *lighthouse.Patient, vaxes []lighthouse.Vaccination) *Record {
+	rec := &Record{Patient: Patient{Source: SourceLighthouse}}
+	if pat != nil {
+		rec.Patient.Name = pat.Name
+		rec.Patient.GivenName = pat.GivenName
+		rec.Patient.FamilyName = pat.FamilyName
+		rec.Patient.Gender = pat.Gender
+		rec.Patient.BirthDate = Date{pat.BirthDate.Time}
+	}
+	for _, vax := range vaxes {
+		rec.Doses = append(rec.Doses, newDose(SourceLighthouse, vax.Date, vax.Code, vax.Display, vax.Location, vax.Lot))
+	}
+	assignRoles(rec.Doses)
+	return rec
+}
+
+// FromSMART normalizes a patient and their vaccinations from a SMART on FHIR
+// health system
+func FromSMART(id string, pat *smart.Patient, vaxes []smart.Vaccination) *Record {
+	source := SourceSMART(id)
+	rec := &Record{Patient: Patient{Source: source}}
+	if pat != nil {
+		rec.Patient.Name = pat.Name
+		rec.Patient.GivenName = pat.GivenName
+		rec.Patient.FamilyName = pat.FamilyName
+		rec.Patient.Gender = pat.Gender
+		rec.Patient.BirthDate = Date{pat.BirthDate}
+	}
+	for _, vax := range vaxes {
+		rec.Doses = append(rec.Doses, newDose(source, vax.Date, vax.Code, vax.Display, vax.Location, vax.Lot))
+	}
+	assignRoles(rec.Doses)
+	return rec
+}
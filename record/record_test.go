@@ -0,0 +1,136 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/bluebutton"
+)
+
+func TestFromBlueButton(t *testing.T) {
+	pat := &bluebutton.Patient{
+		Gender:    "female",
+		BirthDate: bluebutton.YearMonthDay{Time: time.Date(1999, 6, 1, 0, 0, 0, 0, time.UTC)},
+		Name: []bluebutton.PatientName{{
+			Family: "Doe",
+			Given:  []string{"Jane", "X"},
+		}},
+	}
+	vaxes := []bluebutton.Vaccination{{
+		Date: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC),
+		Code: "0011A",
+	}}
+
+	rec := FromBlueButton(pat, vaxes)
+	if rec.Patient.Name != "Jane X Doe" || rec.Patient.Source != SourceBlueButton {
+		t.Errorf("unexpected patient %#v", rec.Patient)
+	}
+	if len(rec.Doses) != 1 || rec.Doses[0].Product != moderna.Name || rec.Doses[0].CVX != "207" {
+		t.Errorf("unexpected doses %#v", rec.Doses)
+	}
+}
+
+func TestDateJSON(t *testing.T) {
+	b, err := json.Marshal(Date{time.Date(2021, 2, 1, 16, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"2021-02-01"` {
+		t.Errorf("unexpected date %s", b)
+	}
+
+	var d Date
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Format("2006-01-02") != "2021-02-01" {
+		t.Errorf("unexpected date %s", d)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	date := func(y int, m time.Month, d int) Date { return Date{time.Date(y, m, d, 0, 0, 0, 0, time.UTC)} }
+	dose := func(code string) Dose { return Dose{Code: code, Date: date(2021, 2, 1)} }
+	doseOn := func(code string, m time.Month, d int) Dose { return Dose{Code: code, Date: date(2021, m, d)} }
+
+	tests := []struct {
+		name  string
+		doses []Dose
+		want  Summary
+	}{
+		{"none", nil, Summary{Status: StatusPending, DosesRequired: 2, DosesRemaining: 2}},
+		{"one pfizer", []Dose{dose("0001A")}, Summary{
+			Status: StatusPartial, DosesGiven: 1, DosesRequired: 2, DosesRemaining: 1,
+			NextDoseEarliest: date(2021, 2, 18),
+			NextDoseDue:      date(2021, 2, 22),
+		}},
+		{"two moderna", []Dose{dose("0011A"), dose("0012A")}, Summary{
+			Status: StatusComplete, DosesGiven: 2, DosesRequired: 2,
+			BoosterDue: date(2021, 8, 1),
+		}},
+		{"janssen", []Dose{dose("212")}, Summary{Status: StatusComplete, DosesGiven: 1, DosesRequired: 1, BoosterDue: date(2021, 4, 1)}},
+		{"unknown product", []Dose{dose("99999")}, Summary{Status: StatusPartial, DosesGiven: 1, DosesRequired: 2, DosesRemaining: 1}},
+		{"two unknown", []Dose{dose("99999"), dose("99999")}, Summary{Status: StatusComplete, DosesGiven: 2, DosesRequired: 2}},
+		// a third dose without a code to say what it was is a booster
+		{"combined code", []Dose{dose("91300-0001A"), dose("91300-0001A"), dose("91300-0001A")}, Summary{Status: StatusBoosted, DosesGiven: 3, DosesRequired: 2, BoostersGiven: 1}},
+		{"pfizer booster", []Dose{doseOn("0001A", 2, 1), doseOn("0002A", 2, 22), doseOn("91300-0004A", 10, 1)}, Summary{
+			Status: StatusBoosted, DosesGiven: 3, DosesRequired: 2, BoostersGiven: 1,
+		}},
+		{"moderna additional dose", []Dose{doseOn("0011A", 2, 1), doseOn("0012A", 3, 1), doseOn("0013A", 4, 1)}, Summary{
+			Status: StatusComplete, DosesGiven: 3, DosesRequired: 2,
+			BoosterDue: date(2021, 10, 1),
+		}},
+		{"janssen and moderna booster", []Dose{doseOn("212", 3, 1), doseOn("91306-0064A", 11, 1)}, Summary{
+			Status: StatusBoosted, DosesGiven: 2, DosesRequired: 1, BoostersGiven: 1,
+		}},
+		{"janssen and pfizer", []Dose{doseOn("212", 3, 1), doseOn("208", 11, 1)}, Summary{
+			Status: StatusBoosted, DosesGiven: 2, DosesRequired: 1, BoostersGiven: 1,
+		}},
+		// the series still needs a second dose, whatever else was given
+		{"booster before second dose", []Dose{doseOn("0001A", 2, 1), doseOn("0004A", 10, 1)}, Summary{
+			Status: StatusPartial, DosesGiven: 2, DosesRequired: 2, DosesRemaining: 1, BoostersGiven: 1,
+			NextDoseEarliest: date(2021, 2, 18),
+			NextDoseDue:      date(2021, 2, 22),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Evaluate(tt.doses)
+			if got != tt.want {
+				t.Errorf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	date := func(m time.Month, d int) time.Time { return time.Date(2021, m, d, 0, 0, 0, 0, time.UTC) }
+	rec := FromBlueButton(nil, []bluebutton.Vaccination{
+		{Date: date(1, 8), Code: "0011A"},
+		{Date: date(2, 5), Code: "0012A"},
+		{Date: date(8, 20), Code: "0013A"},
+		{Date: date(11, 1), Code: "0064A"},
+		{Date: date(12, 15), Code: "207"},
+	})
+	want := []DoseRole{RolePrimary, RolePrimary, RoleAdditional, RoleBooster, RoleBooster}
+	for i, dose := range rec.Doses {
+		if dose.Role != want[i] {
+			t.Errorf("dose %d: expected %s, got %s", i, want[i], dose.Role)
+		}
+	}
+}
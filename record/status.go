@@ -0,0 +1,140 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package record
+
+// Status is where a patient is in their vaccination schedule. The values match
+// the css classes used on the card.
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusPartial  Status = "partial"
+	StatusComplete Status = "complete"
+	// StatusBoosted is a complete primary series and at least one booster
+	StatusBoosted Status = "boosted"
+)
+
+// Summary is the computed vaccination status for a record
+type Summary struct {
+	Status     Status `json:"status"`
+	DosesGiven int    `json:"doses_given"`
+	// DosesRequired and DosesRemaining count the doses in the primary series
+	DosesRequired  int `json:"doses_required"`
+	DosesRemaining int `json:"doses_remaining"`
+	BoostersGiven  int `json:"boosters_given"`
+	// NextDoseEarliest and NextDoseDue are the earliest and recommended dates
+	// for the next dose. They're only set for a partial vaccination with a
+	// product we know the dosing interval for.
+	NextDoseEarliest Date `json:"next_dose_earliest"`
+	NextDoseDue      Date `json:"next_dose_due"`
+	// BoosterDue is when a booster is recommended. It's only set for a
+	// complete vaccination with a product we know the booster interval for.
+	BoosterDue Date `json:"booster_due"`
+}
+
+// seriesProduct returns the product of the primary series, which we take from
+// the first dose, and how many doses it has. If we don't know the product, we
+// assume a two-dose series.
+func seriesProduct(doses []Dose) (product Product, required int, known bool) {
+	required = defaultSeriesDoses
+	if len(doses) > 0 {
+		product, known = LookupProduct(doses[0].Code)
+		if known {
+			required = product.SeriesDoses
+		}
+	}
+	return product, required, known
+}
+
+// Roles works out the role of each dose. A code that names the dose, like
+// 0004A for a Pfizer booster, decides it; otherwise the doses are primary
+// until the series is complete, and boosters after that.
+func Roles(doses []Dose) []DoseRole {
+	_, required, _ := seriesProduct(doses)
+	roles := make([]DoseRole, len(doses))
+	primary := 0
+	for i, dose := range doses {
+		if role, ok := lookupRole(dose.Code); ok {
+			roles[i] = role
+			continue
+		}
+		if primary < required {
+			roles[i] = RolePrimary
+			primary++
+		} else {
+			roles[i] = RoleBooster
+		}
+	}
+	return roles
+}
+
+// assignRoles sets the role of each dose
+func assignRoles(doses []Dose) {
+	for i, role := range Roles(doses) {
+		doses[i].Role = role
+	}
+}
+
+// Evaluate computes the vaccination status for a list of doses. The number of
+// doses required comes from the product of the first dose; if we don't know
+// it, we assume a two-dose series.
+func Evaluate(doses []Dose) Summary {
+	product, required, known := seriesProduct(doses)
+
+	summary := Summary{
+		DosesGiven:    len(doses),
+		DosesRequired: required,
+	}
+	// the last dose of the primary series, including any additional dose
+	var last Date
+	primary := 0
+	for i, role := range Roles(doses) {
+		switch role {
+		case RoleBooster:
+			summary.BoostersGiven++
+		case RolePrimary:
+			primary++
+			last = doses[i].Date
+		case RoleAdditional:
+			last = doses[i].Date
+		}
+	}
+	if primary < required {
+		summary.DosesRemaining = required - primary
+	}
+
+	switch {
+	case summary.DosesGiven == 0:
+		summary.Status = StatusPending
+	case summary.DosesRemaining > 0:
+		summary.Status = StatusPartial
+		if known && product.RecommendedInterval > 0 && !last.IsZero() {
+			summary.NextDoseEarliest = Date{last.AddDate(0, 0, product.MinInterval)}
+			summary.NextDoseDue = Date{last.AddDate(0, 0, product.RecommendedInterval)}
+		}
+	case summary.BoostersGiven > 0:
+		summary.Status = StatusBoosted
+	default:
+		summary.Status = StatusComplete
+		if known && product.BoosterMonths > 0 {
+			summary.BoosterDue = Date{last.AddDate(0, product.BoosterMonths, 0)}
+		}
+	}
+	return summary
+}
+
+// Summary computes the vaccination status for the record
+func (r *Record) Summary() Summary {
+	return Evaluate(r.Doses)
+}
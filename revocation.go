@@ -0,0 +1,142 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adhocteam/covidreport/audit"
+)
+
+// Why we revoked a provider's tokens
+const (
+	// the user logged out
+	revokeLogout = "logout"
+	// REVOKE_TOKENS_AFTER_FETCH is set, so we revoke them as soon as we have
+	// the record
+	revokeAfterFetch = "after_fetch"
+	// we got tokens, but couldn't load the record with them
+	revokeFetchFailed = "fetch_failed"
+	// the record didn't match the rest of the session, so we threw it away
+	revokeNotLinked = "not_linked"
+	// the user logged in to the same provider again
+	revokeReplaced = "replaced"
+	// the session expired while we still held the tokens
+	revokeExpired = "expired"
+)
+
+// RevocationEvent records an attempt to revoke a provider's tokens
+type RevocationEvent struct {
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	// Session identifies the session without revealing its id, which would
+	// let anyone reading the log use it
+	Session string `json:"session,omitempty"`
+	Reason  string `json:"reason"`
+	// HeldFor is how long we had the tokens, in seconds
+	HeldFor float64 `json:"held_for"`
+	Revoked bool    `json:"revoked"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// RevocationLog writes a json line for every revocation, so we can show how
+// long we hold on to users' tokens
+type RevocationLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRevocationLog returns a log that writes to w
+func NewRevocationLog(w io.Writer) *RevocationLog {
+	return &RevocationLog{w: w}
+}
+
+// Record writes ev to the log
+func (l *RevocationLog) Record(ev RevocationEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("error encoding revocation event: %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("error writing revocation event: %s", err)
+	}
+}
+
+// sessionRef is a stand-in for a session id that's safe to log
+func sessionRef(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// revokeSession revokes all the tokens a session holds. r is nil when it's
+// not done for a request.
+func (c *CovidRecord) revokeSession(r *http.Request, sess *Session, reason string) {
+	for source, tokens := range sess.Tokens {
+		p, ok := c.Providers.bySource(source)
+		if !ok {
+			log.Printf("no provider for %s to revoke its tokens", source)
+			continue
+		}
+		c.revoke(r, p, sess.ID, tokens, reason)
+	}
+}
+
+// revokeExpired revokes the tokens of a session that expired. It's the
+// session store's Expired hook, called by its janitor, so there's no request
+// to log the revocations under.
+func (c *CovidRecord) revokeExpired(sess *Session) {
+	c.revokeSession(nil, sess, revokeExpired)
+}
+
+// revoke revokes the tokens p issued for a session, and records the outcome
+// in the revocation and audit logs
+func (c *CovidRecord) revoke(r *http.Request, p *registeredProvider, sessionID string, t Tokens, reason string) {
+	err := p.impl.Revoke(t)
+	ev := RevocationEvent{
+		Time:     time.Now().UTC(),
+		Provider: p.ID,
+		Session:  sessionRef(sessionID),
+		Reason:   reason,
+		HeldFor:  time.Since(t.Issued).Seconds(),
+		Revoked:  err == nil,
+	}
+	if err != nil {
+		log.Printf("error revoking tokens from %s: %s", p.ID, err)
+		ev.Error = err.Error()
+	}
+	if c.Revocations != nil {
+		c.Revocations.Record(ev)
+	}
+	c.logEvent(r, audit.Event{
+		Kind:     audit.Revocation,
+		Provider: p.ID,
+		Session:  ev.Session,
+		Outcome:  outcome(err),
+		Detail:   reason,
+	})
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/audit"
+	"github.com/adhocteam/covidreport/record"
+)
+
+// fakeProvider hands out a fixed record and tokens, and remembers what it's
+// asked to revoke
+type fakeProvider struct {
+	rec       *record.Record
+	revoked   []Tokens
+	revokeErr error
+}
+
+func (p *fakeProvider) AuthURL(state string) (string, error) {
+	return "https://provider.example/authorize?state=" + state, nil
+}
+
+func (p *fakeProvider) FetchRecord(code, state string, fetched func(resource string)) (*record.Record, Tokens, error) {
+	fetched("Patient")
+	return p.rec, newTokens("access-"+code, "refresh-"+code), nil
+}
+
+func (p *fakeProvider) Revoke(t Tokens) error {
+	p.revoked = append(p.revoked, t)
+	return p.revokeErr
+}
+
+func (p *fakeProvider) Source() string { return p.rec.Patient.Source }
+
+// newRevocationServer returns a server with one fake provider, and the
+// buffer its revocations are logged to
+func newRevocationServer() (*CovidRecord, *fakeProvider, *bytes.Buffer) {
+	persona, _ := builtinPersonaCatalog().Get("pfizer-complete")
+	fake := &fakeProvider{rec: claimsRecord(persona)}
+	var buf bytes.Buffer
+	server := &CovidRecord{
+		Sessions: NewSessionStore(time.Minute),
+		Providers: &Registry{providers: []*registeredProvider{{
+			ProviderConfig: ProviderConfig{ID: "fake", Name: "Fake", RedirectURL: "https://localhost.dev/auth/fake/callback"},
+			impl:           fake,
+		}}},
+		Revocations: NewRevocationLog(&buf),
+	}
+	server.Sessions.Expired = server.revokeExpired
+	return server, fake, &buf
+}
+
+// login goes through the fake provider's login, returning the session cookie
+func login(t *testing.T, handler http.Handler, code string) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/fake/start", nil))
+	state := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest("GET", "/auth/fake/callback?code="+code+"&state="+state.Value, nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the card, got %d: %s", w.Code, w.Body)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return c
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+func revocationEvents(t *testing.T, buf *bytes.Buffer) []RevocationEvent {
+	t.Helper()
+	var events []RevocationEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var ev RevocationEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestRevokeOnLogout(t *testing.T) {
+	server, fake, buf := newRevocationServer()
+	fake.revokeErr = errors.New("provider is down")
+	handler := server.Handler()
+	session := login(t, handler, "abc")
+
+	if len(fake.revoked) != 0 {
+		t.Fatalf("didn't expect tokens to be revoked before logging out, got %v", fake.revoked)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/logout", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected logging out with GET to be refused, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected a redirect home, got %d", w.Code)
+	}
+	if len(fake.revoked) != 1 || fake.revoked[0].Access != "access-abc" || fake.revoked[0].Refresh != "refresh-abc" {
+		t.Errorf("expected the login's tokens to be revoked, got %v", fake.revoked)
+	}
+	if _, ok := server.Sessions.Get(r); ok {
+		t.Errorf("expected the session to be gone")
+	}
+
+	events := revocationEvents(t, buf)
+	if len(events) != 1 {
+		t.Fatalf("expected one revocation event, got %v", events)
+	}
+	ev := events[0]
+	if ev.Provider != "fake" || ev.Reason != revokeLogout || ev.Revoked || ev.Error != "provider is down" {
+		t.Errorf("unexpected event %#v", ev)
+	}
+	if ev.Session == "" || strings.Contains(buf.String(), session.Value) {
+		t.Errorf("expected the session to be identified without its id, got %s", buf)
+	}
+}
+
+func TestRevokeAfterFetch(t *testing.T) {
+	server, fake, buf := newRevocationServer()
+	server.RevokeAfterFetch = true
+	handler := server.Handler()
+	session := login(t, handler, "abc")
+
+	if len(fake.revoked) != 1 {
+		t.Fatalf("expected the tokens to be revoked as soon as the record was loaded, got %v", fake.revoked)
+	}
+	events := revocationEvents(t, buf)
+	if len(events) != 1 || events[0].Reason != revokeAfterFetch || !events[0].Revoked {
+		t.Errorf("unexpected events %v", events)
+	}
+
+	// so there's nothing left to revoke when the user logs out
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(session)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if len(fake.revoked) != 1 {
+		t.Errorf("didn't expect another revocation, got %v", fake.revoked)
+	}
+}
+
+func TestRevokeOnExpiry(t *testing.T) {
+	server, fake, buf := newRevocationServer()
+	var auditBuf bytes.Buffer
+	server.Audit = audit.New([]byte("key"), audit.NewJSONSink(&auditBuf))
+	server.Sessions.TTL = -time.Second
+	handler := server.Handler()
+
+	// requests don't wait on revoking the tokens of sessions that expired
+	login(t, handler, "abc")
+	session := login(t, handler, "def")
+	r := httptest.NewRequest("GET", "/api/v1/me", nil)
+	r.AddCookie(session)
+	if _, ok := server.Sessions.Get(r); ok {
+		t.Fatalf("expected the session to have expired")
+	}
+	if len(fake.revoked) != 0 {
+		t.Fatalf("expected the requests to leave revoking to the janitor, got %v", fake.revoked)
+	}
+
+	// the janitor does
+	server.Sessions.sweep()
+	if len(fake.revoked) != 2 {
+		t.Fatalf("expected both sessions' tokens to be revoked, got %v", fake.revoked)
+	}
+	events := revocationEvents(t, buf)
+	if len(events) != 2 || events[0].Reason != revokeExpired || events[1].Reason != revokeExpired {
+		t.Errorf("unexpected events %v", events)
+	}
+
+	// outside of any request
+	var revocations int
+	for _, ev := range auditEvents(t, &auditBuf) {
+		if ev.Kind != audit.Revocation {
+			continue
+		}
+		revocations++
+		if ev.RequestID != "" || ev.Path != "" || ev.Detail != revokeExpired {
+			t.Errorf("expected the revocation to be audited without a request, got %+v", ev)
+		}
+	}
+	if revocations != 2 {
+		t.Errorf("expected two revocations in the audit log, got %d", revocations)
+	}
+
+	// and there's nothing left to sweep
+	server.Sessions.sweep()
+	if len(fake.revoked) != 2 {
+		t.Errorf("didn't expect another revocation, got %v", fake.revoked)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"github.com/adhocteam/covidreport/bluebutton/bbtest"
+	"github.com/adhocteam/covidreport/lighthouse/vatest"
+)
+
+// The sandbox's providers accept these made up client credentials
+const (
+	sandboxClientID     = "covidrecord-sandbox"
+	sandboxClientSecret = "sandbox-secret"
+)
+
+// sandbox runs fake Blue Button and VA Lighthouse servers in process, so the
+// app can be tried out without oauth clients, certificates or google secrets.
+// Their login pages offer a choice of the people in their scenarios.
+type sandbox struct {
+	bb *bbtest.Server
+	va *vatest.Server
+}
+
+func newSandbox() *sandbox {
+	return &sandbox{
+		bb: bbtest.NewServer(sandboxClientID, sandboxClientSecret),
+		va: vatest.NewServer(sandboxClientID, sandboxClientSecret),
+	}
+}
+
+// Providers returns a registry of the fake providers, calling back to the app
+// at baseURL
+func (s *sandbox) Providers(baseURL string) (*Registry, error) {
+	return NewRegistry([]ProviderConfig{{
+		ID:           "bluebutton",
+		Type:         providerBlueButton,
+		Name:         "Blue Button (sandbox)",
+		AuthURL:      s.bb.URL,
+		ClientID:     sandboxClientID,
+		ClientSecret: sandboxClientSecret,
+		RedirectURL:  baseURL + "/bbcallback",
+	}, {
+		ID:           "lighthouse",
+		Type:         providerLighthouse,
+		Name:         "VA Lighthouse (sandbox)",
+		AuthURL:      s.va.URL,
+		FhirURL:      s.va.FhirURL(),
+		ClientID:     sandboxClientID,
+		ClientSecret: sandboxClientSecret,
+		RedirectURL:  baseURL + "/callback",
+	}}, nil)
+}
+
+func (s *sandbox) Close() {
+	s.bb.Close()
+	s.va.Close()
+}
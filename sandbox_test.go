@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSandboxServer(t *testing.T) *CovidRecord {
+	t.Helper()
+	sb := newSandbox()
+	t.Cleanup(sb.Close)
+	reg, err := sb.Providers("http://localhost:6655")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CovidRecord{Sessions: NewSessionStore(time.Minute), Providers: reg}
+}
+
+func TestSandboxLoginPages(t *testing.T) {
+	handler := newSandboxServer(t).Handler()
+
+	for provider, person := range map[string]string{"bluebutton": "Marta Quigley", "lighthouse": "Tamara Ellis"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/"+provider+"/start", nil))
+		resp, err := http.Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), person) {
+			t.Errorf("expected %s's login page to offer %s, got %d: %s", provider, person, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestSandboxLinkProviders(t *testing.T) {
+	server := newSandboxServer(t)
+	handler := server.Handler()
+
+	// Medicare was billed for the second dose
+	w := bbLogin(t, handler, "veteran-moderna")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "PARTIAL VACCINATION") {
+		t.Fatalf("expected a partial card, got %d: %s", w.Code, w.Body)
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+
+	// and the VA has both
+	w = vaLogin(t, handler, "moderna-complete", session)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "VACCINATION COMPLETE") {
+		t.Fatalf("expected a complete card, got %d: %s", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(session)
+	sess, ok := server.Sessions.Get(r)
+	if !ok {
+		t.Fatal("no session")
+	}
+	if len(sess.Sources) != 2 || len(sess.Record.Doses) != 2 || len(sess.Record.Doses[1].Sources) != 2 {
+		t.Errorf("expected the second dose to be reported by both, got %#v", sess.Record.Doses)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// staticAssets is where we load USWDS and our images from
+const staticAssets = "https://storage.googleapis.com"
+
+// hstsMaxAge is how long browsers should only connect to us over https, two
+// years being what the HSTS preload list asks for
+const hstsMaxAge = 2 * 365 * 24 * 60 * 60
+
+type nonceKey struct{}
+
+// newNonce returns a random value for a Content-Security-Policy nonce. It's
+// url safe base64 so that the templates don't need to escape it.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// cspNonce returns the request's Content-Security-Policy nonce, which the
+// page's scripts and styles must carry to run. It's empty if the request
+// didn't come through withSecurityHeaders.
+func cspNonce(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+// contentSecurityPolicy only lets a page run the scripts and styles that carry
+// its nonce, load assets from us and the USWDS bucket, and show images from
+// anywhere over https, for the providers' logos, or inline, for the qr codes
+func contentSecurityPolicy(nonce string) string {
+	return fmt.Sprintf("default-src 'none'; "+
+		"script-src 'nonce-%[1]s'; "+
+		"style-src 'nonce-%[1]s' %[2]s; "+
+		"img-src 'self' data: https:; "+
+		"font-src %[2]s; "+
+		"base-uri 'none'; "+
+		"form-action 'self'; "+
+		"frame-ancestors 'none'", nonce, staticAssets)
+}
+
+// withSecurityHeaders sets the headers that tell browsers to lock down every
+// response: a Content-Security-Policy with a fresh nonce, which is passed on
+// to the templates in the request's context, no framing, no referrer, since
+// the callback url holds an authorization code, and HSTS when we're served
+// over https
+func withSecurityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := newNonce()
+		if err != nil {
+			log.Printf("unable to generate a csp nonce: %s", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Referrer-Policy", "no-referrer")
+		if isTLS(r) {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", hstsMaxAge))
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// noStore wraps a handler whose response holds the patient's health
+// information, so that browsers and proxies don't keep a copy of it
+func noStore(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		f(w, r)
+	}
+}
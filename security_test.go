@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var cspNonceRe = regexp.MustCompile(`script-src 'nonce-([^']+)'`)
+
+func TestSecurityHeaders(t *testing.T) {
+	handler := newTestServer(t).Handler()
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := serve("/showCallback?persona=boosted")
+	for header, want := range map[string]string{
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"Referrer-Policy":           "no-referrer",
+		"Cache-Control":             "no-store",
+		"Strict-Transport-Security": "",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("expected %s %q, got %q", header, want, got)
+		}
+	}
+
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "frame-ancestors 'none'") || strings.Contains(csp, "unsafe-inline") {
+		t.Errorf("unexpected policy %q", csp)
+	}
+	m := cspNonceRe.FindStringSubmatch(csp)
+	if m == nil {
+		t.Fatalf("expected a nonce in the policy %q", csp)
+	}
+	body := w.Body.String()
+	if got, want := strings.Count(body, `nonce="`+m[1]+`"`), strings.Count(body, "<script")+strings.Count(body, "<style"); got != want {
+		t.Errorf("expected all %d scripts and styles to have the nonce, %d do", want, got)
+	}
+	if strings.Contains(body, "javascript:") || strings.Contains(body, ` style="`) {
+		t.Errorf("expected no inline script or style the policy would block")
+	}
+
+	// every response gets its own nonce
+	if again := cspNonceRe.FindStringSubmatch(serve("/").Header().Get("Content-Security-Policy")); again == nil || again[1] == m[1] {
+		t.Errorf("expected a new nonce for each request")
+	}
+
+	// pages without the patient's record can be cached
+	if got := serve("/").Header().Get("Cache-Control"); got != "" {
+		t.Errorf("didn't expect the index page to set Cache-Control, got %q", got)
+	}
+	if got := serve("/api/v1/me").Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("expected the api not to be cached, got %q", got)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); !strings.HasPrefix(got, "max-age=63072000") {
+		t.Errorf("expected HSTS over https, got %q", got)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adhocteam/covidreport/identity"
+	"github.com/adhocteam/covidreport/record"
+)
+
+const sessionCookie = "covidrecord_session"
+
+// Session is what we remember about a user between requests: the records we
+// loaded for them from each provider they connected
+type Session struct {
+	ID string
+	// Sources holds the record loaded from each provider, keyed by source
+	Sources map[string]*record.Record
+	// Record is the sources merged into one
+	Record *record.Record
+	// Tokens holds the tokens issued by each provider, keyed by source, until
+	// we revoke them
+	Tokens  map[string]Tokens
+	Expires time.Time
+}
+
+// add stores the record for a source and re-merges the session's record
+func (sess *Session) add(rec *record.Record) {
+	sess.Sources[rec.Patient.Source] = rec
+
+	sources := make([]string, 0, len(sess.Sources))
+	for source := range sess.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	recs := make([]*record.Record, len(sources))
+	for i, source := range sources {
+		recs[i] = sess.Sources[source]
+	}
+	sess.Record = record.Merge(recs...)
+}
+
+// Demo reports whether the session holds a demo persona's made up record
+// rather than one of the user's own
+func (sess *Session) Demo() bool {
+	return sess.Sources[record.SourceDemo] != nil
+}
+
+// copy returns a snapshot of the session that's safe to read without holding
+// the store's lock
+func (sess *Session) copy() *Session {
+	cp := *sess
+	cp.Sources = make(map[string]*record.Record, len(sess.Sources))
+	for source, rec := range sess.Sources {
+		cp.Sources[source] = rec
+	}
+	cp.Tokens = make(map[string]Tokens, len(sess.Tokens))
+	for source, t := range sess.Tokens {
+		cp.Tokens[source] = t
+	}
+	return &cp
+}
+
+// SessionStore keeps sessions in memory. That means sessions don't survive a
+// restart and aren't shared between instances, which is fine for a demo app
+// but would need a real backing store in production.
+type SessionStore struct {
+	TTL time.Duration
+	// Identity decides whether records from two providers belong to the same
+	// person, and so can be linked in one session
+	Identity identity.Matcher
+	// Expired is called by the janitor, outside the lock, with each expired
+	// session that still holds tokens when it's removed, so they can be
+	// revoked
+	Expired func(sess *Session)
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessionStore returns a session store whose sessions last for ttl
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		TTL:      ttl,
+		Identity: identity.Matcher{Threshold: identity.DefaultThreshold},
+		sessions: map[string]*Session{},
+	}
+}
+
+func makeSessionID() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("Unable to get random numbers")
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// Create starts a new session holding rec and sets the session cookie on w
+func (s *SessionStore) Create(w http.ResponseWriter, r *http.Request, rec *record.Record) *Session {
+	sess := &Session{
+		ID:      makeSessionID(),
+		Sources: map[string]*record.Record{},
+		Tokens:  map[string]Tokens{},
+		Expires: time.Now().Add(s.TTL),
+	}
+	sess.add(rec)
+
+	s.mu.Lock()
+	s.sessions[sess.ID] = sess
+	cp := sess.copy()
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   isTLS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return cp
+}
+
+// Link adds rec to the current session, merging it with the records from any
+// other providers the user has already connected. If there's no session, it
+// starts one. If rec's patient doesn't match the patient from the other
+// providers, the session is left alone and Link returns an
+// *identity.MismatchError.
+func (s *SessionStore) Link(w http.ResponseWriter, r *http.Request, rec *record.Record) (*Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return s.Create(w, r, rec), nil
+	}
+
+	s.mu.Lock()
+	sess, ok := s.sessions[cookie.Value]
+	// a demo card isn't the user's record, so there's nothing to link to
+	if !ok || time.Now().After(sess.Expires) || sess.Demo() {
+		s.mu.Unlock()
+		return s.Create(w, r, rec), nil
+	}
+	defer s.mu.Unlock()
+
+	for source, other := range sess.Sources {
+		// logging in to the same provider again just replaces its record
+		if source == rec.Patient.Source {
+			continue
+		}
+		res, err := s.Identity.Check(other.Patient, rec.Patient)
+		log.Printf("identity match between %s and %s: %.2f", source, rec.Patient.Source, res.Score)
+		if err != nil {
+			return sess.copy(), err
+		}
+	}
+
+	sess.add(rec)
+	return sess.copy(), nil
+}
+
+// Get returns a snapshot of the unexpired session for the request, if there is
+// one. Expired sessions are left for the janitor to remove.
+func (s *SessionStore) Get(r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[cookie.Value]
+	if !ok || time.Now().After(sess.Expires) {
+		return nil, false
+	}
+	return sess.copy(), true
+}
+
+// SetTokens remembers the tokens a provider issued for the session, and
+// returns the ones they replace, if any, so they can be revoked
+func (s *SessionStore) SetTokens(id, source string, t Tokens) (Tokens, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Tokens{}, false
+	}
+	old, ok := sess.Tokens[source]
+	sess.Tokens[source] = t
+	return old, ok
+}
+
+// Delete ends the request's session and clears its cookie, returning what it
+// held
+func (s *SessionStore) Delete(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isTLS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[cookie.Value]
+	if !ok {
+		return nil, false
+	}
+	delete(s.sessions, sess.ID)
+	return sess, true
+}
+
+// purge removes expired sessions, and returns them. Must be called with s.mu
+// held.
+func (s *SessionStore) purge() []*Session {
+	var expired []*Session
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.After(sess.Expires) {
+			delete(s.sessions, id)
+			expired = append(expired, sess)
+		}
+	}
+	return expired
+}
+
+// sweep removes expired sessions and hands those that still hold tokens to
+// s.Expired. The lock isn't held while it does, since revoking tokens means
+// calling the providers.
+func (s *SessionStore) sweep() {
+	s.mu.Lock()
+	expired := s.purge()
+	s.mu.Unlock()
+
+	if s.Expired == nil {
+		return
+	}
+	for _, sess := range expired {
+		if len(sess.Tokens) > 0 {
+			s.Expired(sess)
+		}
+	}
+}
+
+// RunJanitor sweeps out expired sessions every interval until done is
+// closed. It runs on its own, rather than in whichever request next touches
+// the store, so that no one waits on the providers to revoke someone else's
+// tokens.
+func (s *SessionStore) RunJanitor(every time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-done:
+			return
+		}
+	}
+}
+
+// isTLS reports whether the user connected over https, either directly or
+// through App Engine's front end
+func isTLS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
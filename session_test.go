@@ -0,0 +1,166 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/identity"
+	"github.com/adhocteam/covidreport/lighthouse"
+	"github.com/adhocteam/covidreport/record"
+)
+
+func mustParse(format, dt string) time.Time {
+	tm, err := time.Parse(format, dt)
+	if err != nil {
+		panic(err)
+	}
+	return tm
+}
+
+func TestSessionLink(t *testing.T) {
+	store := NewSessionStore(time.Minute)
+	persona := mustPersona(t, "pfizer-partial")
+
+	w := httptest.NewRecorder()
+	sess, err := store.Link(w, httptest.NewRequest("GET", "/bbcallback", nil), claimsRecord(persona))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// the second dose was given at the VA
+	vaDoses := []lighthouse.Vaccination{{
+		Date: persona.Doses[0].Date.AddDate(0, 0, 21),
+		Code: "208",
+	}}
+	r := httptest.NewRequest("GET", "/callback", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	linked, err := store.Link(w, r, record.FromLighthouse(&lighthouse.Patient{
+		Name:      "Joseph Esposito",
+		BirthDate: lighthouse.YearMonthDay{Time: mustParse("2006-01-02", "1999-06-01")},
+	}, vaDoses))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if linked.ID != sess.ID {
+		t.Errorf("expected the same session, got a new one")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("didn't expect a new cookie when linking to an existing session")
+	}
+	if len(linked.Sources) != 2 || len(linked.Record.Doses) != 2 {
+		t.Fatalf("expected two sources and two doses, got %#v", linked)
+	}
+	if linked.Record.Summary().Status != record.StatusComplete {
+		t.Errorf("expected the merged record to be complete, got %#v", linked.Record.Summary())
+	}
+	if linked.Record.Doses[1].Provenance() != "VA" {
+		t.Errorf("expected the second dose to come from the VA, got %s", linked.Record.Doses[1].Provenance())
+	}
+
+	// the snapshot we got before linking shouldn't have changed
+	if len(sess.Sources) != 1 {
+		t.Errorf("expected the earlier snapshot to be unchanged, got %#v", sess.Sources)
+	}
+}
+
+func TestSessionLinkMismatch(t *testing.T) {
+	store := NewSessionStore(time.Minute)
+
+	w := httptest.NewRecorder()
+	sess, err := store.Link(w, httptest.NewRequest("GET", "/bbcallback", nil), claimsRecord(mustPersona(t, "pfizer-partial")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// somebody else logs in to the VA in the same browser
+	r := httptest.NewRequest("GET", "/callback", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	_, err = store.Link(httptest.NewRecorder(), r, record.FromLighthouse(&lighthouse.Patient{
+		Name:      "Maria Gonzalez",
+		BirthDate: lighthouse.YearMonthDay{Time: mustParse("2006-01-02", "1971-11-23")},
+	}, nil))
+
+	var mismatch *identity.MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a mismatch error, got %v", err)
+	}
+	got, ok := store.Get(r)
+	if !ok || len(got.Sources) != 1 || got.ID != sess.ID {
+		t.Errorf("expected the session to be left alone, got %#v", got)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	store := NewSessionStore(-time.Minute)
+
+	w := httptest.NewRecorder()
+	store.Create(w, httptest.NewRequest("GET", "/", nil), claimsRecord(mustPersona(t, "pfizer-partial")))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	if _, ok := store.Get(r); ok {
+		t.Errorf("expected an expired session not to be returned")
+	}
+}
+
+func TestSessionJanitor(t *testing.T) {
+	store := NewSessionStore(-time.Minute)
+	expired := make(chan *Session, 1)
+	store.Expired = func(sess *Session) { expired <- sess }
+
+	w := httptest.NewRecorder()
+	sess := store.Create(w, httptest.NewRequest("GET", "/", nil), claimsRecord(mustPersona(t, "pfizer-partial")))
+	store.SetTokens(sess.ID, record.SourceBlueButton, newTokens("access", "refresh"))
+
+	done := make(chan struct{})
+	defer close(done)
+	go store.RunJanitor(time.Millisecond, done)
+
+	select {
+	case got := <-expired:
+		if got.ID != sess.ID {
+			t.Errorf("expected the session to be handed over, got %s", got.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the janitor to hand over the expired session")
+	}
+}
+
+func TestSessionLinkAfterDemo(t *testing.T) {
+	store := NewSessionStore(time.Minute)
+
+	w := httptest.NewRecorder()
+	demo := store.Create(w, httptest.NewRequest("GET", "/showCallback", nil), mustPersona(t, "pfizer-partial").Record())
+
+	// the demo card isn't the user's, so logging in starts a session of their own
+	r := httptest.NewRequest("GET", "/callback", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	sess, err := store.Link(httptest.NewRecorder(), r, record.FromLighthouse(&lighthouse.Patient{
+		Name:      "Maria Gonzalez",
+		BirthDate: lighthouse.YearMonthDay{Time: mustParse("2006-01-02", "1971-11-23")},
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.ID == demo.ID || len(sess.Sources) != 1 || sess.Sources[record.SourceLighthouse] == nil {
+		t.Errorf("expected a new session with just the VA record, got %#v", sess)
+	}
+}
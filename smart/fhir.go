@@ -0,0 +1,231 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package smart
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cvxSystem identifies CVX codes in a coding
+const cvxSystem = "http://hl7.org/fhir/sid/cvx"
+
+// covidCVX are the CVX codes for covid vaccines. Patient portals return every
+// immunization the patient has had; we only want these.
+// https://www2.cdc.gov/vaccines/iis/iisstandards/vaccines.asp?rpt=cvx
+var covidCVX = map[string]bool{
+	"207": true, // Moderna
+	"208": true, // Pfizer-BioNTech
+	"210": true, // AstraZeneca
+	"211": true, // Novavax
+	"212": true, // Janssen
+	"213": true, // unspecified formulation
+	"217": true, // Pfizer-BioNTech, 12 years and up, gray cap
+	"218": true, // Pfizer-BioNTech, 5 to 11 years
+	"219": true, // Pfizer-BioNTech, 2 to 4 years
+	"221": true, // Moderna, 50 mcg
+}
+
+// maxPages stops us following next links forever if a server misbehaves
+const maxPages = 20
+
+type coding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display"`
+}
+
+type link struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+// ImmunizationResource is the part of a FHIR R4 Immunization we use
+type ImmunizationResource struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	VaccineCode  struct {
+		Coding []coding `json:"coding"`
+		Text   string   `json:"text"`
+	} `json:"vaccineCode"`
+	OccurrenceDateTime string `json:"occurrenceDateTime"`
+	LotNumber          string `json:"lotNumber"`
+	Location           struct {
+		Display string `json:"display"`
+	} `json:"location"`
+}
+
+// ImmunizationResponse is a page of Immunization search results
+type ImmunizationResponse struct {
+	Links   []link `json:"link"`
+	Entries []struct {
+		FullURL  string               `json:"fullUrl"`
+		Resource ImmunizationResource `json:"resource"`
+	} `json:"entry"`
+}
+
+// Vaccination is a covid vaccine dose from the health system
+type Vaccination struct {
+	Date     time.Time
+	Code     string
+	Display  string
+	Location string
+	Lot      string
+}
+
+// parseDate parses a FHIR date or dateTime, which may be as vague as a year
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if tm, err := time.Parse(layout, s); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse date %q", s)
+}
+
+// findVaxes picks the completed covid vaccinations out of a page of
+// immunizations
+func findVaxes(res ImmunizationResponse) ([]Vaccination, error) {
+	var vaxes []Vaccination
+	for _, entry := range res.Entries {
+		imm := entry.Resource
+		if imm.ResourceType != "Immunization" || imm.Status != "completed" {
+			continue
+		}
+		for _, code := range imm.VaccineCode.Coding {
+			if code.System != cvxSystem || !covidCVX[code.Code] {
+				continue
+			}
+			date, err := parseDate(imm.OccurrenceDateTime)
+			if err != nil {
+				return nil, fmt.Errorf("immunization %s: %w", imm.ID, err)
+			}
+			display := code.Display
+			if display == "" {
+				display = imm.VaccineCode.Text
+			}
+			vaxes = append(vaxes, Vaccination{
+				Date:     date,
+				Code:     code.Code,
+				Display:  display,
+				Location: imm.Location.Display,
+				Lot:      imm.LotNumber,
+			})
+			break
+		}
+	}
+	return vaxes, nil
+}
+
+// GetVaccinations returns the patient's covid vaccinations, following the
+// search results through every page
+func (c *Client) GetVaccinations(tok, patientID string) ([]Vaccination, error) {
+	if patientID == "" {
+		return nil, fmt.Errorf("invalid patient id")
+	}
+
+	var vaxes []Vaccination
+	next := fmt.Sprintf("%s/Immunization?patient=%s", strings.TrimSuffix(c.FhirURL, "/"), url.QueryEscape(patientID))
+	for page := 0; next != ""; page++ {
+		if page == maxPages {
+			return nil, fmt.Errorf("%s returned more than %d pages of immunizations", c.Name, maxPages)
+		}
+		var res ImmunizationResponse
+		err := get(next, tok, &res)
+		if err != nil {
+			return nil, err
+		}
+		found, err := findVaxes(res)
+		if err != nil {
+			return nil, err
+		}
+		vaxes = append(vaxes, found...)
+		next = nextPage(res.Links)
+	}
+	return vaxes, nil
+}
+
+// nextPage returns the url of the next page of a bundle, if there is one
+func nextPage(links []link) string {
+	for _, l := range links {
+		if l.Relation == "next" {
+			return l.URL
+		}
+	}
+	return ""
+}
+
+// PatientResponse is the part of a FHIR R4 Patient we use
+type PatientResponse struct {
+	Names []struct {
+		Use    string   `json:"use"`
+		Text   string   `json:"text"`
+		Family string   `json:"family"`
+		Given  []string `json:"given"`
+	} `json:"name"`
+	Gender    string `json:"gender"`
+	BirthDate string `json:"birthDate"`
+}
+
+// Patient is the demographic information we get from the health system
+type Patient struct {
+	Name       string
+	GivenName  string
+	FamilyName string
+	Gender     string
+	BirthDate  time.Time
+}
+
+// GetPatient returns the patient the token was issued for
+func (c *Client) GetPatient(tok, patientID string) (*Patient, error) {
+	if patientID == "" {
+		return nil, fmt.Errorf("invalid patient id")
+	}
+	var res PatientResponse
+	err := get(fmt.Sprintf("%s/Patient/%s", strings.TrimSuffix(c.FhirURL, "/"), url.PathEscape(patientID)), tok, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Names) == 0 {
+		return nil, fmt.Errorf("patient %s has no name", patientID)
+	}
+
+	// prefer the patient's official name if they have more than one
+	name := res.Names[0]
+	for _, n := range res.Names {
+		if n.Use == "official" {
+			name = n
+			break
+		}
+	}
+	pat := &Patient{
+		GivenName:  strings.Join(name.Given, " "),
+		FamilyName: name.Family,
+		Gender:     res.Gender,
+	}
+	pat.Name = name.Text
+	if pat.Name == "" {
+		pat.Name = strings.TrimSpace(pat.GivenName + " " + pat.FamilyName)
+	}
+	if res.BirthDate != "" {
+		pat.BirthDate, err = parseDate(res.BirthDate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pat, nil
+}
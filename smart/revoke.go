@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package smart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrRevocationUnsupported is returned when a health system doesn't publish
+// a revocation endpoint
+var ErrRevocationUnsupported = errors.New("the health system doesn't support token revocation")
+
+// RevokeToken revokes an access or refresh token, if the health system
+// publishes a revocation endpoint. hint is "access_token" or "refresh_token".
+// https://tools.ietf.org/html/rfc7009
+func (c *Client) RevokeToken(token, hint string) error {
+	config, err := c.Discover()
+	if err != nil {
+		return err
+	}
+	if config.RevocationEndpoint == "" {
+		return ErrRevocationUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	params := url.Values{}
+	params.Set("token", token)
+	params.Set("token_type_hint", hint)
+	if c.ClientSecret == "" {
+		params.Set("client_id", c.ClientID)
+	}
+
+	log.Printf("revoking a %s at %s", hint, config.RevocationEndpoint)
+	req, err := http.NewRequestWithContext(ctx, "POST", config.RevocationEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(c.ClientID, c.ClientSecret)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Expected 200, got %v", resp.Status)
+	}
+	return nil
+}
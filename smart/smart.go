@@ -0,0 +1,260 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package smart is a client for health systems that offer a SMART on FHIR
+// patient API, which most EHR patient portals do. It performs the standalone
+// launch flow: the user picks their health system in our app, logs in to the
+// portal, and we're handed a token scoped to their record.
+//
+// http://hl7.org/fhir/smart-app-launch/
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScopes are the scopes we request when a health system doesn't
+// configure its own. We need the patient's demographics as well as their
+// immunizations, to check they're the same person as any other records the
+// user has connected.
+const DefaultScopes = "launch/patient patient/Patient.read patient/Immunization.read"
+
+// Configuration is a health system's SMART configuration, published at
+// .well-known/smart-configuration under its FHIR base URL
+// http://hl7.org/fhir/smart-app-launch/conformance.html
+type Configuration struct {
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	RevocationEndpoint    string   `json:"revocation_endpoint"`
+	Capabilities          []string `json:"capabilities"`
+	ScopesSupported       []string `json:"scopes_supported"`
+}
+
+// supports reports whether the configuration lists capability. Servers that
+// don't list any capabilities are given the benefit of the doubt.
+func (c Configuration) supports(capability string) bool {
+	if len(c.Capabilities) == 0 {
+		return true
+	}
+	for _, c := range c.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Client talks to one health system
+type Client struct {
+	// ID identifies the health system in our urls and records
+	ID string
+	// Name is what we call the health system on buttons and cards
+	Name         string
+	ClientID     string
+	ClientSecret string
+	FhirURL      string
+	CallbackURL  string
+	Scopes       string
+
+	mu     sync.Mutex
+	config *Configuration
+}
+
+func (c *Client) String() string {
+	var truncatedSecret string
+	if len(c.ClientSecret) > 5 {
+		truncatedSecret = c.ClientSecret[:5] + "..."
+	} else {
+		truncatedSecret = "<empty>"
+	}
+
+	return fmt.Sprintf("SMART on FHIR Client %s {%s %s %s %s}",
+		c.ID,
+		c.ClientID,
+		truncatedSecret,
+		c.FhirURL,
+		c.CallbackURL)
+}
+
+// Discover fetches the health system's SMART configuration. It's fetched
+// once and remembered; a failure isn't, so a health system that was down
+// gets tried again on the next login.
+func (c *Client) Discover() (*Configuration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config != nil {
+		return c.config, nil
+	}
+
+	var config Configuration
+	err := get(strings.TrimSuffix(c.FhirURL, "/")+"/.well-known/smart-configuration", "", &config)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", c.Name, err)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" {
+		return nil, fmt.Errorf("%s's smart configuration is missing its authorization or token endpoint", c.Name)
+	}
+	if !config.supports("launch-standalone") {
+		return nil, fmt.Errorf("%s doesn't support standalone launch", c.Name)
+	}
+	c.config = &config
+	return c.config, nil
+}
+
+func (c *Client) scopes() string {
+	if c.Scopes == "" {
+		return DefaultScopes
+	}
+	return c.Scopes
+}
+
+// AuthURL returns the url to send the user to to log in to the health
+// system's portal. state is handed back to our callback.
+func (c *Client) AuthURL(state string) (string, error) {
+	config, err := c.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", c.ClientID)
+	params.Set("redirect_uri", c.CallbackURL)
+	params.Set("scope", c.scopes())
+	params.Set("state", state)
+	// the standalone launch has to tell the server which FHIR API the token
+	// is for
+	params.Set("aud", c.FhirURL)
+
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return config.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// FullToken is the token response. Like VA Lighthouse, the server tells us
+// which patient the user picked in the "patient" field.
+type FullToken struct {
+	AccessToken  string  `json:"access_token"`
+	Expires      float32 `json:"expires_in"`
+	TokenType    string  `json:"token_type"`
+	Scope        string  `json:"scope"`
+	RefreshToken string  `json:"refresh_token"`
+	PatientID    string  `json:"patient"`
+}
+
+// GetFullToken exchanges the code from the callback for an access token
+func (c *Client) GetFullToken(code string) (*FullToken, error) {
+	config, err := c.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", c.CallbackURL)
+	// public clients identify themselves in the form; confidential clients
+	// authenticate with basic auth
+	if c.ClientSecret == "" {
+		params.Set("client_id", c.ClientID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(c.ClientID, c.ClientSecret)
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	log.Printf("Request took: %s", time.Since(start))
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Expected 200, got %v", resp.Status)
+	}
+
+	var tok FullToken
+	err = json.Unmarshal(respBody, &tok)
+	if err != nil {
+		return nil, err
+	}
+	if tok.AccessToken == "" || tok.PatientID == "" {
+		return nil, fmt.Errorf("%s didn't return an access token for a patient", c.Name)
+	}
+	return &tok, nil
+}
+
+// get fetches url and decodes the json response into obj. tok is sent as a
+// bearer token if it isn't empty.
+func get(url, tok string, obj interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log.Printf("getting %s", url)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/fhir+json, application/json")
+	if tok != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	log.Printf("Request took: %s", time.Since(start))
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Expected 200, got %s", resp.Status)
+	}
+
+	return json.Unmarshal(respBody, obj)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package smart
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeSystem serves a health system's discovery document, token endpoint and
+// FHIR API from the files in testdata
+func fakeSystem(t *testing.T) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fhir/.well-known/smart-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"authorization_endpoint": "%[1]s/authorize",
+			"token_endpoint": "%[1]s/token",
+			"capabilities": ["launch-standalone", "client-public"]
+		}`, srv.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good-code" || r.PostFormValue("client_id") != "covidrecord" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "tok", "token_type": "Bearer", "patient": "eq081-VQEgP8drUUqCWzHfw3"}`)
+	})
+	mux.HandleFunc("/fhir/Patient/eq081-VQEgP8drUUqCWzHfw3", func(w http.ResponseWriter, r *http.Request) {
+		serveFile(t, w, r, srv.URL, "testdata/patient.json")
+	})
+	mux.HandleFunc("/fhir/Immunization", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"resourceType": "Bundle", "entry": [{"resource": {
+				"resourceType": "Immunization", "id": "4", "status": "completed",
+				"vaccineCode": {"coding": [{"system": "http://hl7.org/fhir/sid/cvx", "code": "208"}]},
+				"occurrenceDateTime": "2021-01-25"}}]}`)
+			return
+		}
+		serveFile(t, w, r, srv.URL, "testdata/immunizations.json")
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func serveFile(t *testing.T, w http.ResponseWriter, r *http.Request, base, path string) {
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.ReplaceAll(string(b), "{{base}}", base+"/fhir")
+	if strings.Contains(path, "immunizations") {
+		// add a second page
+		body = strings.Replace(body, `"link": [`, fmt.Sprintf(`"link": [{"relation": "next", "url": "%s/fhir/Immunization?patient=eq081-VQEgP8drUUqCWzHfw3&page=2"}, `, base), 1)
+	}
+	fmt.Fprint(w, body)
+}
+
+func newClient(srv *httptest.Server) *Client {
+	return &Client{
+		ID:          "valley",
+		Name:        "Valley Medical",
+		ClientID:    "covidrecord",
+		FhirURL:     srv.URL + "/fhir",
+		CallbackURL: "https://localhost.dev:6655/auth/valley/callback",
+	}
+}
+
+func TestAuthURL(t *testing.T) {
+	srv := fakeSystem(t)
+	c := newClient(srv)
+
+	authURL, err := c.AuthURL("some-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/authorize" {
+		t.Errorf("expected the discovered authorization endpoint, got %s", authURL)
+	}
+	q := u.Query()
+	if q.Get("aud") != c.FhirURL || q.Get("state") != "some-state" || q.Get("scope") != DefaultScopes {
+		t.Errorf("unexpected authorization parameters %v", q)
+	}
+	if !strings.Contains(q.Get("scope"), "launch/patient") || !strings.Contains(q.Get("scope"), "patient/Immunization.read") {
+		t.Errorf("expected the standalone launch scopes, got %q", q.Get("scope"))
+	}
+}
+
+func TestDiscoverFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	c := newClient(srv)
+	if _, err := c.AuthURL("state"); err == nil {
+		t.Errorf("expected an error when the health system has no smart configuration")
+	}
+}
+
+func TestFetchRecord(t *testing.T) {
+	srv := fakeSystem(t)
+	c := newClient(srv)
+
+	if _, err := c.GetFullToken("bad-code"); err == nil {
+		t.Errorf("expected an error for a bad code")
+	}
+	tok, err := c.GetFullToken("good-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.PatientID != "eq081-VQEgP8drUUqCWzHfw3" {
+		t.Errorf("expected the patient from the token response, got %q", tok.PatientID)
+	}
+
+	pat, err := c.GetPatient(tok.AccessToken, tok.PatientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pat.Name != "Jason T Argonaut" || pat.FamilyName != "Argonaut" || pat.BirthDate.Format("2006-01-02") != "1985-08-01" {
+		t.Errorf("unexpected patient %#v", pat)
+	}
+
+	vaxes, err := c.GetVaccinations(tok.AccessToken, tok.PatientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the flu shot and the dose entered in error are skipped, and the second
+	// dose is on the next page
+	if len(vaxes) != 2 {
+		t.Fatalf("expected two covid vaccinations, got %#v", vaxes)
+	}
+	if vaxes[0].Code != "208" || vaxes[0].Lot != "EL9261" || vaxes[0].Location != "Valley Medical Center" {
+		t.Errorf("unexpected first dose %#v", vaxes[0])
+	}
+	if vaxes[1].Date.Format("2006-01-02") != "2021-01-25" {
+		t.Errorf("unexpected second dose %#v", vaxes[1])
+	}
+}
+
+func TestRevokeTokenUnsupported(t *testing.T) {
+	srv := fakeSystem(t)
+	c := newClient(srv)
+
+	if err := c.RevokeToken("tok", "access_token"); err != ErrRevocationUnsupported {
+		t.Errorf("expected revocation to be unsupported without an endpoint, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/adhocteam/covidreport/i18n"
+)
+
+// the templates are compiled into the binary so that it doesn't need to be
+// run from the repository root
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// templateFuncs are the functions templates use to show text and dates in the
+// page's language:
+//
+//	{{t "card.nextDoseDue"}}, {{t "connect.provider" .Name}}
+//	{{n "card.dosesRemaining" 2}} picks the singular or plural message
+//	{{date .Date}}, {{dob .BirthDate}} and {{datetime .NegativeUntil}}
+//
+// and {{nonce}} is the page's Content-Security-Policy nonce, which every
+// <script> and <style> needs. It's set for each page by renderTemplateStatus.
+func templateFuncs(cat *i18n.Catalog) template.FuncMap {
+	return template.FuncMap{
+		"nonce":    func() string { return "" },
+		"lang":     func() string { return cat.Lang },
+		"t":        cat.T,
+		"n":        cat.N,
+		"date":     cat.Date,
+		"datetime": cat.DateTime,
+		"dob": func(t i18n.Time) string {
+			return cat.Format("dob.format", t)
+		},
+	}
+}
+
+// newTemplates returns an empty set of templates with the functions for a
+// language
+func newTemplates(lang string) *template.Template {
+	return template.New("").Funcs(templateFuncs(i18n.Lookup(lang)))
+}
+
+// templates is parsed once at startup from the embedded files, once for each
+// language. They're never executed themselves, only cloned, since a template
+// can't be cloned once it has been.
+var templates = func() map[string]*template.Template {
+	sets := make(map[string]*template.Template, len(i18n.Supported))
+	for _, lang := range i18n.Supported {
+		sets[lang] = template.Must(newTemplates(lang).ParseFS(templateFS, "templates/*.html"))
+	}
+	return sets
+}()
+
+// reloadTemplates makes renderTemplate re-read the templates from disk on every
+// request, so you can edit them without restarting the server. Set
+// COVID_RECORD_DEV to turn it on.
+var reloadTemplates = env("COVID_RECORD_DEV", "") != ""
+
+// loadTemplates returns the set of templates to render a language with
+func loadTemplates(lang string) (*template.Template, error) {
+	if reloadTemplates {
+		return newTemplates(lang).ParseGlob("templates/*.html")
+	}
+	return templates[i18n.Lookup(lang).Lang], nil
+}
+
+// renderTemplate renders the named template with a 200 status
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	renderTemplateStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderError renders the error page with the given status code, in the
+// request's language if it's an error we have messages for
+func renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	renderTemplateStatus(w, r, status, "error.html", localizeError(r, err))
+}
+
+// renderTemplateStatus executes the named template into a buffer before writing
+// anything, so that a failure part of the way through a page results in a
+// clean error page instead of half a card. The page is in the request's
+// language, with its nonce.
+func renderTemplateStatus(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	lang := requestLang(r)
+	t, err := loadTemplates(lang)
+	if err == nil {
+		t, err = t.Clone()
+	}
+	if err != nil {
+		log.Printf("error loading templates: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	nonce := cspNonce(r)
+	t.Funcs(template.FuncMap{"nonce": func() string { return nonce }})
+
+	var buf bytes.Buffer
+	err = t.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		log.Printf("error rendering %s: %s", name, err)
+
+		// don't try to render the error page with itself
+		if name == "error.html" {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("error writing %s: %s", name, err)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run `go test -update` to regenerate the golden files after an intentional
+// change to the templates
+var update = flag.Bool("update", false, "update golden files")
+
+// checkGolden compares got against testdata/golden/<name>, or overwrites the
+// golden file when -update is given
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match golden file; rerun with -update if the change is intentional\n%s", name, got)
+	}
+}
+
+func TestCallbackGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		persona string
+	}{
+		{"pending", "pending"},
+		{"partial", "pfizer-partial"},
+		{"complete", "pfizer-complete"},
+		{"boosted", "boosted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/showCallback?persona="+tt.persona, nil)
+			server := &CovidRecord{Sessions: NewSessionStore(time.Minute)}
+			server.staticCallback(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			checkGolden(t, "callback_"+tt.name+".html", w.Body.Bytes())
+		})
+	}
+}
+
+func TestRenderTemplateError(t *testing.T) {
+	// callback.html can't render without any vaccinations field, so this
+	// should fail part of the way through
+	w := httptest.NewRecorder()
+	renderTemplate(w, httptest.NewRequest("GET", "/", nil), "callback.html", struct{}{})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "Error occurred") {
+		t.Errorf("expected the error page, got %s", body)
+	}
+	if strings.Contains(body, `class="card-scene`) {
+		t.Errorf("expected no partial card output, got %s", body)
+	}
+}
+
+func TestRenderErrorStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/bbcallback", nil)
+	newTestServer(t).Handler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a callback without a code, got %d", w.Code)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/lighthouse/vatest"
+)
+
+// newVAServer returns a server whose only provider is a fake VA Lighthouse
+// serving the given scenarios
+func newVAServer(t *testing.T, scenarios ...vatest.Scenario) (*CovidRecord, *vatest.Server) {
+	t.Helper()
+	va := vatest.NewServer("va-client", "va-secret", scenarios...)
+	t.Cleanup(va.Close)
+	reg, err := NewRegistry([]ProviderConfig{{
+		ID:           "lighthouse",
+		Type:         providerLighthouse,
+		Name:         "VA Lighthouse",
+		AuthURL:      va.URL,
+		FhirURL:      va.FhirURL(),
+		ClientID:     "va-client",
+		ClientSecret: "va-secret",
+		RedirectURL:  "https://localhost.dev:6655/callback",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CovidRecord{Sessions: NewSessionStore(time.Minute), Providers: reg}, va
+}
+
+// vaLogin logs in to the fake VA as scenario, and returns the response to the
+// callback
+func vaLogin(t *testing.T, handler http.Handler, scenario string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	return fakeLogin(t, handler, "lighthouse", vatest.Login, scenario, cookies...)
+}
+
+func TestVACallback(t *testing.T) {
+	tests := []struct {
+		scenario string
+		status   int
+		expect   []string
+		absent   []string
+	}{
+		{"moderna-complete", http.StatusOK, []string{
+			"Tamara Ellis", "19 Jun 1967", "VACCINATION COMPLETE",
+			"6 Jan 2021", "3 Feb 2021", "Cheyenne VA Medical Center", "037K20A", "011J20A",
+			"COVID-19 Tests", "PCR test", "23 Nov 2020", "Positive", "20 Sep 2021", "Negative",
+		}, nil},
+		{"pfizer-partial", http.StatusOK, []string{"Marcus Delgado", "PARTIAL VACCINATION", "17 Feb 2021", "Tampa VA Clinic", "EN6201", "Antigen test", "15 Feb 2021"}, nil},
+		// the card is shown without the test results the VA couldn't send
+		{"labs-outage", http.StatusOK, []string{"Denise Holloway", "VACCINATION COMPLETE", "19 Jan 2021", "16 Feb 2021"}, []string{"COVID-19 Tests", "2 Mar 2021"}},
+		{"token-expired", http.StatusInternalServerError, []string{"Your VA login expired"}, nil},
+		{"fhir-outage", http.StatusInternalServerError, nil, nil},
+		{"deny", http.StatusBadRequest, []string{"access_denied"}, nil},
+	}
+
+	server, _ := newVAServer(t)
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			w := vaLogin(t, server.Handler(), tt.scenario)
+			if w.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			for _, s := range tt.expect {
+				if !strings.Contains(w.Body.String(), s) {
+					t.Errorf("expected the page to contain %q", s)
+				}
+			}
+			for _, s := range tt.absent {
+				if strings.Contains(w.Body.String(), s) {
+					t.Errorf("expected the page not to contain %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestVACallbackSlow(t *testing.T) {
+	slow := vatest.MustScenario("slow-fhir")
+	slow.Delays["immunization"] = vatest.Duration{Duration: time.Second}
+	server, va := newVAServer(t, slow)
+	server.Providers.Enabled()[0].impl.(*vaProvider).client.Timeout = 50 * time.Millisecond
+
+	w := vaLogin(t, server.Handler(), "slow-fhir")
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "took too long") {
+		t.Errorf("expected the VA to time out, got %d: %s", w.Code, w.Body)
+	}
+	// we couldn't use the tokens, so they're revoked straight away
+	if len(va.Revoked()) != 2 {
+		t.Errorf("expected the refresh and access tokens to be revoked, got %v", va.Revoked())
+	}
+}
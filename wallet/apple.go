@@ -0,0 +1,355 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package wallet builds passes that put the vaccination card in a phone's
+// wallet app.
+package wallet
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"image"
+	"image/png"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// PKPassContentType is the mime type for an Apple Wallet pass
+const PKPassContentType = "application/vnd.apple.pkpass"
+
+// AppleWallet builds signed Apple Wallet passes
+// https://developer.apple.com/documentation/walletpasses
+type AppleWallet struct {
+	PassTypeID       string
+	TeamID           string
+	OrganizationName string
+
+	// Certificate and Key are the pass type id certificate Apple issued us and
+	// its private key. Intermediates should hold Apple's WWDR certificate.
+	Certificate   *x509.Certificate
+	Key           *rsa.PrivateKey
+	Intermediates []*x509.Certificate
+
+	// Images are included in the pass as-is, keyed by file name. A pass
+	// must at least have an icon.png.
+	Images map[string][]byte
+}
+
+// NewAppleWallet parses a PEM encoded pass certificate, private key and
+// (optionally) intermediate certificates
+func NewAppleWallet(passTypeID, teamID, certPEM, keyPEM, intermediatePEM string) (*AppleWallet, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found for apple wallet")
+	}
+	intermediates, err := parseCertificates(intermediatePEM)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseRSAKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AppleWallet{
+		PassTypeID:       passTypeID,
+		TeamID:           teamID,
+		OrganizationName: "Ad Hoc",
+		Certificate:      certs[0],
+		Key:              key,
+		Intermediates:    append(certs[1:], intermediates...),
+	}, nil
+}
+
+func parseCertificates(in string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(in)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// parseRSAKey parses a PEM encoded RSA private key in either PKCS#1 or PKCS#8
+// form
+func parseRSAKey(in string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(in))
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA private key, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+// IconSet scales a square png into the icon sizes a pass wants
+func IconSet(src []byte) (map[string][]byte, error) {
+	img, err := png.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	icons := map[string][]byte{}
+	for name, size := range map[string]int{"icon.png": 29, "icon@2x.png": 58, "icon@3x.png": 87} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, scale(img, size)); err != nil {
+			return nil, err
+		}
+		icons[name] = buf.Bytes()
+	}
+	return icons, nil
+}
+
+// scale shrinks img to size x size by averaging the source pixels that fall
+// in each destination pixel
+func scale(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/size, b.Min.Y+(y+1)*b.Dy()/size
+		for x := 0; x < size; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/size, b.Min.X+(x+1)*b.Dx()/size
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			// RGBA returns alpha-premultiplied values; NRGBA wants them
+			// straight
+			i := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[i+0] = uint8(r * 0xff / a)
+				dst.Pix[i+1] = uint8(g * 0xff / a)
+				dst.Pix[i+2] = uint8(bl * 0xff / a)
+			}
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+type passField struct {
+	Key   string `json:"key"`
+	Label string `json:"label,omitempty"`
+	Value string `json:"value"`
+}
+
+type passBarcode struct {
+	Format          string `json:"format"`
+	Message         string `json:"message"`
+	MessageEncoding string `json:"messageEncoding"`
+	AltText         string `json:"altText,omitempty"`
+}
+
+type passStructure struct {
+	PrimaryFields   []passField `json:"primaryFields"`
+	SecondaryFields []passField `json:"secondaryFields,omitempty"`
+	AuxiliaryFields []passField `json:"auxiliaryFields,omitempty"`
+	BackFields      []passField `json:"backFields,omitempty"`
+}
+
+type pass struct {
+	FormatVersion      int           `json:"formatVersion"`
+	PassTypeIdentifier string        `json:"passTypeIdentifier"`
+	SerialNumber       string        `json:"serialNumber"`
+	TeamIdentifier     string        `json:"teamIdentifier"`
+	OrganizationName   string        `json:"organizationName"`
+	Description        string        `json:"description"`
+	LogoText           string        `json:"logoText"`
+	ForegroundColor    string        `json:"foregroundColor"`
+	BackgroundColor    string        `json:"backgroundColor"`
+	LabelColor         string        `json:"labelColor"`
+	Generic            passStructure `json:"generic"`
+	Barcodes           []passBarcode `json:"barcodes"`
+	// Barcode is deprecated in favor of Barcodes, but is still needed by
+	// iOS 8 and earlier
+	Barcode passBarcode `json:"barcode"`
+}
+
+// statusColors are the background, foreground and label colors for each
+// status, matching the html card
+var statusColors = map[record.Status][3]string{
+	record.StatusPending:  {"rgb(216, 57, 51)", "rgb(255, 255, 255)", "rgb(248, 225, 222)"},
+	record.StatusPartial:  {"rgb(250, 206, 0)", "rgb(0, 0, 0)", "rgb(119, 96, 23)"},
+	record.StatusComplete: {"rgb(0, 169, 28)", "rgb(255, 255, 255)", "rgb(227, 245, 225)"},
+	record.StatusBoosted:  {"rgb(0, 136, 23)", "rgb(255, 255, 255)", "rgb(227, 245, 225)"},
+}
+
+var statusLabels = map[record.Status]string{
+	record.StatusPending:  "Vaccination pending",
+	record.StatusPartial:  "Partial vaccination",
+	record.StatusComplete: "Vaccination complete",
+	record.StatusBoosted:  "Vaccinated and boosted",
+}
+
+func makeSerialNumber() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("Unable to get random numbers")
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// newPass builds the pass.json contents for a record
+func (a *AppleWallet) newPass(rec *record.Record, qrPayload string) pass {
+	summary := rec.Summary()
+	colors := statusColors[summary.Status]
+
+	barcode := passBarcode{
+		Format:          "PKBarcodeFormatQR",
+		Message:         qrPayload,
+		MessageEncoding: "utf-8",
+	}
+
+	p := pass{
+		FormatVersion:      1,
+		PassTypeIdentifier: a.PassTypeID,
+		SerialNumber:       makeSerialNumber(),
+		TeamIdentifier:     a.TeamID,
+		OrganizationName:   a.OrganizationName,
+		Description:        "COVID-19 Vaccination Record",
+		LogoText:           "COVID-19 Vaccination",
+		BackgroundColor:    colors[0],
+		ForegroundColor:    colors[1],
+		LabelColor:         colors[2],
+		Barcodes:           []passBarcode{barcode},
+		Barcode:            barcode,
+		Generic: passStructure{
+			PrimaryFields: []passField{{Key: "name", Label: "NAME", Value: rec.Patient.Name}},
+			SecondaryFields: []passField{
+				{Key: "status", Label: "STATUS", Value: statusLabels[summary.Status]},
+			},
+			AuxiliaryFields: []passField{
+				{Key: "doses", Label: "DOSES", Value: fmt.Sprintf("%d of %d", summary.DosesGiven, summary.DosesRequired)},
+			},
+		},
+	}
+	if !rec.Patient.BirthDate.IsZero() {
+		p.Generic.SecondaryFields = append(p.Generic.SecondaryFields,
+			passField{Key: "dob", Label: "DATE OF BIRTH", Value: rec.Patient.BirthDate.Format("02 Jan 2006")})
+	}
+
+	for i, dose := range rec.Doses {
+		lines := []string{dose.Date.Format("2 Jan 2006")}
+		for _, s := range []string{dose.Product, dose.Location} {
+			if s != "" {
+				lines = append(lines, s)
+			}
+		}
+		if dose.Lot != "" {
+			lines = append(lines, "Lot "+dose.Lot)
+		}
+		p.Generic.BackFields = append(p.Generic.BackFields, passField{
+			Key:   fmt.Sprintf("dose%d", i+1),
+			Label: fmt.Sprintf("Dose %d", i+1),
+			Value: strings.Join(lines, "\n"),
+		})
+	}
+	return p
+}
+
+// Pass builds a signed .pkpass for rec, whose barcode encodes qrPayload
+func (a *AppleWallet) Pass(rec *record.Record, qrPayload string) ([]byte, error) {
+	passJSON, err := json.MarshalIndent(a.newPass(rec, qrPayload), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{"pass.json": passJSON}
+	for name, b := range a.Images {
+		files[name] = b
+	}
+	if _, ok := files["icon.png"]; !ok {
+		return nil, fmt.Errorf("apple wallet passes require an icon.png")
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	manifest := map[string]string{}
+	for _, name := range names {
+		manifest[name] = fmt.Sprintf("%x", sha1.Sum(files[name]))
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signDetached(manifestJSON, a.Certificate, a.Key, a.Intermediates, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	names = append(names, "manifest.json", "signature")
+	files["manifest.json"] = manifestJSON
+	files["signature"] = signature
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package wallet
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// selfSigned generates a throwaway certificate and key, PEM encoded
+func selfSigned(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "Pass Type ID: pass.test.covidreport"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return string(certPEM), string(keyPEM)
+}
+
+func testIcon(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.NRGBA{0, 0x66, 0xff, 0xff})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testRecord() *record.Record {
+	return &record.Record{
+		Patient: record.Patient{
+			Name:      "Jane X Doe",
+			BirthDate: record.Date{Time: time.Date(1999, 6, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		Doses: []record.Dose{{
+			Date:     record.Date{Time: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)},
+			Code:     "0011A",
+			Product:  "Moderna COVID-19 Vaccine",
+			Location: "Northshore Clinic",
+			Lot:      "012L20A",
+		}},
+	}
+}
+
+// verifySignature checks a detached signature made by signDetached
+func verifySignature(t *testing.T, sig, content []byte, cert *x509.Certificate) {
+	t.Helper()
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(sig, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("expected signed data, got %v", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		t.Fatalf("expected one signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	if si.IssuerAndSerialNumber.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("signer serial number doesn't match the certificate")
+	}
+
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.AuthenticatedAttributes.Bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(signed)
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], si.EncryptedDigest); err != nil {
+		t.Errorf("bad signature: %s", err)
+	}
+
+	// find the message digest among the signed attributes
+	contentDigest := sha256.Sum256(content)
+	rest := si.AuthenticatedAttributes.Bytes
+	found := false
+	for len(rest) > 0 {
+		var attr attribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.Type.Equal(oidMessageDigest) {
+			var md []byte
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &md); err != nil {
+				t.Fatal(err)
+			}
+			found = bytes.Equal(md, contentDigest[:])
+		}
+	}
+	if !found {
+		t.Errorf("signed attributes don't include the manifest's digest")
+	}
+}
+
+func TestApplePass(t *testing.T) {
+	certPEM, keyPEM := selfSigned(t)
+	aw, err := NewAppleWallet("pass.test.covidreport", "TEAMID1234", certPEM, keyPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Images, err = IconSet(testIcon(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkpass, err := aw.Pass(testRecord(), "HC1:TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(pkpass), int64(len(pkpass)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"pass.json", "manifest.json", "signature", "icon.png", "icon@2x.png", "icon@3x.png"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("pass is missing %s", name)
+		}
+	}
+
+	var manifest map[string]string
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range files {
+		if name == "manifest.json" || name == "signature" {
+			continue
+		}
+		if manifest[name] != fmt.Sprintf("%x", sha1.Sum(b)) {
+			t.Errorf("manifest has the wrong hash for %s", name)
+		}
+	}
+
+	var p pass
+	if err := json.Unmarshal(files["pass.json"], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Barcodes[0].Message != "HC1:TEST" || p.Generic.PrimaryFields[0].Value != "Jane X Doe" {
+		t.Errorf("unexpected pass %s", files["pass.json"])
+	}
+	if p.Generic.SecondaryFields[0].Value != "Partial vaccination" || len(p.Generic.BackFields) != 1 {
+		t.Errorf("unexpected pass %s", files["pass.json"])
+	}
+
+	verifySignature(t, files["signature"], files["manifest.json"], aw.Certificate)
+}
+
+func TestIconSet(t *testing.T) {
+	icons, err := IconSet(testIcon(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(icons["icon@2x.png"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 58 || b.Dy() != 58 {
+		t.Errorf("expected a 58x58 icon, got %v", b)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package wallet
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adhocteam/covidreport/record"
+)
+
+// GoogleSaveURL is where a signed "Save to Google Pay" jwt is sent
+const GoogleSaveURL = "https://pay.google.com/gp/v/save/"
+
+// GoogleWallet builds "Save to Google Pay" links for generic passes
+// https://developers.google.com/pay/passes/guides/pass-verticals/generic
+type GoogleWallet struct {
+	// IssuerID is our Google Pay issuer id, and ClassID the suffix of the
+	// generic class we created for the card
+	IssuerID string
+	ClassID  string
+
+	// ServiceAccount and Key are the email and private key of the service
+	// account authorized to issue passes
+	ServiceAccount string
+	KeyID          string
+	Key            *rsa.PrivateKey
+
+	// LogoURL is a public url for the logo shown on the pass
+	LogoURL string
+}
+
+// serviceAccountFile is the json key file google gives you for a service
+// account; we only need a few of its fields
+type serviceAccountFile struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+}
+
+// NewGoogleWallet configures Google Wallet passes from a service account's
+// json key file
+func NewGoogleWallet(issuerID, classID, serviceAccountJSON string) (*GoogleWallet, error) {
+	var sa serviceAccountFile
+	if err := json.Unmarshal([]byte(serviceAccountJSON), &sa); err != nil {
+		return nil, fmt.Errorf("unable to parse service account: %w", err)
+	}
+	key, err := parseRSAKey(sa.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleWallet{
+		IssuerID:       issuerID,
+		ClassID:        classID,
+		ServiceAccount: sa.ClientEmail,
+		KeyID:          sa.PrivateKeyID,
+		Key:            key,
+	}, nil
+}
+
+type localizedString struct {
+	DefaultValue struct {
+		Language string `json:"language"`
+		Value    string `json:"value"`
+	} `json:"defaultValue"`
+}
+
+func localized(s string) localizedString {
+	var ls localizedString
+	ls.DefaultValue.Language = "en-US"
+	ls.DefaultValue.Value = s
+	return ls
+}
+
+type textModule struct {
+	ID     string `json:"id"`
+	Header string `json:"header"`
+	Body   string `json:"body"`
+}
+
+type googleBarcode struct {
+	Type          string `json:"type"`
+	Value         string `json:"value"`
+	AlternateText string `json:"alternateText,omitempty"`
+}
+
+type googleImage struct {
+	SourceURI struct {
+		URI string `json:"uri"`
+	} `json:"sourceUri"`
+}
+
+// GenericObject is a Google Pay generic pass object
+// https://developers.google.com/pay/passes/reference/v1/genericobject
+type GenericObject struct {
+	ID                 string          `json:"id"`
+	ClassID            string          `json:"classId"`
+	State              string          `json:"state"`
+	CardTitle          localizedString `json:"cardTitle"`
+	Header             localizedString `json:"header"`
+	Subheader          localizedString `json:"subheader"`
+	HexBackgroundColor string          `json:"hexBackgroundColor"`
+	Logo               *googleImage    `json:"logo,omitempty"`
+	Barcode            googleBarcode   `json:"barcode"`
+	TextModulesData    []textModule    `json:"textModulesData"`
+}
+
+// SaveClaims are the claims of a "Save to Google Pay" jwt
+type SaveClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	Type     string `json:"typ"`
+	IssuedAt int64  `json:"iat"`
+	Payload  struct {
+		GenericObjects []GenericObject `json:"genericObjects"`
+	} `json:"payload"`
+}
+
+var googleBackgroundColors = map[record.Status]string{
+	record.StatusPending:  "#D83933",
+	record.StatusPartial:  "#FACE00",
+	record.StatusComplete: "#00A91C",
+	record.StatusBoosted:  "#008817",
+}
+
+// Object builds the generic pass object for rec, whose barcode encodes
+// qrPayload
+func (g *GoogleWallet) Object(rec *record.Record, qrPayload string) GenericObject {
+	summary := rec.Summary()
+
+	obj := GenericObject{
+		ID:                 fmt.Sprintf("%s.%s", g.IssuerID, makeSerialNumber()),
+		ClassID:            fmt.Sprintf("%s.%s", g.IssuerID, g.ClassID),
+		State:              "ACTIVE",
+		CardTitle:          localized("COVID-19 Vaccination Record"),
+		Header:             localized(rec.Patient.Name),
+		Subheader:          localized(statusLabels[summary.Status]),
+		HexBackgroundColor: googleBackgroundColors[summary.Status],
+		Barcode: googleBarcode{
+			Type:          "QR_CODE",
+			Value:         qrPayload,
+			AlternateText: statusLabels[summary.Status],
+		},
+	}
+	if g.LogoURL != "" {
+		obj.Logo = &googleImage{}
+		obj.Logo.SourceURI.URI = g.LogoURL
+	}
+
+	if !rec.Patient.BirthDate.IsZero() {
+		obj.TextModulesData = append(obj.TextModulesData, textModule{
+			ID: "dob", Header: "Date of birth", Body: rec.Patient.BirthDate.Format("02 Jan 2006"),
+		})
+	}
+	obj.TextModulesData = append(obj.TextModulesData, textModule{
+		ID: "doses", Header: "Doses", Body: fmt.Sprintf("%d of %d", summary.DosesGiven, summary.DosesRequired),
+	})
+	for i, dose := range rec.Doses {
+		lines := []string{dose.Date.Format("2 Jan 2006")}
+		for _, s := range []string{dose.Product, dose.Location} {
+			if s != "" {
+				lines = append(lines, s)
+			}
+		}
+		if dose.Lot != "" {
+			lines = append(lines, "Lot "+dose.Lot)
+		}
+		obj.TextModulesData = append(obj.TextModulesData, textModule{
+			ID:     fmt.Sprintf("dose%d", i+1),
+			Header: fmt.Sprintf("Dose %d", i+1),
+			Body:   strings.Join(lines, "\n"),
+		})
+	}
+	return obj
+}
+
+// Claims builds the claims for a jwt saving rec's pass
+func (g *GoogleWallet) Claims(rec *record.Record, qrPayload string, now time.Time) SaveClaims {
+	claims := SaveClaims{
+		Issuer:   g.ServiceAccount,
+		Audience: "google",
+		Type:     "savetowallet",
+		IssuedAt: now.Unix(),
+	}
+	claims.Payload.GenericObjects = []GenericObject{g.Object(rec, qrPayload)}
+	return claims
+}
+
+// signJWT returns claims as a jwt signed with RS256
+func signJWT(claims interface{}, keyID string, key *rsa.PrivateKey) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// SaveURL returns a "Save to Google Pay" link for rec's pass
+func (g *GoogleWallet) SaveURL(rec *record.Record, qrPayload string) (string, error) {
+	jwt, err := signJWT(g.Claims(rec, qrPayload, time.Now()), g.KeyID, g.Key)
+	if err != nil {
+		return "", err
+	}
+	return GoogleSaveURL + jwt, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Ad Hoc LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package wallet
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testGoogleWallet(t *testing.T) *GoogleWallet {
+	t.Helper()
+	_, keyPEM := selfSigned(t)
+	sa, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "passes@covidrecord.iam.gserviceaccount.com",
+		"private_key_id": "abc123",
+		"private_key":    keyPEM,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw, err := NewGoogleWallet("3388000000012345678", "covid_vaccination", string(sa))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.LogoURL = "https://example.com/icon.png"
+	return gw
+}
+
+func TestGoogleObject(t *testing.T) {
+	gw := testGoogleWallet(t)
+	obj := gw.Object(testRecord(), "HC1:TEST")
+
+	if !strings.HasPrefix(obj.ID, "3388000000012345678.") || obj.ClassID != "3388000000012345678.covid_vaccination" {
+		t.Errorf("unexpected ids %s %s", obj.ID, obj.ClassID)
+	}
+	if obj.Header.DefaultValue.Value != "Jane X Doe" || obj.Subheader.DefaultValue.Value != "Partial vaccination" {
+		t.Errorf("unexpected header %v %v", obj.Header, obj.Subheader)
+	}
+	if obj.Barcode.Type != "QR_CODE" || obj.Barcode.Value != "HC1:TEST" {
+		t.Errorf("unexpected barcode %v", obj.Barcode)
+	}
+	if obj.HexBackgroundColor != "#FACE00" || obj.Logo == nil {
+		t.Errorf("unexpected styling %v %v", obj.HexBackgroundColor, obj.Logo)
+	}
+	last := obj.TextModulesData[len(obj.TextModulesData)-1]
+	if last.Header != "Dose 1" || !strings.Contains(last.Body, "Lot 012L20A") {
+		t.Errorf("unexpected dose module %v", last)
+	}
+}
+
+func TestGoogleSaveURL(t *testing.T) {
+	gw := testGoogleWallet(t)
+	u, err := gw.SaveURL(testRecord(), "HC1:TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u, GoogleSaveURL) {
+		t.Fatalf("unexpected save url %s", u)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(u, GoogleSaveURL), ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a three part jwt, got %d parts", len(parts))
+	}
+	enc := base64.RawURLEncoding
+
+	header, err := enc.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != `{"alg":"RS256","kid":"abc123","typ":"JWT"}` {
+		t.Errorf("unexpected header %s", header)
+	}
+
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&gw.Key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("bad signature: %s", err)
+	}
+
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims SaveClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "passes@covidrecord.iam.gserviceaccount.com" || claims.Audience != "google" || claims.Type != "savetowallet" {
+		t.Errorf("unexpected claims %s", payload)
+	}
+	if len(claims.Payload.GenericObjects) != 1 {
+		t.Errorf("expected one pass object, got %s", payload)
+	}
+}
+
+func TestNewGoogleWalletBadKey(t *testing.T) {
+	if _, err := NewGoogleWallet("1", "c", `{"private_key": "nope"}`); err == nil {
+		t.Errorf("expected an error for a bad private key")
+	}
+}